@@ -0,0 +1,156 @@
+// rotatekeys เข้ารหัสข้อมูลลับทุกรายการใหม่ด้วย primary key
+// ได้แก่ password/secondPassword ของ listing และ secret ของ handover
+// ใช้หลังเพิ่ม key ใหม่ใน ENCRYPTION_KEYS หรือเพื่อย้ายข้อมูลจาก AES-CFB เดิม
+// รหัสที่ถูกบันทึกไว้แบบไม่เข้ารหัสจะถูกเข้ารหัสด้วย
+//
+//	go run ./cmd/rotatekeys          # เข้ารหัสใหม่
+//	go run ./cmd/rotatekeys -dry-run # แค่นับว่ามีกี่รายการที่ต้องย้าย
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type rotationTarget struct {
+	collection string
+	fields     []string
+}
+
+var rotationTargets = []rotationTarget{
+	{collection: "listings", fields: []string{"password", "secondPassword"}},
+	{collection: "handovers", fields: []string{"secret"}},
+}
+
+type rotationStats struct {
+	scanned, rotated, plaintext, failed int
+}
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "report documents that need re-encryption without writing")
+	flag.Parse()
+
+	config.ConnectDB()
+	if err := utils.LoadEncryptionKeys(); err != nil {
+		log.Fatal("Failed to load encryption keys: ", err)
+	}
+	log.Println("Rotating credentials to key:", utils.PrimaryKeyID())
+
+	ctx := context.Background()
+	failed := 0
+	for _, target := range rotationTargets {
+		stats, err := rotateCollection(ctx, config.GetCollection(target.collection), target.fields, *dryRun)
+		if err != nil {
+			log.Fatal("Failed to rotate ", target.collection, ": ", err)
+		}
+		log.Printf("%s: scanned %d, re-encrypted %d (%d were plaintext), failed %d (dry run: %v)",
+			target.collection, stats.scanned, stats.rotated, stats.plaintext, stats.failed, *dryRun)
+		failed += stats.failed
+	}
+
+	if failed > 0 {
+		log.Fatal("Some documents could not be rotated")
+	}
+}
+
+// แปลงค่าของ field ให้อยู่ในรูปแบบปัจจุบัน คืน plaintext=true ถ้าค่าเดิมไม่ได้เข้ารหัส
+func reencrypt(value string) (encrypted string, plaintext bool, err error) {
+	if utils.LooksLikePlaintext(value) {
+		encrypted, err = utils.Encrypt(value)
+		return encrypted, true, err
+	}
+	decrypted, err := utils.Decrypt(value)
+	if err != nil {
+		return "", false, err
+	}
+	encrypted, err = utils.Encrypt(decrypted)
+	return encrypted, false, err
+}
+
+func rotateCollection(ctx context.Context, collection *mongo.Collection, fields []string, dryRun bool) (rotationStats, error) {
+	var stats rotationStats
+
+	projection := bson.M{}
+	for _, field := range fields {
+		projection[field] = 1
+	}
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetProjection(projection))
+	if err != nil {
+		return stats, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			log.Println("Failed to decode", collection.Name(), "document:", err)
+			stats.failed++
+			continue
+		}
+		stats.scanned++
+		id := doc["_id"]
+
+		current := map[string]string{}
+		set := bson.M{}
+		plaintext := false
+		ok := true
+		for _, field := range fields {
+			value, _ := doc[field].(string)
+			if value == "" || (!utils.NeedsReencryption(value) && !utils.LooksLikePlaintext(value)) {
+				continue
+			}
+			encrypted, wasPlaintext, err := reencrypt(value)
+			if err != nil {
+				log.Println("Cannot re-encrypt", field, "of", collection.Name(), id, ":", err)
+				ok = false
+				break
+			}
+			current[field] = value
+			set[field] = encrypted
+			plaintext = plaintext || wasPlaintext
+		}
+		if !ok {
+			stats.failed++
+			continue
+		}
+		if len(set) == 0 {
+			continue
+		}
+		if dryRun {
+			stats.rotated++
+			if plaintext {
+				stats.plaintext++
+			}
+			continue
+		}
+
+		// อัปเดตเฉพาะเมื่อค่าเดิมยังไม่ถูกแก้ระหว่างที่รันอยู่
+		filter := bson.M{"_id": id}
+		for field, value := range current {
+			filter[field] = value
+		}
+		result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": set})
+		if err != nil {
+			log.Println("Failed to update", collection.Name(), id, ":", err)
+			stats.failed++
+			continue
+		}
+		if result.MatchedCount == 0 {
+			log.Println(collection.Name(), id, "changed during rotation, skipped")
+			continue
+		}
+		stats.rotated++
+		if plaintext {
+			stats.plaintext++
+		}
+	}
+	return stats, cursor.Err()
+}
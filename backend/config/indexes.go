@@ -0,0 +1,123 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const chatEventRetention = 7 * 24 * time.Hour
+
+// index ที่ query หลักของระบบต้องใช้ สร้างซ้ำได้โดยไม่มีผลอะไร
+var collectionIndexes = map[string][]mongo.IndexModel{
+	"listings": {
+		{Keys: bson.D{{Key: "title", Value: "text"}, {Key: "description", Value: "text"}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "price", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "favorites", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "game", Value: 1}, {Key: "status", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "userEmail", Value: 1}}},
+	},
+	// ใช้ตอน $lookup ผู้ขายของประกาศ
+	"users": {
+		{Keys: bson.D{{Key: "email", Value: 1}}},
+	},
+	"messages": {
+		{Keys: bson.D{{Key: "group_id", Value: 1}, {Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}},
+		{
+			Keys: bson.D{{Key: "group_id", Value: 1}, {Key: "senderEmail", Value: 1}, {Key: "client_id", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"client_id": bson.M{"$type": "string"}}),
+		},
+	},
+	"groups": {
+		{Keys: bson.D{{Key: "members", Value: 1}, {Key: "last_message_at", Value: -1}, {Key: "_id", Value: -1}}},
+	},
+	"chat_attachments": {
+		{Keys: bson.D{{Key: "group_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		// โควตาต่อผู้ใช้ และการลบไฟล์ที่ไม่ถูกส่ง
+		{Keys: bson.D{{Key: "uploader", Value: 1}, {Key: "message_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "message_id", Value: 1}, {Key: "created_at", Value: 1}}},
+	},
+	// event ใช้แค่ตอน catch-up ของ client ที่หลุดไปไม่นาน จึงเก็บไว้ chatEventRetention แล้วให้ TTL ลบ
+	"chat_events": {
+		{Keys: bson.D{{Key: "group_id", Value: 1}, {Key: "at", Value: 1}}},
+		{Keys: bson.D{{Key: "at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(chatEventRetention.Seconds()))},
+	},
+	// webhook upsert ตาม sourceId หรือ chargeId ส่วนประวัติการชำระเงินเรียงตาม createdAt ของผู้ซื้อหรือผู้ขาย
+	// charge ที่ไม่มี source ถูกบันทึกด้วย sourceId ว่าง จึงไม่นับใน unique
+	"payments": {
+		{
+			Keys: bson.D{{Key: "sourceId", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"sourceId": bson.M{"$gt": ""}}),
+		},
+		{Keys: bson.D{{Key: "chargeId", Value: 1}}},
+		{Keys: bson.D{{Key: "buyer", Value: 1}, {Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "seller", Value: 1}, {Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}},
+	},
+	"escrows": {
+		{Keys: bson.D{{Key: "listingId", Value: 1}, {Key: "buyer", Value: 1}, {Key: "status", Value: 1}}},
+	},
+	// แต่ละการลงบัญชีของ escrow มีหนึ่งบรรทัดต่อบัญชี จึงกันการลงซ้ำด้วย (escrowId, kind, account)
+	"ledger_entries": {
+		{
+			Keys: bson.D{{Key: "escrowId", Value: 1}, {Key: "kind", Value: 1}, {Key: "account", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"escrowId": bson.M{"$type": "objectId"}}),
+		},
+		{Keys: bson.D{{Key: "account", Value: 1}, {Key: "kind", Value: 1}}},
+	},
+	// lock มีอายุสั้น ถ้า process ตายระหว่างถือ lock จะถูกลบเมื่อหมดเวลา
+	"locks": {
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	},
+	"handovers": {
+		{Keys: bson.D{{Key: "escrowId", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"report_issues_post": {
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "createdAt", Value: 1}}},
+		{Keys: bson.D{{Key: "assignedTo", Value: 1}, {Key: "status", Value: 1}}},
+	},
+	"credential_access_logs": {
+		{Keys: bson.D{{Key: "listingId", Value: 1}, {Key: "at", Value: -1}}},
+		{Keys: bson.D{{Key: "viewer", Value: 1}, {Key: "at", Value: -1}}},
+	},
+}
+
+// index เก่าที่ต้องลบออก เช่น handovers เคย unique ต่อกลุ่มซึ่งทำให้เปิด escrow ใหม่ในกลุ่มเดิมไม่ได้
+// และ index ของ groups ที่ถูกแทนด้วยตัวที่มี _id สำหรับ cursor
+var droppedIndexes = map[string][]string{
+	"handovers": {"groupId_1"},
+	"groups":    {"members_1_last_message_at_-1"},
+}
+
+func EnsureIndexes() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for name, indexNames := range droppedIndexes {
+		for _, indexName := range indexNames {
+			if _, err := DB.Collection(name).Indexes().DropOne(ctx, indexName); err != nil && !isIndexNotFound(err) {
+				log.Println("Failed to drop index", indexName, "on", name, ":", err)
+			}
+		}
+	}
+
+	for name, indexes := range collectionIndexes {
+		if _, err := DB.Collection(name).Indexes().CreateMany(ctx, indexes); err != nil {
+			log.Println("Failed to create indexes for", name, ":", err)
+		}
+	}
+}
+
+func isIndexNotFound(err error) bool {
+	var cmdErr mongo.CommandError
+	// 26 = NamespaceNotFound (ยังไม่มี collection), 27 = IndexNotFound
+	return errors.As(err, &cmdErr) && (cmdErr.Code == 26 || cmdErr.Code == 27)
+}
@@ -0,0 +1,38 @@
+package config
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"go-auth-mongo/pubsub"
+)
+
+var PubSub pubsub.PubSub
+
+// PUBSUB_DRIVER=memory (ค่าเริ่มต้น) สำหรับ instance เดียว
+// หรือ mongo เพื่อกระจายข้อความแชทข้ามหลาย instance ผ่าน change stream
+func InitPubSub() {
+	driver := os.Getenv("PUBSUB_DRIVER")
+	if driver == "" {
+		driver = "memory"
+	}
+
+	switch driver {
+	case "memory":
+		PubSub = pubsub.NewMemory()
+	case "mongo":
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		ps, err := pubsub.NewMongo(ctx, DB.Collection("pubsub_events"))
+		if err != nil {
+			log.Fatal("Failed to init mongo pubsub: ", err)
+		}
+		PubSub = ps
+	default:
+		log.Fatalf("Unknown PUBSUB_DRIVER %q", driver)
+	}
+	log.Println("PubSub driver:", driver)
+}
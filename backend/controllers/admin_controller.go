@@ -0,0 +1,214 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultAdminPageSize = 50
+	maxAdminPageSize     = 200
+)
+
+type AdminUser struct {
+	SafeUser `bson:",inline"`
+	Role     models.Role `bson:"role" json:"role"`
+}
+
+// ตั้ง role admin ให้อีเมลใน ADMIN_EMAILS (คั่นด้วย comma) ตอนเริ่มระบบ
+func SeedAdminRoles() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		email = strings.TrimSpace(email)
+		if email == "" {
+			continue
+		}
+		result, err := config.GetCollection("users").UpdateOne(ctx,
+			bson.M{"email": email},
+			bson.M{"$set": bson.M{"role": models.RoleAdmin}},
+		)
+		if err != nil {
+			log.Println("Failed to seed admin role for", email, ":", err)
+			continue
+		}
+		if result.MatchedCount == 0 {
+			log.Println("ADMIN_EMAILS user not found:", email)
+		}
+	}
+}
+
+// อ่าน limit/skip สำหรับหน้ารายการของผู้ดูแล
+func adminPage(c *gin.Context) (int64, int64) {
+	limit, err := strconv.ParseInt(c.DefaultQuery("limit", strconv.Itoa(defaultAdminPageSize)), 10, 64)
+	if err != nil || limit <= 0 {
+		limit = defaultAdminPageSize
+	}
+	if limit > maxAdminPageSize {
+		limit = maxAdminPageSize
+	}
+	skip, err := strconv.ParseInt(c.DefaultQuery("skip", "0"), 10, 64)
+	if err != nil || skip < 0 {
+		skip = 0
+	}
+	return limit, skip
+}
+
+func AdminListUsers(c *gin.Context) {
+	filter := bson.M{}
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(q), Options: "i"}
+		filter["$or"] = []bson.M{{"email": pattern}, {"username": pattern}, {"namestore": pattern}}
+	}
+	if role := models.Role(c.Query("role")); role != "" {
+		if !role.IsValid() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+			return
+		}
+		if role == models.RoleUser {
+			filter["role"] = bson.M{"$in": []interface{}{role, nil}}
+		} else {
+			filter["role"] = role
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	collection := config.GetCollection("users")
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count users"})
+		return
+	}
+
+	limit, skip := adminPage(c)
+	cursor, err := collection.Find(ctx, filter, options.Find().
+		SetProjection(bson.M{"password": 0}).
+		SetSort(bson.M{"_id": -1}).
+		SetSkip(skip).
+		SetLimit(limit),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get users"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	users := []AdminUser{}
+	if err := cursor.All(ctx, &users); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse users"})
+		return
+	}
+	for i := range users {
+		if users[i].Role == "" {
+			users[i].Role = models.RoleUser
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": users, "total": total})
+}
+
+func AdminSetUserRole(c *gin.Context) {
+	userID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var input struct {
+		Role models.Role `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || !input.Role.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user models.User
+	if err := config.GetCollection("users").FindOne(ctx, bson.M{"_id": userID}).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	// กันผู้ดูแลถอดสิทธิ์ตัวเองจนไม่มีใครจัดการระบบได้
+	if user.Email == c.GetString("email") && input.Role != models.RoleAdmin {
+		c.JSON(http.StatusConflict, gin.H{"error": "ไม่สามารถลดสิทธิ์ของตัวเองได้"})
+		return
+	}
+
+	_, err = config.GetCollection("users").UpdateOne(ctx,
+		bson.M{"_id": userID},
+		bson.M{"$set": bson.M{"role": input.Role}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update role"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role updated", "email": user.Email, "role": input.Role})
+}
+
+// รายการสินค้าทุกสถานะสำหรับผู้ดูแล รวมถึง hidden/removed
+func AdminListListings(c *gin.Context) {
+	filter := bson.M{}
+	if status := models.ListingStatus(c.Query("status")); status != "" {
+		if !status.IsValid() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+			return
+		}
+		filter["status"] = status
+	}
+	if seller := c.Query("seller"); seller != "" {
+		filter["userEmail"] = seller
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	collection := config.GetCollection("listings")
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count listings"})
+		return
+	}
+
+	limit, skip := adminPage(c)
+	cursor, err := collection.Find(ctx, filter, options.Find().
+		SetSort(bson.M{"createdAt": -1}).
+		SetSkip(skip).
+		SetLimit(limit),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get listings"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	listings := []models.Listing{}
+	if err := cursor.All(ctx, &listings); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse listings"})
+		return
+	}
+	for i := range listings {
+		redactListingCredentials(&listings[i])
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": listings, "total": total})
+}
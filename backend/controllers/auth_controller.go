@@ -25,6 +25,7 @@ func Register(c *gin.Context) {
 	}
 
 	user.Password, _ = utils.HashPassword(user.Password)
+	user.Role = models.RoleUser
 
 	collection := config.GetCollection("users")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -55,7 +56,7 @@ func Register(c *gin.Context) {
 		return
 	}
 
-	token, err := utils.GenerateToken(user.Email)
+	token, err := utils.GenerateToken(user.Email, string(user.Role))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "ไม่สามารถสร้าง token ได้"})
 		return
@@ -136,13 +137,18 @@ func Login(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
+	if suspension := user.ActiveSuspension(time.Now()); suspension != nil {
+		respondSuspended(c, suspension)
+		return
+	}
 
-	token, _ := utils.GenerateToken(user.Email)
+	token, _ := utils.GenerateToken(user.Email, string(user.EffectiveRole()))
 	c.JSON(http.StatusOK, gin.H{
 		"token": token,
 		"user": gin.H{
 			"username": user.Username,
 			"email":    user.Email,
+			"role":     user.EffectiveRole(),
 		},
 	})
 }
@@ -180,8 +186,12 @@ func GoogleAuth(c *gin.Context) {
 	var user models.User
 	err = collection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
 	if err == nil {
+		if suspension := user.ActiveSuspension(time.Now()); suspension != nil {
+			respondSuspended(c, suspension)
+			return
+		}
 
-		token, err := utils.GenerateToken(user.Email)
+		token, err := utils.GenerateToken(user.Email, string(user.EffectiveRole()))
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 			return
@@ -192,6 +202,7 @@ func GoogleAuth(c *gin.Context) {
 			"user": gin.H{
 				"username": user.Username,
 				"email":    user.Email,
+				"role":     user.EffectiveRole(),
 			},
 		})
 		return
@@ -200,7 +211,7 @@ func GoogleAuth(c *gin.Context) {
 	username := generateUsernameFromEmail(email)
 	password := generateRandomPassword(12)
 
-	token, err := utils.GenerateToken(email)
+	token, err := utils.GenerateToken(email, string(models.RoleUser))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
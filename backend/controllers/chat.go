@@ -6,14 +6,18 @@ import (
 	"go-auth-mongo/config"
 	"go-auth-mongo/models"
 	"go-auth-mongo/utils"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // ฟังก์ชันแปลง email ให้ใช้เป็น key ได้ใน MongoDB
@@ -219,10 +223,10 @@ func CreateGroupHandler(c *gin.Context) {
 				}
 
 				// ส่ง WebSocket notification
-				broadcastNewGroup <- NewGroupNotification{
+				publishEvent(groupCreatedTopic, NewGroupNotification{
 					Group:      group,
 					ReceiverEM: member,
-				}
+				})
 			}
 		}
 	}()
@@ -234,15 +238,14 @@ func CreateGroupHandler(c *gin.Context) {
 }
 
 // ดึงรายชื่อกลุ่มที่ user เป็นสมาชิกอยู่
+// รายการแชทของผู้ใช้พร้อมข้อความล่าสุด จำนวนที่ยังไม่อ่าน ข้อมูลคู่สนทนา สินค้า และสถานะการซื้อขาย
+// แบ่งหน้าด้วย limit/skip เรียงจากกลุ่มที่มีความเคลื่อนไหวล่าสุด
 func GetUserChatsHandler(c *gin.Context) {
-	emailVal, exists := c.Get("email")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-		return
-	}
-	email, ok := emailVal.(string)
+	email := c.GetString("email")
+
+	limit, pageCursor, ok := inboxPage(c)
 	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid email"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit or cursor"})
 		return
 	}
 
@@ -250,83 +253,142 @@ func GetUserChatsHandler(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	cursor, err := groupCollection.Find(ctx, bson.M{"members": email})
+	cursor, err := groupCollection.Aggregate(ctx, inboxPipeline(email, limit, pageCursor))
 	if err != nil {
-		fmt.Println("Mongo Find error:", err)
+		fmt.Println("Mongo Aggregate error:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching chat groups"})
 		return
 	}
 	defer cursor.Close(ctx)
 
-	var groups []models.Group
-	if err := cursor.All(ctx, &groups); err != nil {
+	items := []InboxItem{}
+	if err := cursor.All(ctx, &items); err != nil {
 		fmt.Println("Cursor decode error:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error decoding groups"})
 		return
 	}
 
-	c.JSON(http.StatusOK, groups)
+	nextCursor := ""
+	hasMore := int64(len(items)) > limit
+	if hasMore {
+		items = items[:limit]
+		nextCursor = encodeInboxCursor(items[len(items)-1].Group)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": items, "has_more": hasMore, "next_cursor": nextCursor})
 }
 
-// ดึงข้อความทั้งหมดในกลุ่ม
+const (
+	defaultMessagePageSize = 50
+	maxMessagePageSize     = 200
+)
+
+func findGroupMessage(ctx context.Context, groupID primitive.ObjectID, messageID string) (models.Message, error) {
+	var msg models.Message
+	id, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return msg, err
+	}
+	err = config.GetCollection("messages").FindOne(ctx, bson.M{"_id": id, "group_id": groupID}).Decode(&msg)
+	return msg, err
+}
+
+// เงื่อนไขข้อความก่อน/หลังข้อความอ้างอิง เรียงด้วย timestamp แล้วใช้ _id ตัดสินกรณีเวลาเท่ากัน
+func messageCursorFilter(ref models.Message, op string) []bson.M {
+	return []bson.M{
+		{"timestamp": bson.M{op: ref.Timestamp}},
+		{"timestamp": ref.Timestamp, "_id": bson.M{op: ref.ID}},
+	}
+}
+
+// ดึงข้อความในกลุ่มทีละหน้า เรียงจากเก่าไปใหม่
+// ไม่ส่ง cursor จะได้หน้าล่าสุด, before=<id> เลื่อนดูย้อนหลัง, after=<id> ดึงข้อความที่ใหม่กว่า
 func GetMessagesHandler(c *gin.Context) {
-	groupID := c.Param("id")
-	if groupID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Group ID is required"})
+	group, _, ok := loadMemberGroup(c)
+	if !ok {
 		return
 	}
 
-	groupIDObj, err := primitive.ObjectIDFromHex(groupID)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Group ID"})
+	limit := int64(defaultMessagePageSize)
+	if raw := c.Query("limit"); raw != "" {
+		v, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || v <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		if v > maxMessagePageSize {
+			v = maxMessagePageSize
+		}
+		limit = v
+	}
+
+	before, after := c.Query("before"), c.Query("after")
+	if before != "" && after != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ใช้ before หรือ after อย่างใดอย่างหนึ่ง"})
 		return
 	}
-	groupCollection := config.GetCollection("groups")
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	var group models.Group
-	err = groupCollection.FindOne(ctx, bson.M{"_id": groupIDObj}).Decode(&group)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
-		return
+	filter := bson.M{"group_id": group.ID}
+	order := -1
+	cursorID, op := before, "$lt"
+	if after != "" {
+		order = 1
+		cursorID, op = after, "$gt"
+	}
+	if cursorID != "" {
+		ref, err := findGroupMessage(ctx, group.ID, cursorID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		filter["$or"] = messageCursorFilter(ref, op)
 	}
 
 	messageCollection := config.GetCollection("messages")
-	cursor, err := messageCollection.Find(ctx, bson.M{"group_id": groupIDObj})
+	cursor, err := messageCollection.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: order}, {Key: "_id", Value: order}}).
+		SetLimit(limit+1),
+	)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving messages"})
 		return
 	}
 	defer cursor.Close(ctx)
 
-	var messages []models.Message
+	messages := []models.Message{}
 	if err := cursor.All(ctx, &messages); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error decoding messages"})
 		return
 	}
 
-	c.JSON(http.StatusOK, messages)
-}
-
-func ConfirmTradeHandler(c *gin.Context) {
-	groupIDParam := c.Param("id")
-	groupID, err := primitive.ObjectIDFromHex(groupIDParam)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
-		return
+	hasMore := int64(len(messages)) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	// หน้าที่ดึงย้อนหลังเรียงจากใหม่ไปเก่า กลับลำดับให้เป็นเก่าไปใหม่เสมอ
+	if order < 0 {
+		for l, r := 0, len(messages)-1; l < r; l, r = l+1, r-1 {
+			messages[l], messages[r] = messages[r], messages[l]
+		}
 	}
 
-	emailVal, exists := c.Get("email")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-		return
+	resp := gin.H{"messages": messages, "has_more": hasMore}
+	if len(messages) > 0 {
+		resp["next_before"] = messages[0].ID.Hex()
+		resp["next_after"] = messages[len(messages)-1].ID.Hex()
 	}
-	email, ok := emailVal.(string)
+	c.JSON(http.StatusOK, resp)
+}
+
+func ConfirmTradeHandler(c *gin.Context) {
+	group, email, ok := loadMemberGroup(c)
 	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid email in context"})
 		return
 	}
+	groupID := group.ID
 
 	// รับค่าที่ส่งมาจาก body เช่น { "confirmed": true }
 	var reqBody struct {
@@ -339,13 +401,6 @@ func ConfirmTradeHandler(c *gin.Context) {
 
 	collection := config.GetCollection("groups")
 
-	var group models.Group
-	err = collection.FindOne(context.Background(), bson.M{"_id": groupID}).Decode(&group)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
-		return
-	}
-
 	update := bson.M{}
 	role := ""
 
@@ -360,16 +415,66 @@ func ConfirmTradeHandler(c *gin.Context) {
 		return
 	}
 
-	_, err = collection.UpdateOne(
+	escrow, escrowErr := findEscrowByGroup(context.Background(), groupID)
+	if escrowErr != nil && escrowErr != mongo.ErrNoDocuments {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load escrow"})
+		return
+	}
+	hasEscrow := escrowErr == nil
+
+	// ยกเลิกได้เฉพาะก่อนชำระเงินเท่านั้น
+	if !reqBody.Confirmed && hasEscrow {
+		if err := transitionEscrow(context.Background(), &escrow, models.EscrowCancelled, email, "trade unconfirmed", nil); err != nil {
+			respondEscrowTransitionError(c, err)
+			return
+		}
+	}
+
+	// บันทึกการยืนยันก่อน แล้วตัดสินจากเอกสารหลังอัปเดต เพื่อให้การยืนยันพร้อมกันของสองฝ่ายเปิด escrow ได้
+	var updated models.Group
+	err := collection.FindOneAndUpdate(
 		context.Background(),
 		bson.M{"_id": groupID},
 		bson.M{"$set": update},
-	)
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "ไม่สามารถอัปเดตสถานะการยืนยันได้"})
 		return
 	}
 
+	// ยืนยันครบทั้งสองฝ่ายแล้วจะจองสินค้าและเปิด escrow ถ้าไม่สำเร็จให้ถอนการยืนยันของฝ่ายนี้
+	var escrowResp *models.Escrow
+	if updated.BuyerConfirmed && updated.SellerConfirmed {
+		escrow, err = openEscrowForGroup(context.Background(), updated)
+		if err != nil {
+			revert := bson.M{}
+			for field := range update {
+				revert[field] = false
+			}
+			if _, revertErr := collection.UpdateOne(context.Background(), bson.M{"_id": groupID}, bson.M{"$set": revert}); revertErr != nil {
+				log.Println("Failed to revert trade confirmation for group", groupID.Hex(), ":", revertErr)
+			}
+		}
+		if err == errIllegalListingTransition {
+			c.JSON(http.StatusConflict, gin.H{"error": "สินค้านี้ไม่พร้อมขายแล้ว"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "ไม่สามารถเปิดการซื้อขายผ่านระบบกลางได้"})
+			return
+		}
+		escrowResp = &escrow
+	}
+
+	trade := models.TradeStatusPayload{GroupID: groupID}
+	if role == "buyer" {
+		trade.BuyerConfirmed = &reqBody.Confirmed
+	} else {
+		trade.SellerConfirmed = &reqBody.Confirmed
+	}
+	publishTradeStatus(trade)
+
 	action := "ยืนยัน"
 	if !reqBody.Confirmed {
 		action = "ยกเลิก"
@@ -379,72 +484,66 @@ func ConfirmTradeHandler(c *gin.Context) {
 		"message":      action + "การใช้ระบบซื้อขายกลางสำเร็จ",
 		"confirmed_by": role,
 		"status":       reqBody.Confirmed,
+		"escrow":       escrowResp,
 	})
 }
 
 // อัปเดตสถานะอ่านข้อความของ user ในกลุ่ม
+// ส่ง { "message_id": "..." } เพื่อระบุข้อความที่อ่านถึง ถ้าไม่ส่งถือว่าอ่านถึงข้อความล่าสุด
 func UpdateReadStatusHandler(c *gin.Context) {
-	groupIDStr := c.Param("id")
-
-	groupID, err := primitive.ObjectIDFromHex(groupIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+	group, email, ok := loadMemberGroup(c)
+	if !ok {
 		return
 	}
 
-	emailVal, exists := c.Get("email")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-		return
+	var input struct {
+		MessageID string `json:"message_id"`
 	}
-	email, ok := emailVal.(string)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	if err := c.ShouldBindJSON(&input); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
 		return
 	}
 
-	encodedEmail := encodeEmailKey(email)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	filter := bson.M{"_id": groupID}
-	update := bson.M{
-		"$set": bson.M{
-			"read_status." + encodedEmail: time.Now().Format(time.RFC3339),
-		},
+	var msg models.Message
+	var err error
+	if input.MessageID != "" {
+		msg, err = findGroupMessage(ctx, group.ID, input.MessageID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message_id"})
+			return
+		}
+	} else {
+		msg, err = latestGroupMessage(ctx, group.ID)
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusOK, gin.H{"message": "Read status updated"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update read status"})
+			return
+		}
 	}
 
-	collection := config.GetCollection("groups")
-	_, err = collection.UpdateOne(context.Background(), filter, update)
+	advanced, err := markGroupRead(ctx, group.ID, email, msg)
 	if err != nil {
 		fmt.Println("Failed to update read_status:", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update read status"})
 		return
 	}
+	if advanced {
+		publishReadReceipt(group.ID, "", email, msg)
+	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Read status updated"})
+	c.JSON(http.StatusOK, gin.H{"message": "Read status updated", "last_read": models.ReadMarker{MessageID: msg.ID, Timestamp: msg.Timestamp}})
 }
 
 // ดึงข้อมูลกลุ่มตาม group_id
 func GetGroupByIDHandler(c *gin.Context) {
-	groupID := c.Param("id")
-	if groupID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Group ID is required"})
-		return
-	}
-
-	groupIDObj, err := primitive.ObjectIDFromHex(groupID)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Group ID"})
-		return
-	}
-
-	collection := config.GetCollection("groups")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	var group models.Group
-	err = collection.FindOne(ctx, bson.M{"_id": groupIDObj}).Decode(&group)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+	group, _, ok := loadMemberGroup(c)
+	if !ok {
 		return
 	}
 
@@ -0,0 +1,364 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
+	"go-auth-mongo/utils"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	maxChatAttachmentSize = 10 << 20
+	chatThumbnailSize     = 320
+	attachmentURLExpiry   = 15 * time.Minute
+	// ไฟล์ที่อัปโหลดแล้วไม่ถูกส่งพร้อมข้อความภายในเวลานี้จะถูกลบทั้งใน S3 และฐานข้อมูล
+	unclaimedAttachmentTTL = 24 * time.Hour
+	// จำกัดต่อผู้ใช้: ไฟล์ที่ยังไม่ได้ส่ง และจำนวนที่อัปโหลดได้ต่อชั่วโมง
+	maxPendingChatAttachments = 10
+	maxChatAttachmentsPerHour = 60
+	chatAttachmentSweepPeriod = 10 * time.Minute
+)
+
+// ชนิดไฟล์ที่แนบในแชทได้ ตรวจจากเนื้อไฟล์จริงไม่ใช่ Content-Type ที่ client ส่งมา
+var chatAttachmentTypes = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"application/pdf": ".pdf",
+}
+
+var errAttachmentUnavailable = errors.New("attachment not found or already used")
+
+func uploadToS3(ctx context.Context, key, contentType string, body io.Reader) error {
+	uploader := manager.NewUploader(config.S3Client)
+	_, err := uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(config.GetS3BucketName()),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+func deleteS3Object(ctx context.Context, key string) error {
+	_, err := config.S3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(config.GetS3BucketName()),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func presignS3Object(ctx context.Context, key, disposition string) (string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(config.GetS3BucketName()),
+		Key:    aws.String(key),
+	}
+	if disposition != "" {
+		input.ResponseContentDisposition = aws.String(disposition)
+	}
+	req, err := s3.NewPresignClient(config.S3Client).PresignGetObject(ctx, input, s3.WithPresignExpires(attachmentURLExpiry))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// สมาชิกอัปโหลดไฟล์เข้ากลุ่ม แล้วส่งข้อความแนบ attachment_id ผ่าน WebSocket
+func UploadChatAttachmentHandler(c *gin.Context) {
+	group, email, ok := loadMemberGroup(c)
+	if !ok {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxChatAttachmentSize+1<<20)
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File is required"})
+		return
+	}
+	defer file.Close()
+
+	if header.Size > maxChatAttachmentSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "ไฟล์มีขนาดใหญ่เกิน 10MB"})
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(file, maxChatAttachmentSize+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return
+	}
+	if len(data) > maxChatAttachmentSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "ไฟล์มีขนาดใหญ่เกิน 10MB"})
+		return
+	}
+
+	contentType := http.DetectContentType(data)
+	ext, allowed := chatAttachmentTypes[contentType]
+	if !allowed {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "รองรับเฉพาะไฟล์ JPEG, PNG, GIF และ PDF"})
+		return
+	}
+
+	attachment := models.ChatAttachment{
+		ID:          primitive.NewObjectID(),
+		GroupID:     group.ID,
+		Uploader:    email,
+		Name:        filepath.Base(strings.TrimSpace(header.Filename)),
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		CreatedAt:   time.Now(),
+	}
+	prefix := "chat/" + group.ID.Hex() + "/" + uuid.New().String()
+	attachment.Key = prefix + ext
+
+	var thumbnail []byte
+	if strings.HasPrefix(contentType, "image/") {
+		thumbnail, attachment.Width, attachment.Height, err = utils.MakeThumbnail(data, chatThumbnailSize)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ไฟล์รูปภาพไม่ถูกต้อง"})
+			return
+		}
+		attachment.ThumbnailKey = prefix + "_thumb.jpg"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	collection := config.GetCollection("chat_attachments")
+
+	// จองโควตาด้วยการบันทึกก่อนอัปโหลด การอัปโหลดพร้อมกันจะนับเห็นกันและเกินโควตาไม่ได้
+	attachment.Uploading = true
+	if _, err := collection.InsertOne(ctx, attachment); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save attachment"})
+		return
+	}
+	if status, msg := checkAttachmentQuota(ctx, email); status != http.StatusOK {
+		discardChatAttachment(ctx, attachment)
+		c.JSON(status, gin.H{"error": msg})
+		return
+	}
+
+	err = uploadToS3(ctx, attachment.Key, contentType, bytes.NewReader(data))
+	if err == nil && thumbnail != nil {
+		err = uploadToS3(ctx, attachment.ThumbnailKey, "image/jpeg", bytes.NewReader(thumbnail))
+	}
+	if err != nil {
+		log.Println("S3 Upload Error:", err)
+		discardChatAttachment(ctx, attachment)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Upload failed"})
+		return
+	}
+
+	if _, err := collection.UpdateOne(ctx, bson.M{"_id": attachment.ID}, bson.M{"$unset": bson.M{"uploading": ""}}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save attachment"})
+		return
+	}
+	attachment.Uploading = false
+
+	c.JSON(http.StatusCreated, attachment)
+}
+
+// ถอนการจองเมื่ออัปโหลดไม่สำเร็จหรือเกินโควตา ลบไฟล์ใน S3 ที่อาจขึ้นไปแล้วด้วย
+// ถ้าลบไม่สำเร็จ sweepUnclaimedAttachments จะลบให้เมื่อหมดเวลา
+func discardChatAttachment(ctx context.Context, attachment models.ChatAttachment) {
+	for _, key := range []string{attachment.Key, attachment.ThumbnailKey} {
+		if key == "" {
+			continue
+		}
+		if err := deleteS3Object(ctx, key); err != nil {
+			log.Println("Failed to delete discarded attachment object", key, ":", err)
+			return
+		}
+	}
+	if _, err := config.GetCollection("chat_attachments").DeleteOne(ctx, bson.M{"_id": attachment.ID}); err != nil {
+		log.Println("Failed to delete discarded attachment", attachment.ID.Hex(), ":", err)
+	}
+}
+
+// ตรวจโควตาการอัปโหลดของผู้ใช้ นับรวมรายการที่เพิ่งจองไว้แล้ว
+// ไฟล์ที่หมดเวลาแล้วและรอลบ (expired_at) ไม่นับ
+func checkAttachmentQuota(ctx context.Context, email string) (int, string) {
+	collection := config.GetCollection("chat_attachments")
+
+	pending, err := collection.CountDocuments(ctx, bson.M{
+		"uploader":   email,
+		"message_id": nil,
+		"expired_at": bson.M{"$exists": false},
+	})
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to check upload quota"
+	}
+	if pending > maxPendingChatAttachments {
+		return http.StatusTooManyRequests, "มีไฟล์ที่อัปโหลดแล้วยังไม่ได้ส่งมากเกินไป กรุณาส่งหรือรอสักครู่"
+	}
+
+	recent, err := collection.CountDocuments(ctx, bson.M{
+		"uploader":   email,
+		"created_at": bson.M{"$gt": time.Now().Add(-time.Hour)},
+	})
+	if err != nil {
+		return http.StatusInternalServerError, "Failed to check upload quota"
+	}
+	if recent > maxChatAttachmentsPerHour {
+		return http.StatusTooManyRequests, "อัปโหลดไฟล์บ่อยเกินไป กรุณาลองใหม่ภายหลัง"
+	}
+	return http.StatusOK, ""
+}
+
+// คืนลิงก์ชั่วคราวสำหรับเปิดไฟล์และรูปย่อ เฉพาะสมาชิกของกลุ่มที่ไฟล์อยู่
+func GetChatAttachmentHandler(c *gin.Context) {
+	group, _, ok := loadMemberGroup(c)
+	if !ok {
+		return
+	}
+
+	attachmentID, err := primitive.ObjectIDFromHex(c.Param("attachmentId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attachment ID"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var attachment models.ChatAttachment
+	err = config.GetCollection("chat_attachments").FindOne(ctx,
+		bson.M{"_id": attachmentID, "group_id": group.ID, "uploading": bson.M{"$exists": false}},
+	).Decode(&attachment)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+
+	disposition := ""
+	if !strings.HasPrefix(attachment.ContentType, "image/") {
+		disposition = `attachment; filename="` + strings.ReplaceAll(attachment.Name, `"`, "") + `"`
+	}
+	url, err := presignS3Object(ctx, attachment.Key, disposition)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign URL"})
+		return
+	}
+
+	resp := gin.H{"attachment": attachment, "url": url, "expires_in": int(attachmentURLExpiry.Seconds())}
+	if attachment.ThumbnailKey != "" {
+		thumbnailURL, err := presignS3Object(ctx, attachment.ThumbnailKey, "")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign URL"})
+			return
+		}
+		resp["thumbnail_url"] = thumbnailURL
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// ผูกไฟล์แนบกับข้อความ ไฟล์ต้องอยู่ในกลุ่มเดียวกัน อัปโหลดโดยผู้ส่ง และยังไม่เคยถูกใช้
+func claimChatAttachment(ctx context.Context, groupID primitive.ObjectID, email, attachmentID string, messageID primitive.ObjectID) (models.ChatAttachment, error) {
+	var attachment models.ChatAttachment
+	id, err := primitive.ObjectIDFromHex(attachmentID)
+	if err != nil {
+		return attachment, errAttachmentUnavailable
+	}
+
+	err = config.GetCollection("chat_attachments").FindOneAndUpdate(ctx,
+		bson.M{
+			"_id":        id,
+			"group_id":   groupID,
+			"uploader":   email,
+			"message_id": bson.M{"$exists": false},
+			"expired_at": bson.M{"$exists": false},
+			"uploading":  bson.M{"$exists": false},
+		},
+		bson.M{"$set": bson.M{"message_id": messageID}},
+	).Decode(&attachment)
+	if err != nil {
+		return attachment, errAttachmentUnavailable
+	}
+	return attachment, nil
+}
+
+// คืนไฟล์แนบให้ใช้ใหม่ได้เมื่อบันทึกข้อความไม่สำเร็จ
+func releaseChatAttachment(ctx context.Context, attachmentID, messageID primitive.ObjectID) {
+	_, err := config.GetCollection("chat_attachments").UpdateOne(ctx,
+		bson.M{"_id": attachmentID, "message_id": messageID},
+		bson.M{"$unset": bson.M{"message_id": ""}},
+	)
+	if err != nil {
+		log.Println("Failed to release chat attachment", attachmentID.Hex(), ":", err)
+	}
+}
+
+// ลบไฟล์แนบที่ไม่ถูกส่งภายใน unclaimedAttachmentTTL
+// ทำเครื่องหมาย expired_at ก่อนเพื่อไม่ให้ถูกผูกกับข้อความระหว่างลบ ถ้าลบใน S3 ไม่สำเร็จจะลองใหม่รอบถัดไป
+func sweepUnclaimedAttachments(ctx context.Context) error {
+	collection := config.GetCollection("chat_attachments")
+	cutoff := time.Now().Add(-unclaimedAttachmentTTL)
+
+	_, err := collection.UpdateMany(ctx,
+		bson.M{"message_id": nil, "created_at": bson.M{"$lt": cutoff}, "expired_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"expired_at": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+
+	cursor, err := collection.Find(ctx, bson.M{"message_id": nil, "expired_at": bson.M{"$exists": true}})
+	if err != nil {
+		return err
+	}
+	var expired []models.ChatAttachment
+	if err := cursor.All(ctx, &expired); err != nil {
+		return err
+	}
+
+	for _, attachment := range expired {
+		keys := []string{attachment.Key}
+		if attachment.ThumbnailKey != "" {
+			keys = append(keys, attachment.ThumbnailKey)
+		}
+		failed := false
+		for _, key := range keys {
+			if err := deleteS3Object(ctx, key); err != nil {
+				log.Println("Failed to delete unclaimed attachment object", key, ":", err)
+				failed = true
+			}
+		}
+		if failed {
+			continue
+		}
+		if _, err := collection.DeleteOne(ctx, bson.M{"_id": attachment.ID, "message_id": nil}); err != nil {
+			log.Println("Failed to delete unclaimed attachment", attachment.ID.Hex(), ":", err)
+		}
+	}
+	return nil
+}
+
+func ChatAttachmentSweeper() {
+	ticker := time.NewTicker(chatAttachmentSweepPeriod)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		if err := sweepUnclaimedAttachments(ctx); err != nil {
+			log.Println("Failed to sweep unclaimed attachments:", err)
+		}
+		cancel()
+	}
+}
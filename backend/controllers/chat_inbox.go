@@ -0,0 +1,209 @@
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"log"
+	"strconv"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	defaultInboxPageSize = 30
+	maxInboxPageSize     = 100
+	inboxSnippetLength   = 120
+)
+
+type InboxLastMessage struct {
+	ID          primitive.ObjectID        `bson:"_id" json:"id"`
+	SenderEmail string                    `bson:"senderEmail" json:"senderEmail"`
+	Content     string                    `bson:"content" json:"content"`
+	Timestamp   string                    `bson:"timestamp" json:"timestamp"`
+	Attachment  *models.MessageAttachment `bson:"attachment,omitempty" json:"attachment,omitempty"`
+}
+
+type InboxListing struct {
+	ID     primitive.ObjectID   `bson:"_id" json:"id"`
+	Title  string               `bson:"title" json:"title"`
+	Price  int                  `bson:"price" json:"price"`
+	Status models.ListingStatus `bson:"status" json:"status"`
+}
+
+type InboxTrade struct {
+	BuyerConfirmed  bool                `bson:"buyer_confirmed" json:"buyer_confirmed"`
+	SellerConfirmed bool                `bson:"seller_confirmed" json:"seller_confirmed"`
+	PaymentStatus   string              `bson:"payment_status,omitempty" json:"payment_status,omitempty"`
+	EscrowID        *primitive.ObjectID `bson:"escrow_id,omitempty" json:"escrow_id,omitempty"`
+	EscrowStatus    models.EscrowStatus `bson:"escrow_status,omitempty" json:"escrow_status,omitempty"`
+}
+
+// ข้อมูลที่หน้ารายการแชทต้องใช้ต่อหนึ่งกลุ่ม ไม่ต้องดึงข้อความหรือโปรไฟล์แยกอีก
+type InboxItem struct {
+	models.Group `bson:",inline"`
+	UnreadCount  int64             `bson:"unread_count" json:"unread_count"`
+	LastMessage  *InboxLastMessage `bson:"last_message,omitempty" json:"last_message"`
+	Counterparty *SafeUser         `bson:"counterparty,omitempty" json:"counterparty"`
+	Listing      *InboxListing     `bson:"listing,omitempty" json:"listing"`
+	Trade        InboxTrade        `bson:"trade" json:"trade"`
+}
+
+// ตำแหน่งของกลุ่มสุดท้ายในหน้าก่อน เรียงด้วย last_message_at แล้วใช้ _id ตัดสินกรณีเวลาเท่ากัน
+type inboxCursor struct {
+	At string             `bson:"at"`
+	ID primitive.ObjectID `bson:"id"`
+}
+
+func encodeInboxCursor(group models.Group) string {
+	raw, err := bson.Marshal(inboxCursor{At: group.LastMessageAt, ID: group.ID})
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeInboxCursor(s string) (*inboxCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var cursor inboxCursor
+	if err := bson.Unmarshal(raw, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// อ่าน limit และ cursor จาก query string
+func inboxPage(c *gin.Context) (int64, *inboxCursor, bool) {
+	limit := int64(defaultInboxPageSize)
+	if raw := c.Query("limit"); raw != "" {
+		v, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || v <= 0 {
+			return 0, nil, false
+		}
+		if v > maxInboxPageSize {
+			v = maxInboxPageSize
+		}
+		limit = v
+	}
+	var cursor *inboxCursor
+	if raw := c.Query("cursor"); raw != "" {
+		decoded, err := decodeInboxCursor(raw)
+		if err != nil {
+			return 0, nil, false
+		}
+		cursor = decoded
+	}
+	return limit, cursor, true
+}
+
+// กลุ่มของ email เรียงตามข้อความล่าสุด ใช้ index {members, last_message_at, _id} ทั้งตอนกรองและเรียง
+// ดึงเกิน limit มาหนึ่งรายการเพื่อบอกว่ามีหน้าถัดไปหรือไม่
+func inboxPipeline(email string, limit int64, cursor *inboxCursor) mongo.Pipeline {
+	match := bson.M{"members": email}
+	if cursor != nil {
+		match["$or"] = []bson.M{
+			{"last_message_at": bson.M{"$lt": cursor.At}},
+			{"last_message_at": cursor.At, "_id": bson.M{"$lt": cursor.ID}},
+		}
+	}
+	return mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$sort", Value: bson.D{{Key: "last_message_at", Value: -1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$limit", Value: limit + 1}},
+		unreadCountLookup(email),
+		{{Key: "$lookup", Value: bson.M{
+			"from": "messages",
+			"let":  bson.M{"gid": "$_id"},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"$expr": bson.M{"$eq": bson.A{"$group_id", "$$gid"}}}},
+				bson.M{"$sort": bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}},
+				bson.M{"$limit": 1},
+				bson.M{"$project": bson.M{
+					"senderEmail": 1,
+					"timestamp":   1,
+					"attachment":  1,
+					"content":     bson.M{"$substrCP": bson.A{"$content", 0, inboxSnippetLength}},
+				}},
+			},
+			"as": "last_messages",
+		}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from": "users",
+			"let":  bson.M{"members": "$members"},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"$expr": bson.M{"$and": bson.A{
+					bson.M{"$in": bson.A{"$email", "$$members"}},
+					bson.M{"$ne": bson.A{"$email", email}},
+				}}}},
+				bson.M{"$limit": 1},
+				bson.M{"$project": safeUserProjection},
+			},
+			"as": "counterparties",
+		}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from": "listings",
+			"let": bson.M{"pid": bson.M{"$convert": bson.M{
+				"input": "$product_id", "to": "objectId", "onError": nil, "onNull": nil,
+			}}},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"$expr": bson.M{"$eq": bson.A{"$_id", "$$pid"}}}},
+				bson.M{"$project": bson.M{"title": 1, "price": 1, "status": 1}},
+			},
+			"as": "listings",
+		}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from": "escrows",
+			"let":  bson.M{"gid": "$_id"},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"$expr": bson.M{"$eq": bson.A{"$groupId", "$$gid"}}}},
+				bson.M{"$sort": bson.M{"createdAt": -1}},
+				bson.M{"$limit": 1},
+				bson.M{"$project": bson.M{"status": 1}},
+			},
+			"as": "escrows",
+		}}},
+		{{Key: "$addFields", Value: bson.M{
+			"unread_count": bson.M{"$ifNull": bson.A{bson.M{"$arrayElemAt": bson.A{"$unread.n", 0}}, 0}},
+			"last_message": bson.M{"$arrayElemAt": bson.A{"$last_messages", 0}},
+			"counterparty": bson.M{"$arrayElemAt": bson.A{"$counterparties", 0}},
+			"listing":      bson.M{"$arrayElemAt": bson.A{"$listings", 0}},
+			"trade": bson.M{
+				"buyer_confirmed":  "$buyer_confirmed",
+				"seller_confirmed": "$seller_confirmed",
+				"payment_status":   "$payment_status",
+				"escrow_id":        bson.M{"$arrayElemAt": bson.A{"$escrows._id", 0}},
+				"escrow_status":    bson.M{"$arrayElemAt": bson.A{"$escrows.status", 0}},
+			},
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"unread": 0, "last_messages": 0, "counterparties": 0, "listings": 0, "escrows": 0,
+		}}},
+	}
+}
+
+// กลุ่มเก่าที่ไม่มี last_message_at จะไม่ติดหน้าแชทเมื่อเรียงด้วย index ใช้เวลาสร้างกลุ่มแทน
+func MigrateGroupLastMessageAt() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	result, err := config.GetCollection("groups").UpdateMany(ctx,
+		bson.M{"$or": []bson.M{{"last_message_at": bson.M{"$exists": false}}, {"last_message_at": ""}}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"last_message_at": "$created_at"}}}},
+	)
+	if err != nil {
+		log.Println("Failed to backfill group last_message_at:", err)
+		return
+	}
+	if result.ModifiedCount > 0 {
+		log.Println("Backfilled last_message_at on", result.ModifiedCount, "groups")
+	}
+}
@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	errCredentialAccessDenied   = errors.New("credential access denied")
+	errCredentialsAlreadyViewed = errors.New("credentials already revealed")
+)
+
+// บันทึกการเปิดดูรหัสใช้เป็นหลักฐานเวลามีข้อพิพาท โค้ดในระบบนี้จึงมีแค่ logCredentialAccess ที่ insert
+// เป็นข้อตกลงของโค้ดเท่านั้น ฐานข้อมูลไม่ได้กันการแก้หรือลบ ใครที่มีสิทธิ์เขียน DB ยังแก้ได้
+// ถ้าต้องการให้แก้ไม่ได้จริงต้องแยก DB user ที่มีแค่สิทธิ์ insert/find บน collection นี้
+const credentialAccessLogCollection = "credential_access_logs"
+
+// escrow ที่ถือว่าผู้ซื้อจ่ายเงินแล้ว (เงินถูกพักไว้หรือปล่อยแล้ว)
+// disputed ไม่นับ เพื่อไม่ให้เปิดดูเพิ่มระหว่างรอตัดสินข้อพิพาท
+var credentialRevealEscrowStatuses = []models.EscrowStatus{
+	models.EscrowPaid,
+	models.EscrowDelivered,
+	models.EscrowAccepted,
+	models.EscrowReleased,
+}
+
+// ตรวจว่า viewer เปิดดูรหัสของ listing นี้ได้หรือไม่ คืน role และ escrow ที่ใช้อ้างอิง
+func authorizeCredentialAccess(ctx context.Context, listing models.Listing, viewer string) (models.CredentialAccessLog, error) {
+	entry := models.CredentialAccessLog{ListingID: listing.ID, Viewer: viewer}
+	if viewer == listing.UserEmail {
+		entry.Role = "owner"
+		return entry, nil
+	}
+
+	var escrow models.Escrow
+	err := config.GetCollection("escrows").FindOne(ctx, bson.M{
+		"listingId": listing.ID,
+		"buyer":     viewer,
+		"status":    bson.M{"$in": credentialRevealEscrowStatuses},
+	}, options.FindOne().SetSort(bson.M{"createdAt": -1})).Decode(&escrow)
+	if err == mongo.ErrNoDocuments {
+		return entry, errCredentialAccessDenied
+	}
+	if err != nil {
+		return entry, err
+	}
+
+	entry.Role = "buyer"
+	entry.EscrowID = &escrow.ID
+	return entry, nil
+}
+
+// ผู้ซื้อเปิดดูรหัสของ listing ได้ครั้งเดียวต่อ escrow จองสิทธิ์แบบ atomic บน escrow
+func claimBuyerReveal(ctx context.Context, escrowID primitive.ObjectID) error {
+	result, err := config.GetCollection("escrows").UpdateOne(ctx,
+		bson.M{"_id": escrowID, "credentialsRevealedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"credentialsRevealedAt": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errCredentialsAlreadyViewed
+	}
+	return nil
+}
+
+// คืนสิทธิ์เมื่อเปิดเผยรหัสไม่สำเร็จหลังจองไปแล้ว
+func releaseBuyerReveal(ctx context.Context, escrowID primitive.ObjectID) {
+	_, err := config.GetCollection("escrows").UpdateOne(ctx,
+		bson.M{"_id": escrowID},
+		bson.M{"$unset": bson.M{"credentialsRevealedAt": ""}},
+	)
+	if err != nil {
+		log.Println("Failed to release credential reveal for escrow", escrowID.Hex(), ":", err)
+	}
+}
+
+// IP มาจาก c.ClientIP() ซึ่งเชื่อ X-Forwarded-For เฉพาะจาก proxy ใน TRUSTED_PROXIES (ดู main.go)
+func logCredentialAccess(ctx context.Context, c *gin.Context, entry models.CredentialAccessLog) error {
+	entry.IP = c.ClientIP()
+	entry.UserAgent = c.Request.UserAgent()
+	entry.At = time.Now()
+	_, err := config.GetCollection(credentialAccessLogCollection).InsertOne(ctx, entry)
+	return err
+}
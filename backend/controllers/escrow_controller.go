@@ -0,0 +1,401 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var errIllegalEscrowTransition = errors.New("illegal escrow transition")
+
+// ระยะเวลาที่แต่ละสถานะค้างได้ก่อนระบบจะจัดการให้อัตโนมัติ
+var escrowTimeouts = map[models.EscrowStatus]time.Duration{
+	models.EscrowPendingPayment: 30 * time.Minute,
+	models.EscrowPaid:           48 * time.Hour,
+	models.EscrowDelivered:      72 * time.Hour,
+}
+
+const escrowSystemActor = "system"
+
+func findEscrowByGroup(ctx context.Context, groupID primitive.ObjectID) (models.Escrow, error) {
+	var escrow models.Escrow
+	err := config.GetCollection("escrows").FindOne(ctx, bson.M{
+		"groupId": groupID,
+		"status":  bson.M{"$nin": []models.EscrowStatus{models.EscrowCancelled, models.EscrowRefunded}},
+	}).Decode(&escrow)
+	return escrow, err
+}
+
+// เปิด escrow ใหม่ให้กลุ่มที่ทั้งสองฝ่ายยืนยันการใช้ระบบซื้อขายกลางแล้ว
+func openEscrowForGroup(ctx context.Context, group models.Group) (models.Escrow, error) {
+	listingID, err := primitive.ObjectIDFromHex(group.ProductID)
+	if err != nil {
+		return models.Escrow{}, err
+	}
+
+	var listing models.Listing
+	err = config.GetCollection("listings").FindOne(ctx, bson.M{"_id": listingID}).Decode(&listing)
+	if err != nil {
+		return models.Escrow{}, err
+	}
+
+	now := time.Now()
+
+	existing, err := findEscrowByGroup(ctx, group.ID)
+	if err == nil {
+		// ยืนยันซ้ำก่อนจ่ายเงิน ให้ใช้ราคาล่าสุดของ listing
+		if existing.Status == models.EscrowPendingPayment && existing.Amount != int64(listing.Price)*100 {
+			existing.Amount = int64(listing.Price) * 100
+			existing.UpdatedAt = now
+			_, err = config.GetCollection("escrows").UpdateOne(ctx,
+				bson.M{"_id": existing.ID, "status": models.EscrowPendingPayment},
+				bson.M{"$set": bson.M{"amount": existing.Amount, "updatedAt": now}},
+			)
+		}
+		return existing, err
+	}
+	if err != mongo.ErrNoDocuments {
+		return models.Escrow{}, err
+	}
+
+	if err := transitionListingStatus(ctx, listingID, models.ListingReserved); err != nil {
+		// อีกฝ่ายยืนยันพร้อมกันและเปิด escrow ไปก่อนแล้ว
+		if err == errIllegalListingTransition {
+			if existing, findErr := findEscrowByGroup(ctx, group.ID); findErr == nil {
+				return existing, nil
+			}
+		}
+		return models.Escrow{}, err
+	}
+
+	deadline := now.Add(escrowTimeouts[models.EscrowPendingPayment])
+	escrow := models.Escrow{
+		ID:        primitive.NewObjectID(),
+		GroupID:   group.ID,
+		ListingID: listingID,
+		Buyer:     group.Buyer,
+		Seller:    group.Seller,
+		Amount:    int64(listing.Price) * 100,
+		Currency:  "THB",
+		Status:    models.EscrowPendingPayment,
+		Deadline:  &deadline,
+		History:   []models.EscrowEvent{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	_, err = config.GetCollection("escrows").InsertOne(ctx, escrow)
+	if err != nil {
+		if revertErr := transitionListingStatus(ctx, listingID, models.ListingActive); revertErr != nil {
+			log.Println("Failed to release reserved listing", listingID.Hex(), ":", revertErr)
+		}
+		return models.Escrow{}, err
+	}
+	return escrow, nil
+}
+
+// สถานะของ listing เดินตาม escrow: ขายแล้วเมื่อปล่อยเงิน และกลับมาขายต่อเมื่อยกเลิกหรือคืนเงิน
+func syncListingWithEscrow(ctx context.Context, escrow models.Escrow) error {
+	var to models.ListingStatus
+	switch escrow.Status {
+	case models.EscrowReleased:
+		to = models.ListingSold
+	case models.EscrowCancelled, models.EscrowRefunded:
+		to = models.ListingActive
+	default:
+		return nil
+	}
+
+	err := transitionListingStatus(ctx, escrow.ListingID, to)
+	if err == errIllegalListingTransition {
+		log.Println("Listing", escrow.ListingID.Hex(), "is not reserved, skip marking it", to)
+		return nil
+	}
+	return err
+}
+
+// เปลี่ยนสถานะ escrow แบบ atomic โดยอ้างอิงสถานะปัจจุบัน
+// ถ้ามีคนเปลี่ยนสถานะไปก่อนแล้วจะได้ errIllegalEscrowTransition
+func transitionEscrow(ctx context.Context, escrow *models.Escrow, to models.EscrowStatus, by, note string, extra bson.M) error {
+	if !escrow.Status.CanTransitionTo(to) {
+		return errIllegalEscrowTransition
+	}
+
+	now := time.Now()
+	event := models.EscrowEvent{From: escrow.Status, To: to, By: by, Note: note, At: now}
+
+	set := bson.M{"status": to, "updatedAt": now}
+	for k, v := range extra {
+		set[k] = v
+	}
+	update := bson.M{"$set": set, "$push": bson.M{"history": event}}
+
+	var deadline *time.Time
+	if timeout, ok := escrowTimeouts[to]; ok {
+		d := now.Add(timeout)
+		deadline = &d
+		set["deadline"] = d
+	} else {
+		update["$unset"] = bson.M{"deadline": ""}
+	}
+
+	result, err := config.GetCollection("escrows").UpdateOne(ctx,
+		bson.M{"_id": escrow.ID, "status": escrow.Status},
+		update,
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errIllegalEscrowTransition
+	}
+
+	escrow.Status = to
+	escrow.Deadline = deadline
+	escrow.UpdatedAt = now
+	escrow.History = append(escrow.History, event)
+
+	if err := syncListingWithEscrow(ctx, *escrow); err != nil {
+		log.Println("Failed to sync listing", escrow.ListingID.Hex(), "with escrow:", err)
+	}
+	publishTradeStatus(models.TradeStatusPayload{GroupID: escrow.GroupID, EscrowID: &escrow.ID, EscrowStatus: to})
+	return nil
+}
+
+// ปิดการซื้อขายและปล่อยเงินให้ผู้ขาย
+// สถานะเปลี่ยนก่อนเพื่อกันปล่อยเงินซ้ำ ถ้าลงบัญชีไม่สำเร็จ reconcileReleasedEscrows จะลงให้ภายหลัง
+func releaseEscrow(ctx context.Context, escrow *models.Escrow, by string) error {
+	if err := transitionEscrow(ctx, escrow, models.EscrowReleased, by, "", nil); err != nil {
+		return err
+	}
+	if err := postEscrowRelease(ctx, *escrow); err != nil {
+		log.Println("Failed to post ledger for released escrow", escrow.ID.Hex(), ", will retry:", err)
+	}
+	return nil
+}
+
+// ลงบัญชีให้ escrow ที่ปล่อยเงินแล้วแต่รายการ escrow_released ใน ledger ยังไม่มีหรือไม่ครบ
+func reconcileReleasedEscrows(ctx context.Context) error {
+	cursor, err := config.GetCollection("escrows").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"status": models.EscrowReleased}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from": "ledger_entries",
+			"let":  bson.M{"eid": "$_id"},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"$expr": bson.M{"$and": bson.A{
+					bson.M{"$eq": bson.A{"$escrowId", "$$eid"}},
+					bson.M{"$eq": bson.A{"$kind", ledgerKindEscrowReleased}},
+				}}}},
+				bson.M{"$project": bson.M{"debit": 1, "credit": 1}},
+			},
+			"as": "posted",
+		}}},
+		// ยังไม่ได้ลง หรือลงไปได้ไม่ครบจนยอดไม่สมดุล
+		{{Key: "$match", Value: bson.M{"$or": bson.A{
+			bson.M{"posted": bson.M{"$size": 0}},
+			bson.M{"$expr": bson.M{"$ne": bson.A{bson.M{"$sum": "$posted.debit"}, bson.M{"$sum": "$posted.credit"}}}},
+		}}}},
+		{{Key: "$project", Value: bson.M{"posted": 0}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	var unposted []models.Escrow
+	if err := cursor.All(ctx, &unposted); err != nil {
+		return err
+	}
+	for _, escrow := range unposted {
+		if err := postEscrowRelease(ctx, escrow); err != nil {
+			log.Println("Failed to reconcile ledger for escrow", escrow.ID.Hex(), ":", err)
+			continue
+		}
+		log.Println("Reconciled ledger for released escrow", escrow.ID.Hex())
+	}
+	return nil
+}
+
+func loadGroupEscrow(c *gin.Context) (models.Group, models.Escrow, string, bool) {
+	group, email, ok := loadMemberGroup(c)
+	if !ok {
+		return models.Group{}, models.Escrow{}, "", false
+	}
+	if group.Buyer != email && group.Seller != email {
+		c.JSON(http.StatusForbidden, gin.H{"error": "คุณไม่ได้เป็นผู้ซื้อหรือผู้ขายในกลุ่มนี้"})
+		return models.Group{}, models.Escrow{}, "", false
+	}
+
+	ctx := c.Request.Context()
+	groupID := group.ID
+	escrow, err := findEscrowByGroup(ctx, groupID)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "ยังไม่มีการซื้อขายผ่านระบบกลางในกลุ่มนี้"})
+		return models.Group{}, models.Escrow{}, "", false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load escrow"})
+		return models.Group{}, models.Escrow{}, "", false
+	}
+
+	return group, escrow, email, true
+}
+
+func respondEscrowTransitionError(c *gin.Context, err error) {
+	if err == errIllegalEscrowTransition {
+		c.JSON(http.StatusConflict, gin.H{"error": "ไม่สามารถเปลี่ยนสถานะการซื้อขายจากสถานะปัจจุบันได้"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update escrow"})
+}
+
+func GetEscrowHandler(c *gin.Context) {
+	_, escrow, _, ok := loadGroupEscrow(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, escrow)
+}
+
+// ผู้ขายแจ้งว่าส่งมอบบัญชีให้ผู้ซื้อแล้ว
+func DeliverEscrowHandler(c *gin.Context) {
+	group, escrow, email, ok := loadGroupEscrow(c)
+	if !ok {
+		return
+	}
+	if group.Seller != email {
+		c.JSON(http.StatusForbidden, gin.H{"error": "เฉพาะผู้ขายเท่านั้นที่แจ้งส่งมอบได้"})
+		return
+	}
+
+	if err := transitionEscrow(c.Request.Context(), &escrow, models.EscrowDelivered, email, "", nil); err != nil {
+		respondEscrowTransitionError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, escrow)
+}
+
+// ผู้ซื้อยืนยันรับบัญชีแล้ว ระบบจะปล่อยเงินให้ผู้ขายทันที
+func AcceptEscrowHandler(c *gin.Context) {
+	group, escrow, email, ok := loadGroupEscrow(c)
+	if !ok {
+		return
+	}
+	if group.Buyer != email {
+		c.JSON(http.StatusForbidden, gin.H{"error": "เฉพาะผู้ซื้อเท่านั้นที่ยืนยันรับสินค้าได้"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	blocked, err := handoverBlocksRelease(ctx, escrow.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load handover"})
+		return
+	}
+	if blocked {
+		c.JSON(http.StatusConflict, gin.H{"error": "กรุณาเปิดดูข้อมูลบัญชีและยืนยันการเปลี่ยนรหัสผ่านก่อน"})
+		return
+	}
+	if err := transitionEscrow(ctx, &escrow, models.EscrowAccepted, email, "", nil); err != nil {
+		respondEscrowTransitionError(c, err)
+		return
+	}
+	if err := releaseEscrow(ctx, &escrow, email); err != nil {
+		respondEscrowTransitionError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, escrow)
+}
+
+func DisputeEscrowHandler(c *gin.Context) {
+	_, escrow, email, ok := loadGroupEscrow(c)
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&reqBody); err != nil || reqBody.Reason == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ต้องระบุเหตุผลในการโต้แย้ง"})
+		return
+	}
+
+	if err := transitionEscrow(c.Request.Context(), &escrow, models.EscrowDisputed, email, reqBody.Reason, nil); err != nil {
+		respondEscrowTransitionError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, escrow)
+}
+
+// จัดการ escrow ที่ค้างเกินเวลา: ไม่จ่ายเงินภายในกำหนดจะถูกยกเลิก
+// ผู้ขายไม่ส่งมอบจะเข้าสู่การโต้แย้ง และผู้ซื้อไม่ตอบหลังส่งมอบจะถือว่ายอมรับ
+// ยกเว้นส่งมอบผ่าน vault ที่ผู้ซื้อยังไม่ยืนยันเปลี่ยนรหัส จะส่งให้ผู้ดูแลตัดสินแทน
+func expireEscrow(ctx context.Context, escrow *models.Escrow) error {
+	switch escrow.Status {
+	case models.EscrowPendingPayment:
+		return transitionEscrow(ctx, escrow, models.EscrowCancelled, escrowSystemActor, "payment timeout", nil)
+	case models.EscrowPaid:
+		return transitionEscrow(ctx, escrow, models.EscrowDisputed, escrowSystemActor, "delivery timeout", nil)
+	case models.EscrowDelivered:
+		blocked, err := handoverBlocksRelease(ctx, escrow.ID)
+		if err != nil {
+			return err
+		}
+		if blocked {
+			return transitionEscrow(ctx, escrow, models.EscrowDisputed, escrowSystemActor, "handover not confirmed", nil)
+		}
+		if err := transitionEscrow(ctx, escrow, models.EscrowAccepted, escrowSystemActor, "acceptance timeout", nil); err != nil {
+			return err
+		}
+		return releaseEscrow(ctx, escrow, escrowSystemActor)
+	}
+	return nil
+}
+
+func EscrowTimeoutWatcher() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+
+		cursor, err := config.GetCollection("escrows").Find(ctx, bson.M{
+			"deadline": bson.M{"$lte": time.Now()},
+		})
+		if err != nil {
+			log.Println("Failed to query expired escrows:", err)
+			cancel()
+			continue
+		}
+
+		var expired []models.Escrow
+		if err := cursor.All(ctx, &expired); err != nil {
+			log.Println("Failed to decode expired escrows:", err)
+		}
+
+		for i := range expired {
+			if err := expireEscrow(ctx, &expired[i]); err != nil && err != errIllegalEscrowTransition {
+				log.Println("Failed to expire escrow", expired[i].ID.Hex(), ":", err)
+			}
+		}
+
+		if err := reconcileReleasedEscrows(ctx); err != nil {
+			log.Println("Failed to reconcile released escrows:", err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ผู้ซื้อและผู้ขายยืนยันพร้อมกัน ต้องได้ escrow หนึ่งรายการเสมอ
+func TestConcurrentTradeConfirmOpensOneEscrow(t *testing.T) {
+	useTestDB(t)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("email", c.GetHeader("X-Test-Email"))
+	})
+	r.PATCH("/chat/groups/:id/confirm", ConfirmTradeHandler)
+
+	for i := 0; i < 10; i++ {
+		now := time.Now()
+		listing := models.Listing{
+			ID:        primitive.NewObjectID(),
+			UserEmail: testSeller,
+			Title:     "test account",
+			Price:     500,
+			Status:    models.ListingActive,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		insertTestDoc(t, "listings", listing)
+		group := models.Group{
+			ID:        primitive.NewObjectID(),
+			Name:      "test group",
+			Members:   []string{testBuyer, testSeller},
+			ProductID: listing.ID.Hex(),
+			Buyer:     testBuyer,
+			Seller:    testSeller,
+			CreatedAt: now.Format(time.RFC3339),
+		}
+		insertTestDoc(t, "groups", group)
+
+		var wg sync.WaitGroup
+		for _, email := range []string{testBuyer, testSeller} {
+			wg.Add(1)
+			go func(email string) {
+				defer wg.Done()
+				if w := doJSON(t, r, http.MethodPatch, "/chat/groups/"+group.ID.Hex()+"/confirm", email, gin.H{"confirmed": true}); w.Code != http.StatusOK {
+					t.Errorf("%s confirm: status %d body %s", email, w.Code, w.Body.String())
+				}
+			}(email)
+		}
+		wg.Wait()
+
+		count, err := config.GetCollection("escrows").CountDocuments(context.Background(), bson.M{"groupId": group.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Fatalf("round %d: %d escrows opened, want 1", i, count)
+		}
+	}
+}
+
+// ลงบัญชีปล่อยเงินไปได้แค่ฝั่งเดียว reconcile ต้องลงเฉพาะแถวที่ขาดด้วย txnId เดิมจนยอดสมดุล
+func TestReconcileCompletesPartialReleasePosting(t *testing.T) {
+	useTestDB(t)
+	t.Setenv("PLATFORM_FEE_PERCENT", "")
+	ctx := context.Background()
+
+	_, escrow := seedPaidTrade(t)
+	_, err := config.GetCollection("escrows").UpdateOne(ctx,
+		bson.M{"_id": escrow.ID}, bson.M{"$set": bson.M{"status": models.EscrowReleased}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	txnID := primitive.NewObjectID()
+	insertTestDoc(t, "ledger_entries", models.LedgerEntry{
+		ID:        primitive.NewObjectID(),
+		TxnID:     txnID,
+		Kind:      ledgerKindEscrowReleased,
+		Account:   ledgerEscrowHolding,
+		Debit:     escrow.Amount,
+		EscrowID:  escrow.ID,
+		CreatedAt: time.Now(),
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := reconcileReleasedEscrows(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cursor, err := config.GetCollection("ledger_entries").Find(ctx,
+		bson.M{"escrowId": escrow.ID, "kind": ledgerKindEscrowReleased})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []models.LedgerEntry
+	if err := cursor.All(ctx, &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("escrow_released entries = %d, want 2", len(entries))
+	}
+	var debit, credit int64
+	for _, e := range entries {
+		if e.TxnID != txnID {
+			t.Errorf("entry %s has txnId %s, want %s", e.Account, e.TxnID.Hex(), txnID.Hex())
+		}
+		debit += e.Debit
+		credit += e.Credit
+	}
+	if debit != credit {
+		t.Fatalf("debit %d != credit %d", debit, credit)
+	}
+}
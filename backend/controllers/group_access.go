@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var errNotGroupMember = errors.New("not a group member")
+
+func isGroupMember(group models.Group, email string) bool {
+	return containsEmail(group.Members, email)
+}
+
+func containsEmail(members []string, email string) bool {
+	if email == "" {
+		return false
+	}
+	for _, member := range members {
+		if member == email {
+			return true
+		}
+	}
+	return false
+}
+
+// โหลดกลุ่มและตรวจว่า email เป็นสมาชิก ใช้ร่วมกันทั้ง /chat และ WebSocket
+func authorizeGroupMember(ctx context.Context, groupID primitive.ObjectID, email string) (models.Group, error) {
+	var group models.Group
+	err := config.GetCollection("groups").FindOne(ctx, bson.M{"_id": groupID}).Decode(&group)
+	if err != nil {
+		return group, err
+	}
+	if !isGroupMember(group, email) {
+		return group, errNotGroupMember
+	}
+	return group, nil
+}
+
+func respondGroupAccessError(c *gin.Context, err error) {
+	switch err {
+	case mongo.ErrNoDocuments:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+	case errNotGroupMember:
+		c.JSON(http.StatusForbidden, gin.H{"error": "คุณไม่ได้เป็นสมาชิกของกลุ่มนี้"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load group"})
+	}
+}
+
+// อ่าน group id จาก :id และผู้ใช้จาก JWT แล้วตรวจสิทธิ์สมาชิก
+// ตอบ error ให้เองและคืน ok=false ถ้าไม่ผ่าน
+func loadMemberGroup(c *gin.Context) (models.Group, string, bool) {
+	groupID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		return models.Group{}, "", false
+	}
+
+	email := c.GetString("email")
+	if email == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return models.Group{}, "", false
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+	defer cancel()
+
+	group, err := authorizeGroupMember(ctx, groupID, email)
+	if err != nil {
+		respondGroupAccessError(c, err)
+		return models.Group{}, "", false
+	}
+	return group, email, true
+}
@@ -0,0 +1,282 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
+	"go-auth-mongo/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const maxHandoverBackupCodes = 20
+
+// handover ผูกกับ escrow ไม่ใช่กลุ่ม เพราะกลุ่มเดียวอาจมี escrow ใหม่หลังคืนเงินหรือยกเลิก
+func findHandoverByEscrow(ctx context.Context, escrowID primitive.ObjectID) (models.Handover, error) {
+	var handover models.Handover
+	err := config.GetCollection("handovers").FindOne(ctx, bson.M{"escrowId": escrowID}).Decode(&handover)
+	return handover, err
+}
+
+// escrow ที่มีการส่งมอบผ่าน vault ต้องให้ผู้ซื้อยืนยันเปลี่ยนรหัสก่อนจึงปล่อยเงินได้
+func handoverBlocksRelease(ctx context.Context, escrowID primitive.ObjectID) (bool, error) {
+	handover, err := findHandoverByEscrow(ctx, escrowID)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return handover.Status != models.HandoverConfirmed, nil
+}
+
+func GetHandoverHandler(c *gin.Context) {
+	_, escrow, _, ok := loadGroupEscrow(c)
+	if !ok {
+		return
+	}
+
+	handover, err := findHandoverByEscrow(c.Request.Context(), escrow.ID)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "ผู้ขายยังไม่ได้ส่งมอบข้อมูลบัญชี"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load handover"})
+		return
+	}
+
+	c.JSON(http.StatusOK, handover)
+}
+
+// ผู้ขายส่งข้อมูลบัญชีหลังผู้ซื้อชำระเงินแล้ว แก้ไขได้จนกว่าผู้ซื้อจะเปิดดู
+func SubmitHandoverHandler(c *gin.Context) {
+	group, escrow, email, ok := loadGroupEscrow(c)
+	if !ok {
+		return
+	}
+	if group.Seller != email {
+		c.JSON(http.StatusForbidden, gin.H{"error": "เฉพาะผู้ขายเท่านั้นที่ส่งมอบข้อมูลบัญชีได้"})
+		return
+	}
+	if escrow.Status != models.EscrowPaid && escrow.Status != models.EscrowDelivered {
+		c.JSON(http.StatusConflict, gin.H{"error": "ส่งมอบข้อมูลได้หลังผู้ซื้อชำระเงินแล้วเท่านั้น"})
+		return
+	}
+
+	var secrets models.HandoverSecrets
+	if err := c.ShouldBindJSON(&secrets); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	secrets.Username = strings.TrimSpace(secrets.Username)
+	secrets.RecoveryEmail = strings.TrimSpace(secrets.RecoveryEmail)
+	if secrets.Username == "" || secrets.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ต้องระบุชื่อผู้ใช้และรหัสผ่าน"})
+		return
+	}
+	if len(secrets.BackupCodes) > maxHandoverBackupCodes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many backup codes"})
+		return
+	}
+
+	raw, err := json.Marshal(secrets)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode credentials"})
+		return
+	}
+	secret, err := utils.Encrypt(string(raw))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt credentials"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	collection := config.GetCollection("handovers")
+	now := time.Now()
+
+	existing, err := findHandoverByEscrow(ctx, escrow.ID)
+	switch {
+	case err == mongo.ErrNoDocuments:
+		existing = models.Handover{
+			ID:               primitive.NewObjectID(),
+			GroupID:          group.ID,
+			EscrowID:         escrow.ID,
+			ListingID:        escrow.ListingID,
+			Buyer:            escrow.Buyer,
+			Seller:           escrow.Seller,
+			Status:           models.HandoverSubmitted,
+			Secret:           secret,
+			HasRecoveryEmail: secrets.RecoveryEmail != "",
+			BackupCodeCount:  len(secrets.BackupCodes),
+			SubmittedAt:      now,
+			CreatedAt:        now,
+			UpdatedAt:        now,
+		}
+		if _, err := collection.InsertOne(ctx, existing); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save handover"})
+			return
+		}
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load handover"})
+		return
+	default:
+		result, err := collection.UpdateOne(ctx,
+			bson.M{"_id": existing.ID, "status": models.HandoverSubmitted},
+			bson.M{"$set": bson.M{
+				"secret":           secret,
+				"hasRecoveryEmail": secrets.RecoveryEmail != "",
+				"backupCodeCount":  len(secrets.BackupCodes),
+				"submittedAt":      now,
+				"updatedAt":        now,
+			}},
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save handover"})
+			return
+		}
+		if result.MatchedCount == 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "ผู้ซื้อเปิดดูข้อมูลแล้ว ไม่สามารถแก้ไขได้"})
+			return
+		}
+		existing.Secret = secret
+		existing.HasRecoveryEmail = secrets.RecoveryEmail != ""
+		existing.BackupCodeCount = len(secrets.BackupCodes)
+		existing.SubmittedAt = now
+		existing.UpdatedAt = now
+	}
+
+	// การส่งข้อมูลบัญชีถือเป็นการส่งมอบสินค้า
+	if escrow.Status == models.EscrowPaid {
+		if err := transitionEscrow(ctx, &escrow, models.EscrowDelivered, email, "credentials submitted", nil); err != nil {
+			respondEscrowTransitionError(c, err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"handover": existing, "escrow": escrow})
+}
+
+// ผู้ซื้อเปิดดูข้อมูลบัญชีได้ครั้งเดียว
+func RevealHandoverHandler(c *gin.Context) {
+	group, escrow, email, ok := loadGroupEscrow(c)
+	if !ok {
+		return
+	}
+	if group.Buyer != email {
+		c.JSON(http.StatusForbidden, gin.H{"error": "เฉพาะผู้ซื้อเท่านั้นที่เปิดดูข้อมูลบัญชีได้"})
+		return
+	}
+	// ระหว่างข้อพิพาทห้ามเปิดดู เพื่อไม่ให้ผู้ซื้อได้ทั้งบัญชีและเงินคืน (เหมือน credentialRevealEscrowStatuses)
+	if escrow.Status != models.EscrowPaid && escrow.Status != models.EscrowDelivered {
+		c.JSON(http.StatusConflict, gin.H{"error": "ไม่สามารถเปิดดูข้อมูลบัญชีในสถานะนี้ได้"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	handover, err := findHandoverByEscrow(ctx, escrow.ID)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "ผู้ขายยังไม่ได้ส่งมอบข้อมูลบัญชี"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load handover"})
+		return
+	}
+	if handover.Status != models.HandoverSubmitted {
+		c.JSON(http.StatusGone, gin.H{"error": "ข้อมูลบัญชีถูกเปิดดูไปแล้ว"})
+		return
+	}
+
+	// ถอดรหัสให้ได้ก่อน จะได้ไม่เสียสิทธิ์ดูครั้งเดียวถ้าถอดไม่สำเร็จ
+	plaintext, err := utils.Decrypt(handover.Secret)
+	if err != nil {
+		log.Println("Failed to decrypt handover", handover.ID.Hex(), ":", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt credentials"})
+		return
+	}
+	var secrets models.HandoverSecrets
+	if err := json.Unmarshal([]byte(plaintext), &secrets); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode credentials"})
+		return
+	}
+
+	collection := config.GetCollection("handovers")
+	now := time.Now()
+	result, err := collection.UpdateOne(ctx,
+		bson.M{"_id": handover.ID, "status": models.HandoverSubmitted},
+		bson.M{"$set": bson.M{"status": models.HandoverRevealed, "revealedAt": now, "updatedAt": now}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update handover"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusGone, gin.H{"error": "ข้อมูลบัญชีถูกเปิดดูไปแล้ว"})
+		return
+	}
+
+	// บันทึกหลังจองสิทธิ์สำเร็จ เพื่อไม่ให้มี log ของการเปิดดูที่ไม่ได้เกิดขึ้นจริง
+	entry := models.CredentialAccessLog{ListingID: handover.ListingID, EscrowID: &escrow.ID, Viewer: email, Role: "buyer"}
+	if err := logCredentialAccess(ctx, c, entry); err != nil {
+		log.Println("Failed to write credential access log:", handover.ID.Hex(), err)
+		_, undoErr := collection.UpdateOne(ctx,
+			bson.M{"_id": handover.ID, "status": models.HandoverRevealed},
+			bson.M{"$set": bson.M{"status": models.HandoverSubmitted, "updatedAt": time.Now()}, "$unset": bson.M{"revealedAt": ""}},
+		)
+		if undoErr != nil {
+			log.Println("Failed to undo handover reveal", handover.ID.Hex(), ":", undoErr)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record access"})
+		return
+	}
+
+	c.JSON(http.StatusOK, secrets)
+}
+
+// ผู้ซื้อยืนยันว่าเปลี่ยนรหัสผ่านแล้ว ระบบจะยอมรับสินค้าและปล่อยเงินให้ผู้ขาย
+func ConfirmHandoverHandler(c *gin.Context) {
+	group, escrow, email, ok := loadGroupEscrow(c)
+	if !ok {
+		return
+	}
+	if group.Buyer != email {
+		c.JSON(http.StatusForbidden, gin.H{"error": "เฉพาะผู้ซื้อเท่านั้นที่ยืนยันได้"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	now := time.Now()
+	result, err := config.GetCollection("handovers").UpdateOne(ctx,
+		bson.M{"escrowId": escrow.ID, "status": models.HandoverRevealed},
+		bson.M{"$set": bson.M{"status": models.HandoverConfirmed, "confirmedAt": now, "updatedAt": now}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update handover"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "ต้องเปิดดูข้อมูลบัญชีก่อนยืนยันการเปลี่ยนรหัสผ่าน"})
+		return
+	}
+
+	if err := transitionEscrow(ctx, &escrow, models.EscrowAccepted, email, "password changed", nil); err != nil {
+		respondEscrowTransitionError(c, err)
+		return
+	}
+	if err := releaseEscrow(ctx, &escrow, email); err != nil {
+		respondEscrowTransitionError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, escrow)
+}
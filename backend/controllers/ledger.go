@@ -0,0 +1,227 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ledgerOmiseClearing  = "omise_clearing"
+	ledgerEscrowHolding  = "escrow_holding"
+	ledgerPlatformFees   = "platform_fees"
+	ledgerPayoutClearing = "payout_clearing"
+
+	ledgerKindPaymentReceived = "payment_received"
+	ledgerKindEscrowReleased  = "escrow_released"
+	ledgerKindPayout          = "payout"
+	ledgerKindPayoutReversal  = "payout_reversal"
+	ledgerKindRefund          = "refund"
+)
+
+var errUnbalancedLedgerTxn = errors.New("ledger transaction is not balanced")
+
+func sellerPayableAccount(email string) string {
+	return "seller_payable:" + email
+}
+
+// ค่าธรรมเนียมแพลตฟอร์มเป็นเปอร์เซ็นต์จาก PLATFORM_FEE_PERCENT เช่น "5" หรือ "2.5"
+func platformFeePercent() float64 {
+	raw := os.Getenv("PLATFORM_FEE_PERCENT")
+	if raw == "" {
+		return 0
+	}
+	percent, err := strconv.ParseFloat(raw, 64)
+	if err != nil || percent < 0 || percent > 100 {
+		log.Println("Invalid PLATFORM_FEE_PERCENT, using 0:", raw)
+		return 0
+	}
+	return percent
+}
+
+func platformFeeFor(amount int64) int64 {
+	return int64(float64(amount) * platformFeePercent() / 100)
+}
+
+func checkLedgerBalanced(entries []models.LedgerEntry) error {
+	var debit, credit int64
+	for _, e := range entries {
+		debit += e.Debit
+		credit += e.Credit
+	}
+	if debit != credit || debit == 0 {
+		return errUnbalancedLedgerTxn
+	}
+	return nil
+}
+
+func insertLedgerEntries(ctx context.Context, txnID primitive.ObjectID, entries []models.LedgerEntry) error {
+	now := time.Now()
+	docs := make([]interface{}, 0, len(entries))
+	for _, e := range entries {
+		e.ID = primitive.NewObjectID()
+		e.TxnID = txnID
+		e.CreatedAt = now
+		docs = append(docs, e)
+	}
+
+	_, err := config.GetCollection("ledger_entries").InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	return err
+}
+
+// รายการที่ไม่ผูกกับ escrow (เช่น payout) ไม่มี unique index ให้ลงซ้ำเฉพาะแถวที่ขาด
+// ถ้า insert ได้ไม่ครบจึงลบแถวของ txnId นี้ทิ้ง ให้ผู้เรียกถือว่าไม่ได้ลงบัญชีเลย
+func postLedgerTxn(ctx context.Context, entries []models.LedgerEntry) error {
+	if err := checkLedgerBalanced(entries); err != nil {
+		return err
+	}
+
+	txnID := primitive.NewObjectID()
+	err := insertLedgerEntries(ctx, txnID, entries)
+	if err != nil {
+		// ctx เดิมอาจหมดเวลาไปแล้ว
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, delErr := config.GetCollection("ledger_entries").DeleteMany(cleanupCtx, bson.M{"txnId": txnID}); delErr != nil {
+			log.Println("Failed to roll back partial ledger txn", txnID.Hex(), ":", delErr)
+		}
+	}
+	return err
+}
+
+// true เมื่อทุก error ของ insert เป็น duplicate key คือแถวนั้นมีคนลงไว้แล้ว
+func onlyDuplicateKeyErrors(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) {
+		return mongo.IsDuplicateKeyError(err)
+	}
+	if bulkErr.WriteConcernError != nil || len(bulkErr.WriteErrors) == 0 {
+		return false
+	}
+	for _, we := range bulkErr.WriteErrors {
+		if we.Code != 11000 {
+			return false
+		}
+	}
+	return true
+}
+
+// ลงบัญชีของ escrow ได้ครั้งเดียวต่อ kind โดย unique index (escrowId, kind, account) กันแถวซ้ำ
+// InsertMany ไม่ได้อยู่ใน transaction ถ้าลงไปได้บางแถว การเรียกซ้ำจะลงเฉพาะบัญชีที่ยังขาดด้วย txnId เดิม
+// ส่วนแถวที่ได้ duplicate key เพราะมีคนลงพร้อมกันถือว่าลงแล้ว
+func postEscrowLedgerTxn(ctx context.Context, escrowID primitive.ObjectID, kind string, entries []models.LedgerEntry) error {
+	if err := checkLedgerBalanced(entries); err != nil {
+		return err
+	}
+
+	cursor, err := config.GetCollection("ledger_entries").Find(ctx, bson.M{
+		"escrowId": escrowID,
+		"kind":     kind,
+	})
+	if err != nil {
+		return err
+	}
+	var posted []models.LedgerEntry
+	if err := cursor.All(ctx, &posted); err != nil {
+		return err
+	}
+
+	txnID := primitive.NewObjectID()
+	postedAccounts := make(map[string]bool, len(posted))
+	for _, e := range posted {
+		postedAccounts[e.Account] = true
+		txnID = e.TxnID
+	}
+	missing := make([]models.LedgerEntry, 0, len(entries))
+	for _, e := range entries {
+		if !postedAccounts[e.Account] {
+			missing = append(missing, e)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if len(posted) > 0 {
+		log.Println("Completing partially posted ledger", kind, "for escrow", escrowID.Hex())
+	}
+
+	err = insertLedgerEntries(ctx, txnID, missing)
+	if err != nil && onlyDuplicateKeyErrors(err) {
+		return nil
+	}
+	return err
+}
+
+// เงินเข้าจาก Omise ถูกพักไว้ในบัญชี escrow จนกว่าจะปล่อยให้ผู้ขาย
+func postPaymentReceived(ctx context.Context, escrow models.Escrow) error {
+	return postEscrowLedgerTxn(ctx, escrow.ID, ledgerKindPaymentReceived, []models.LedgerEntry{
+		{Kind: ledgerKindPaymentReceived, Account: ledgerOmiseClearing, Debit: escrow.Amount, EscrowID: escrow.ID, Memo: escrow.ChargeID},
+		{Kind: ledgerKindPaymentReceived, Account: ledgerEscrowHolding, Credit: escrow.Amount, EscrowID: escrow.ID, Memo: escrow.ChargeID},
+	})
+}
+
+// ปล่อยเงินจาก escrow ให้ผู้ขายหลังหักค่าธรรมเนียมแพลตฟอร์ม
+func postEscrowRelease(ctx context.Context, escrow models.Escrow) error {
+	fee := platformFeeFor(escrow.Amount)
+	entries := []models.LedgerEntry{
+		{Kind: ledgerKindEscrowReleased, Account: ledgerEscrowHolding, Debit: escrow.Amount, EscrowID: escrow.ID},
+		{Kind: ledgerKindEscrowReleased, Account: sellerPayableAccount(escrow.Seller), Credit: escrow.Amount - fee, EscrowID: escrow.ID},
+	}
+	if fee > 0 {
+		entries = append(entries, models.LedgerEntry{
+			Kind: ledgerKindEscrowReleased, Account: ledgerPlatformFees, Credit: fee, EscrowID: escrow.ID,
+		})
+	}
+
+	return postEscrowLedgerTxn(ctx, escrow.ID, ledgerKindEscrowReleased, entries)
+}
+
+// คืนเงินที่พักไว้ใน escrow กลับไปให้ผู้ซื้อผ่าน Omise
+func postEscrowRefund(ctx context.Context, escrow models.Escrow, omiseRefundID string) error {
+	return postEscrowLedgerTxn(ctx, escrow.ID, ledgerKindRefund, []models.LedgerEntry{
+		{Kind: ledgerKindRefund, Account: ledgerEscrowHolding, Debit: escrow.Amount, EscrowID: escrow.ID, Memo: omiseRefundID},
+		{Kind: ledgerKindRefund, Account: ledgerOmiseClearing, Credit: escrow.Amount, EscrowID: escrow.ID, Memo: omiseRefundID},
+	})
+}
+
+// ยอดคงเหลือฝั่ง credit (credit - debit) แยกตามบัญชี
+func ledgerCreditBalances(ctx context.Context, match bson.M) (map[string]int64, error) {
+	cursor, err := config.GetCollection("ledger_entries").Aggregate(ctx, []bson.M{
+		{"$match": match},
+		{"$group": bson.M{
+			"_id":    "$account",
+			"debit":  bson.M{"$sum": "$debit"},
+			"credit": bson.M{"$sum": "$credit"},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var rows []struct {
+		Account string `bson:"_id"`
+		Debit   int64  `bson:"debit"`
+		Credit  int64  `bson:"credit"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+
+	balances := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		balances[row.Account] = row.Credit - row.Debit
+	}
+	return balances, nil
+}
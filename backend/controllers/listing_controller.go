@@ -2,27 +2,24 @@ package controllers
 
 import (
 	"context"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"encoding/base64"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"time"
 
 	"go-auth-mongo/config"
 	"go-auth-mongo/models"
+	"go-auth-mongo/utils"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gin-gonic/gin"
-	"github.com/joho/godotenv"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type SafeUser struct {
@@ -44,63 +41,121 @@ type SafeUser struct {
 }
 
 type ListingWithUser struct {
-	Listing models.Listing `json:"listing"`
-	User    SafeUser       `json:"user"`
+	Listing models.Listing `bson:"listing" json:"listing"`
+	User    SafeUser       `bson:"user" json:"user"`
 }
 
-var secretKey []byte
+func encryptListingCredentials(password, secondPassword string) (string, string, error) {
+	encPassword, err := utils.Encrypt(password)
+	if err != nil {
+		return "", "", err
+	}
+	encSecondPassword, err := utils.Encrypt(secondPassword)
+	if err != nil {
+		return "", "", err
+	}
+	return encPassword, encSecondPassword, nil
+}
 
-func init() {
-	if err := godotenv.Load(); err != nil {
-		log.Println("No .env file found - using environment variables from system")
+func decryptListingCredentials(listing *models.Listing) error {
+	password, err := utils.Decrypt(listing.Password)
+	if err != nil {
+		return err
+	}
+	secondPassword, err := utils.Decrypt(listing.SecondPassword)
+	if err != nil {
+		return err
 	}
+	listing.Password = password
+	listing.SecondPassword = secondPassword
+	return nil
+}
+
+// ไม่ส่งรหัส (แม้เข้ารหัสแล้ว) ออกไปนอก /listing/:id/decrypted
+func redactListingCredentials(listing *models.Listing) {
+	listing.Password = ""
+	listing.SecondPassword = ""
+}
 
-	key := os.Getenv("SECRET_KEY")
+var errIllegalListingTransition = errors.New("illegal listing status transition")
 
-	if key == "" {
-		log.Fatal("SECRET_KEY environment variable is not set")
+// สถานะที่เจ้าของ listing ตั้งเองได้ ส่วน reserved/sold เป็นของระบบซื้อขายกลาง
+func ownerSettableListingStatus(status models.ListingStatus) bool {
+	switch status {
+	case models.ListingDraft, models.ListingActive, models.ListingHidden, models.ListingRemoved:
+		return true
 	}
+	return false
+}
+
+// listing เก่าใช้สถานะ inactive (ถูกระงับ) และ refund (ผู้ซื้อขอคืนเงิน) ซึ่งไม่มีในระบบสถานะใหม่
+// inactive กลายเป็น hidden ส่วน refund กลับไปเป็น reserved ถ้ายังมี escrow ที่ค้างอยู่ ไม่อย่างนั้นเป็น active
+func MigrateLegacyListingStatuses() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 
-	log.Printf("SECRET_KEY length: %d characters", len(key))
+	listings := config.GetCollection("listings")
 
-	if len(key) != 32 {
-		log.Fatalf("SECRET_KEY must be exactly 32 characters (current: %d)", len(key))
+	result, err := listings.UpdateMany(ctx,
+		bson.M{"status": "inactive"},
+		bson.M{"$set": bson.M{"status": models.ListingHidden, "updatedAt": time.Now()}},
+	)
+	if err != nil {
+		log.Println("Failed to migrate inactive listings:", err)
+	} else if result.ModifiedCount > 0 {
+		log.Println("Migrated", result.ModifiedCount, "inactive listings to hidden")
 	}
 
-	secretKey = []byte(key)
-	log.Println("SECRET_KEY loaded successfully")
-}
-
-func Encrypt(text string) (string, error) {
-	plaintext := []byte(text)
-	block, err := aes.NewCipher(secretKey)
+	cursor, err := listings.Find(ctx, bson.M{"status": "refund"})
 	if err != nil {
-		return "", err
+		log.Println("Failed to query refund listings:", err)
+		return
 	}
-	ciphertext := make([]byte, aes.BlockSize+len(plaintext))
-	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return "", err
+	var legacy []models.Listing
+	if err := cursor.All(ctx, &legacy); err != nil {
+		log.Println("Failed to decode refund listings:", err)
+		return
+	}
+
+	for _, listing := range legacy {
+		to := models.ListingActive
+		count, err := config.GetCollection("escrows").CountDocuments(ctx, bson.M{
+			"listingId": listing.ID,
+			"status": bson.M{"$nin": []models.EscrowStatus{
+				models.EscrowReleased, models.EscrowCancelled, models.EscrowRefunded,
+			}},
+		})
+		if err != nil {
+			log.Println("Failed to check escrow for listing", listing.ID.Hex(), ":", err)
+			continue
+		}
+		if count > 0 {
+			to = models.ListingReserved
+		}
+		_, err = listings.UpdateOne(ctx,
+			bson.M{"_id": listing.ID, "status": "refund"},
+			bson.M{"$set": bson.M{"status": to, "updatedAt": time.Now()}},
+		)
+		if err != nil {
+			log.Println("Failed to migrate refund listing", listing.ID.Hex(), ":", err)
+			continue
+		}
+		log.Println("Migrated refund listing", listing.ID.Hex(), "to", to)
 	}
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(ciphertext[aes.BlockSize:], plaintext)
-	return base64.URLEncoding.EncodeToString(ciphertext), nil
 }
 
-func Decrypt(cryptoText string) (string, error) {
-	ciphertext, _ := base64.URLEncoding.DecodeString(cryptoText)
-	block, err := aes.NewCipher(secretKey)
+func transitionListingStatus(ctx context.Context, listingID primitive.ObjectID, to models.ListingStatus) error {
+	result, err := config.DB.Collection("listings").UpdateOne(ctx,
+		bson.M{"_id": listingID, "status": bson.M{"$in": models.ListingStatusesBefore(to)}},
+		bson.M{"$set": bson.M{"status": to, "updatedAt": time.Now()}},
+	)
 	if err != nil {
-		return "", err
+		return err
 	}
-	if len(ciphertext) < aes.BlockSize {
-		return "", err
+	if result.MatchedCount == 0 {
+		return errIllegalListingTransition
 	}
-	iv := ciphertext[:aes.BlockSize]
-	ciphertext = ciphertext[aes.BlockSize:]
-	stream := cipher.NewCFBDecrypter(block, iv)
-	stream.XORKeyStream(ciphertext, ciphertext)
-	return string(ciphertext), nil
+	return nil
 }
 
 func GetDecryptedListingByID(c *gin.Context) {
@@ -122,11 +177,57 @@ func GetDecryptedListingByID(c *gin.Context) {
 		return
 	}
 
-	password, _ := Decrypt(listing.Password)
-	secondPassword, _ := Decrypt(listing.SecondPassword)
+	entry, err := authorizeCredentialAccess(ctx, listing, c.GetString("email"))
+	if err == errCredentialAccessDenied {
+		c.JSON(http.StatusForbidden, gin.H{"error": "ดูรหัสได้เฉพาะเจ้าของสินค้า หรือผู้ซื้อที่ชำระเงินแล้ว"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check access"})
+		return
+	}
 
-	listing.Password = password
-	listing.SecondPassword = secondPassword
+	if entry.Role == "buyer" {
+		// ถ้าผู้ขายส่งมอบผ่าน vault แล้ว ผู้ซื้อต้องเปิดดูผ่าน handover เท่านั้น
+		_, err := findHandoverByEscrow(ctx, *entry.EscrowID)
+		if err == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "กรุณาเปิดดูข้อมูลบัญชีผ่านห้องแชทซื้อขาย"})
+			return
+		}
+		if err != mongo.ErrNoDocuments {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load handover"})
+			return
+		}
+	}
+
+	// ถอดรหัสให้ได้ก่อน จะได้ไม่เสียสิทธิ์ดูครั้งเดียวของผู้ซื้อถ้าถอดไม่สำเร็จ
+	if err := decryptListingCredentials(&listing); err != nil {
+		log.Println("Failed to decrypt listing credentials:", listing.ID.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decrypt listing"})
+		return
+	}
+
+	if entry.Role == "buyer" {
+		err := claimBuyerReveal(ctx, *entry.EscrowID)
+		if err == errCredentialsAlreadyViewed {
+			c.JSON(http.StatusGone, gin.H{"error": "ข้อมูลบัญชีถูกเปิดดูไปแล้ว"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record access"})
+			return
+		}
+	}
+
+	// ต้องบันทึก log ได้ก่อนจึงจะเปิดเผยรหัส
+	if err := logCredentialAccess(ctx, c, entry); err != nil {
+		log.Println("Failed to write credential access log:", listing.ID.Hex(), err)
+		if entry.Role == "buyer" {
+			releaseBuyerReveal(ctx, *entry.EscrowID)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record access"})
+		return
+	}
 
 	c.JSON(http.StatusOK, listing)
 }
@@ -168,8 +269,20 @@ func CreateListing(c *gin.Context) {
 		return
 	}
 
-	encPassword, _ := Encrypt(input.Password)
-	encSecondPassword, _ := Encrypt(input.SecondPassword)
+	status := models.ListingStatus(input.Status)
+	if status == "" {
+		status = models.ListingActive
+	}
+	if status != models.ListingDraft && status != models.ListingActive && status != models.ListingHidden {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+		return
+	}
+
+	encPassword, encSecondPassword, err := encryptListingCredentials(input.Password, input.SecondPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt credentials"})
+		return
+	}
 
 	listing := models.Listing{
 		ID:             primitive.NewObjectID(),
@@ -180,7 +293,7 @@ func CreateListing(c *gin.Context) {
 		Description:    input.Description,
 		Images:         input.Images,
 		BankAccount:    bankAccountID,
-		Status:         input.Status,
+		Status:         status,
 		FormType:       input.FormType,
 		Username:       input.Username,
 		Password:       encPassword,
@@ -197,63 +310,70 @@ func CreateListing(c *gin.Context) {
 		return
 	}
 
+	redactListingCredentials(&listing)
 	c.JSON(http.StatusOK, gin.H{"message": "Listing created", "listing": listing})
 }
 
 func GetListingsAll(c *gin.Context) {
+	query, err := parseListingQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
 
+	// ซ่อนประกาศของผู้ขายที่ถูกระงับบัญชี
+	query.Filter["$nor"] = hideSuspendedSellersFilter(time.Now())
+
 	listingsCollection := config.DB.Collection("listings")
-	usersCollection := config.DB.Collection("users")
 
-	cursor, err := listingsCollection.Find(ctx, bson.M{})
+	total, err := listingsCollection.CountDocuments(ctx, query.Filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count listings"})
+		return
+	}
+
+	pipeline := []bson.M{
+		{"$match": query.pageFilter()},
+		{"$sort": query.sortDoc()},
+		{"$limit": query.Limit + 1},
+	}
+	cursor, err := listingsCollection.Aggregate(ctx, append(pipeline, listingSellerLookup()...))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get listings"})
 		return
 	}
 	defer cursor.Close(ctx)
 
-	var listings []models.Listing
-	if err := cursor.All(ctx, &listings); err != nil {
+	var rows []ListingWithUser
+	if err := cursor.All(ctx, &rows); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse listings"})
 		return
 	}
 
-	var results []ListingWithUser
+	nextCursor := ""
+	if int64(len(rows)) > query.Limit {
+		rows = rows[:query.Limit]
+		nextCursor = encodeListingCursor(query.Sort, rows[len(rows)-1].Listing)
+	}
 
-	for _, listing := range listings {
-		var user models.User
-		err := usersCollection.FindOne(ctx, bson.M{"email": listing.UserEmail}).Decode(&user)
-		if err != nil {
+	// ข้ามประกาศที่หาเจ้าของไม่เจอ เหมือนเดิม แต่ตัดหลังคำนวณ cursor เพื่อไม่ให้หน้าขาดหาย
+	results := []ListingWithUser{}
+	for _, row := range rows {
+		if row.User.ID.IsZero() {
 			continue
 		}
-
-		safeUser := SafeUser{
-			ID:        user.ID,
-			FirstName: user.FirstName,
-			LastName:  user.LastName,
-			NameStore: user.NameStore,
-			Email:     user.Email,
-			Username:  user.Username,
-			Phone:     user.Phone,
-			Address:   user.Address,
-			Facebook:  user.Facebook,
-			Instagram: user.Instagram,
-			Line:      user.Line,
-			Discord:   user.Discord,
-			Bio:       user.Bio,
-			Games:     user.Games,
-			Image:     user.Image,
-		}
-
-		results = append(results, ListingWithUser{
-			Listing: listing,
-			User:    safeUser,
-		})
+		redactListingCredentials(&row.Listing)
+		results = append(results, row)
 	}
 
-	c.JSON(http.StatusOK, results)
+	c.JSON(http.StatusOK, gin.H{
+		"items":      results,
+		"total":      total,
+		"nextCursor": nextCursor,
+	})
 }
 
 func GetListingByID(c *gin.Context) {
@@ -275,6 +395,7 @@ func GetListingByID(c *gin.Context) {
 		return
 	}
 
+	redactListingCredentials(&listing)
 	c.JSON(http.StatusOK, listing)
 }
 
@@ -306,6 +427,9 @@ func GetListingsUser(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse listings"})
 		return
 	}
+	for i := range listings {
+		redactListingCredentials(&listings[i])
+	}
 
 	c.JSON(http.StatusOK, listings)
 }
@@ -348,13 +472,37 @@ func UpdateListing(c *gin.Context) {
 	defer cancel()
 
 	var existingListing struct {
-		Images []string `bson:"images"`
+		UserEmail string               `bson:"userEmail"`
+		Images    []string             `bson:"images"`
+		Price     int                  `bson:"price"`
+		Status    models.ListingStatus `bson:"status"`
 	}
 	err = collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&existingListing)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Listing not found"})
 		return
 	}
+	if existingListing.UserEmail != c.GetString("email") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "คุณไม่ใช่เจ้าของสินค้านี้"})
+		return
+	}
+
+	status := existingListing.Status
+	// ระหว่างซื้อขายหรือขายแล้ว สถานะและราคาเปลี่ยนได้จาก escrow เท่านั้น
+	if status == models.ListingReserved || status == models.ListingSold {
+		if (input.Status != "" && models.ListingStatus(input.Status) != status) || input.Price != existingListing.Price {
+			c.JSON(http.StatusConflict, gin.H{"error": "ไม่สามารถเปลี่ยนสถานะหรือราคาของสินค้าที่อยู่ระหว่างการซื้อขายหรือขายแล้วได้"})
+			return
+		}
+	}
+	if input.Status != "" && models.ListingStatus(input.Status) != status {
+		next := models.ListingStatus(input.Status)
+		if !ownerSettableListingStatus(next) || !status.CanTransitionTo(next) {
+			c.JSON(http.StatusConflict, gin.H{"error": "ไม่สามารถเปลี่ยนสถานะสินค้าจาก " + string(status) + " เป็น " + input.Status + " ได้"})
+			return
+		}
+		status = next
+	}
 
 	if len(input.Images) > 0 && len(existingListing.Images) > 0 {
 		for _, oldURL := range existingListing.Images {
@@ -369,28 +517,46 @@ func UpdateListing(c *gin.Context) {
 		}
 	}
 
-	update := bson.M{
-		"$set": bson.M{
-			"game":           input.Game,
-			"title":          input.Title,
-			"price":          input.Price,
-			"description":    input.Description,
-			"images":         input.Images,
-			"bankAccount":    bankAccountID,
-			"status":         input.Status,
-			"formType":       input.FormType,
-			"username":       input.Username,
-			"password":       input.Password,
-			"secondPassword": input.SecondPassword,
-			"updatedAt":      time.Now(),
-		},
-	}
-
-	result, err := collection.UpdateOne(ctx, bson.M{"_id": objectID}, update)
-	if err != nil || result.MatchedCount == 0 {
+	set := bson.M{
+		"game":        input.Game,
+		"title":       input.Title,
+		"price":       input.Price,
+		"description": input.Description,
+		"images":      input.Images,
+		"bankAccount": bankAccountID,
+		"status":      status,
+		"formType":    input.FormType,
+		"username":    input.Username,
+		"updatedAt":   time.Now(),
+	}
+
+	// รหัสไม่ถูกส่งกลับไปให้ฟอร์มแก้ไข ถ้าส่งมาว่างแปลว่าใช้ค่าเดิม
+	if input.Password != "" {
+		encPassword, err := utils.Encrypt(input.Password)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt credentials"})
+			return
+		}
+		set["password"] = encPassword
+	}
+	if input.SecondPassword != "" {
+		encSecondPassword, err := utils.Encrypt(input.SecondPassword)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt credentials"})
+			return
+		}
+		set["secondPassword"] = encSecondPassword
+	}
+
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": objectID, "status": existingListing.Status}, bson.M{"$set": set})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update listing"})
 		return
 	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "สถานะสินค้าถูกเปลี่ยนระหว่างแก้ไข กรุณาลองใหม่"})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Listing updated successfully"})
 }
@@ -407,51 +573,30 @@ func GetListingWithUserByID(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	listingsCollection := config.DB.Collection("listings")
-	usersCollection := config.DB.Collection("users")
-
-	var listing models.Listing
-	err = listingsCollection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&listing)
+	pipeline := append([]bson.M{{"$match": bson.M{"_id": objectID}}}, listingSellerLookup()...)
+	cursor, err := config.DB.Collection("listings").Aggregate(ctx, pipeline)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Listing not found"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get listing"})
 		return
 	}
+	defer cursor.Close(ctx)
 
-	password, _ := Decrypt(listing.Password)
-	secondPassword, _ := Decrypt(listing.SecondPassword)
-	listing.Password = password
-	listing.SecondPassword = secondPassword
-
-	var user models.User
-	err = usersCollection.FindOne(ctx, bson.M{"email": listing.UserEmail}).Decode(&user)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	var rows []ListingWithUser
+	if err := cursor.All(ctx, &rows); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse listing"})
 		return
 	}
-
-	safeUser := SafeUser{
-		ID:        user.ID,
-		FirstName: user.FirstName,
-		LastName:  user.LastName,
-		NameStore: user.NameStore,
-		Email:     user.Email,
-		Username:  user.Username,
-		Phone:     user.Phone,
-		Address:   user.Address,
-		Facebook:  user.Facebook,
-		Instagram: user.Instagram,
-		Line:      user.Line,
-		Discord:   user.Discord,
-		Bio:       user.Bio,
-		Games:     user.Games,
-		Image:     user.Image,
+	if len(rows) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Listing not found"})
+		return
 	}
-
-	result := ListingWithUser{
-		Listing: listing,
-		User:    safeUser,
+	result := rows[0]
+	if result.User.ID.IsZero() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
 	}
 
+	redactListingCredentials(&result.Listing)
 	c.JSON(http.StatusOK, result)
 }
 
@@ -473,6 +618,56 @@ func DeleteListing(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Listing not found"})
 		return
 	}
+	if listing.UserEmail != c.GetString("email") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "คุณไม่ใช่เจ้าของสินค้านี้"})
+		return
+	}
+
+	switch listing.Status {
+	case models.ListingReserved:
+		c.JSON(http.StatusConflict, gin.H{"error": "ไม่สามารถลบสินค้าที่กำลังอยู่ระหว่างการซื้อขายได้"})
+		return
+	case models.ListingSold:
+		c.JSON(http.StatusConflict, gin.H{"error": "ไม่สามารถลบสินค้าที่ขายแล้วได้"})
+		return
+	case models.ListingRemoved:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Listing not found"})
+		return
+	}
+
+	// listing ที่เคยมี escrow ถูกอ้างถึงจาก escrow, ledger, ประวัติการชำระเงินและแชท จึงลบแบบ soft delete
+	traded, err := config.GetCollection("escrows").CountDocuments(ctx, bson.M{"listingId": objectID}, options.Count().SetLimit(1))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check listing trades"})
+		return
+	}
+	if traded > 0 {
+		err := transitionListingStatus(ctx, objectID, models.ListingRemoved)
+		if err == errIllegalListingTransition {
+			c.JSON(http.StatusConflict, gin.H{"error": "ไม่สามารถลบสินค้าที่กำลังอยู่ระหว่างการซื้อขายได้"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete listing"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Listing deleted successfully"})
+		return
+	}
+
+	// ลบเฉพาะเมื่อสถานะยังลบได้ กันกรณีถูกจองระหว่างนี้ แล้วค่อยลบรูปใน S3
+	result, err := collection.DeleteOne(ctx, bson.M{
+		"_id":    objectID,
+		"status": bson.M{"$in": models.ListingStatusesBefore(models.ListingRemoved)},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete listing"})
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "ไม่สามารถลบสินค้าที่กำลังอยู่ระหว่างการซื้อขายได้"})
+		return
+	}
 
 	for _, imgURL := range listing.Images {
 		imgKey := filepath.Base(imgURL)
@@ -486,12 +681,6 @@ func DeleteListing(c *gin.Context) {
 		}
 	}
 
-	result, err := collection.DeleteOne(ctx, bson.M{"_id": objectID})
-	if err != nil || result.DeletedCount == 0 {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete listing"})
-		return
-	}
-
 	c.JSON(http.StatusOK, gin.H{"message": "Listing deleted successfully"})
 }
 
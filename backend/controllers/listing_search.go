@@ -0,0 +1,212 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+
+	"go-auth-mongo/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultListingPageSize = 20
+	maxListingPageSize     = 100
+)
+
+type listingSort struct {
+	Field string
+	Order int
+}
+
+var listingSorts = map[string]listingSort{
+	"newest":     {Field: "createdAt", Order: -1},
+	"price_asc":  {Field: "price", Order: 1},
+	"price_desc": {Field: "price", Order: -1},
+	"favorites":  {Field: "favorites", Order: -1},
+}
+
+// หน้ารวมสินค้าแสดงเฉพาะสินค้าที่ยังขายอยู่ สถานะอื่นเห็นได้จากหน้าของเจ้าของหรือผู้ดูแลเท่านั้น
+var publicListingStatuses = map[models.ListingStatus]bool{
+	models.ListingActive: true,
+}
+
+type listingCursor struct {
+	Value interface{}        `bson:"v"`
+	ID    primitive.ObjectID `bson:"id"`
+}
+
+type listingQuery struct {
+	Filter bson.M
+	Sort   listingSort
+	Limit  int64
+	Cursor *listingCursor
+}
+
+func encodeListingCursor(sort listingSort, listing models.Listing) string {
+	var value interface{}
+	switch sort.Field {
+	case "price":
+		value = listing.Price
+	case "favorites":
+		value = listing.Favorites
+	default:
+		value = listing.CreatedAt
+	}
+
+	raw, err := bson.Marshal(listingCursor{Value: value, ID: listing.ID})
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeListingCursor(s string) (*listingCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var cursor listingCursor
+	if err := bson.Unmarshal(raw, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// อ่าน query string ของหน้ารวมสินค้า: game, min_price, max_price, form_type,
+// seller, status, q, sort, limit และ cursor
+func parseListingQuery(c *gin.Context) (listingQuery, error) {
+	query := listingQuery{Filter: bson.M{}, Limit: defaultListingPageSize}
+
+	status := models.ListingStatus(c.DefaultQuery("status", string(models.ListingActive)))
+	if !publicListingStatuses[status] {
+		return query, errors.New("invalid status")
+	}
+	query.Filter["status"] = status
+
+	if game := c.Query("game"); game != "" {
+		query.Filter["game"] = game
+	}
+	if formType := c.Query("form_type"); formType != "" {
+		query.Filter["formType"] = formType
+	}
+	if seller := c.Query("seller"); seller != "" {
+		query.Filter["userEmail"] = seller
+	}
+	if q := c.Query("q"); q != "" {
+		query.Filter["$text"] = bson.M{"$search": q}
+	}
+
+	price := bson.M{}
+	if min := c.Query("min_price"); min != "" {
+		v, err := strconv.Atoi(min)
+		if err != nil {
+			return query, errors.New("invalid min_price")
+		}
+		price["$gte"] = v
+	}
+	if max := c.Query("max_price"); max != "" {
+		v, err := strconv.Atoi(max)
+		if err != nil {
+			return query, errors.New("invalid max_price")
+		}
+		price["$lte"] = v
+	}
+	if len(price) > 0 {
+		query.Filter["price"] = price
+	}
+
+	sort, ok := listingSorts[c.DefaultQuery("sort", "newest")]
+	if !ok {
+		return query, errors.New("invalid sort")
+	}
+	query.Sort = sort
+
+	if limit := c.Query("limit"); limit != "" {
+		v, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || v <= 0 {
+			return query, errors.New("invalid limit")
+		}
+		if v > maxListingPageSize {
+			v = maxListingPageSize
+		}
+		query.Limit = v
+	}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		decoded, err := decodeListingCursor(cursor)
+		if err != nil {
+			return query, errors.New("invalid cursor")
+		}
+		query.Cursor = decoded
+	}
+
+	return query, nil
+}
+
+// เงื่อนไขสำหรับหน้าถัดไป เรียงตาม field ที่เลือกแล้วใช้ _id ตัดสินกรณีค่าเท่ากัน
+func (q listingQuery) pageFilter() bson.M {
+	if q.Cursor == nil {
+		return q.Filter
+	}
+
+	op := "$gt"
+	if q.Sort.Order < 0 {
+		op = "$lt"
+	}
+
+	filter := bson.M{}
+	for k, v := range q.Filter {
+		filter[k] = v
+	}
+	filter["$or"] = []bson.M{
+		{q.Sort.Field: bson.M{op: q.Cursor.Value}},
+		{q.Sort.Field: q.Cursor.Value, "_id": bson.M{op: q.Cursor.ID}},
+	}
+	return filter
+}
+
+func (q listingQuery) sortDoc() bson.D {
+	return bson.D{{Key: q.Sort.Field, Value: q.Sort.Order}, {Key: "_id", Value: q.Sort.Order}}
+}
+
+// ฟิลด์ของผู้ขายที่เปิดเผยได้ ตรงกับ SafeUser
+var safeUserProjection = bson.M{
+	"firstName": 1,
+	"lastName":  1,
+	"namestore": 1,
+	"email":     1,
+	"username":  1,
+	"phone":     1,
+	"address":   1,
+	"facebook":  1,
+	"instagram": 1,
+	"line":      1,
+	"discord":   1,
+	"bio":       1,
+	"games":     1,
+	"image":     1,
+}
+
+// join ผู้ขายจาก users ด้วย userEmail ใน query เดียว แล้วจัดรูปเป็น {listing, user}
+func listingSellerLookup() []bson.M {
+	return []bson.M{
+		{"$lookup": bson.M{
+			"from": "users",
+			"let":  bson.M{"email": "$userEmail"},
+			"pipeline": []bson.M{
+				{"$match": bson.M{"$expr": bson.M{"$eq": bson.A{"$email", "$$email"}}}},
+				{"$limit": 1},
+				{"$project": safeUserProjection},
+			},
+			"as": "seller",
+		}},
+		{"$project": bson.M{
+			"listing": "$$ROOT",
+			"user":    bson.M{"$arrayElemAt": bson.A{"$seller", 0}},
+		}},
+	}
+}
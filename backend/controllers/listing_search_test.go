@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const benchListingPage = defaultListingPageSize
+
+func seedListingsWithSellers(b *testing.B, sellers, listings int) {
+	b.Helper()
+	ctx := context.Background()
+
+	users := make([]interface{}, 0, sellers)
+	for i := 0; i < sellers; i++ {
+		users = append(users, bson.M{
+			"_id":       primitive.NewObjectID(),
+			"email":     fmt.Sprintf("seller%d@example.com", i),
+			"firstName": "Seller",
+			"lastName":  fmt.Sprint(i),
+		})
+	}
+	if _, err := config.GetCollection("users").InsertMany(ctx, users); err != nil {
+		b.Fatal(err)
+	}
+
+	now := time.Now()
+	docs := make([]interface{}, 0, listings)
+	for i := 0; i < listings; i++ {
+		docs = append(docs, models.Listing{
+			ID:        primitive.NewObjectID(),
+			UserEmail: fmt.Sprintf("seller%d@example.com", i%sellers),
+			Game:      "ROV",
+			Title:     fmt.Sprint("listing ", i),
+			Price:     100 + i,
+			Status:    models.ListingActive,
+			CreatedAt: now.Add(-time.Duration(i) * time.Minute),
+			UpdatedAt: now,
+		})
+	}
+	if _, err := config.GetCollection("listings").InsertMany(ctx, docs); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// วิธีเดิม: ดึงหน้ารายการก่อน แล้วหาผู้ขายทีละรายการ
+func listingPageNPlusOne(ctx context.Context) ([]ListingWithUser, error) {
+	cursor, err := config.GetCollection("listings").Find(ctx,
+		bson.M{"status": models.ListingActive},
+		options.Find().
+			SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}).
+			SetLimit(benchListingPage),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var listings []models.Listing
+	if err := cursor.All(ctx, &listings); err != nil {
+		return nil, err
+	}
+
+	users := config.GetCollection("users")
+	rows := make([]ListingWithUser, 0, len(listings))
+	for _, listing := range listings {
+		var user SafeUser
+		if err := users.FindOne(ctx, bson.M{"email": listing.UserEmail}).Decode(&user); err != nil {
+			continue
+		}
+		rows = append(rows, ListingWithUser{Listing: listing, User: user})
+	}
+	return rows, nil
+}
+
+// วิธีปัจจุบัน: join ผู้ขายด้วย $lookup ใน aggregation เดียว
+func listingPageLookup(ctx context.Context) ([]ListingWithUser, error) {
+	pipeline := []bson.M{
+		{"$match": bson.M{"status": models.ListingActive}},
+		{"$sort": bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}},
+		{"$limit": benchListingPage},
+	}
+	cursor, err := config.GetCollection("listings").Aggregate(ctx, append(pipeline, listingSellerLookup()...))
+	if err != nil {
+		return nil, err
+	}
+	var rows []ListingWithUser
+	err = cursor.All(ctx, &rows)
+	return rows, err
+}
+
+// go test -run '^$' -bench ListingSellerLookup ./controllers (ต้องตั้ง MONGO_TEST_URI)
+func BenchmarkListingSellerLookup(b *testing.B) {
+	useTestDB(b)
+	seedListingsWithSellers(b, 50, 1000)
+
+	benchmarks := []struct {
+		name  string
+		fetch func(context.Context) ([]ListingWithUser, error)
+	}{
+		{"n_plus_one", listingPageNPlusOne},
+		{"lookup", listingPageLookup},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			ctx := context.Background()
+			for i := 0; i < b.N; i++ {
+				rows, err := bm.fetch(ctx)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(rows) != benchListingPage {
+					b.Fatalf("got %d rows, want %d", len(rows), benchListingPage)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,385 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
+	"go-auth-mongo/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// เงื่อนไข status ที่เปลี่ยนไปเป็น next ได้ รายงานเก่าที่ไม่มี status ถือเป็น open
+func reportStatusFilter(next models.ReportStatus) bson.M {
+	from := []interface{}{}
+	for _, s := range []models.ReportStatus{models.ReportOpen, models.ReportTriaged} {
+		if s.CanTransitionTo(next) {
+			from = append(from, s)
+			if s == models.ReportOpen {
+				from = append(from, nil)
+			}
+		}
+	}
+	return bson.M{"$in": from}
+}
+
+func loadModerationReport(c *gin.Context) (models.ReportIssuePost, bool) {
+	reportID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid report ID"})
+		return models.ReportIssuePost{}, false
+	}
+
+	var report models.ReportIssuePost
+	err = config.GetCollection("report_issues_post").FindOne(c.Request.Context(), bson.M{"_id": reportID}).Decode(&report)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Report not found"})
+		return models.ReportIssuePost{}, false
+	}
+	report.Status = report.Status.OrOpen()
+	return report, true
+}
+
+// แจ้งผู้รายงานทางอีเมลโดยไม่รอผล
+func notifyReporter(report models.ReportIssuePost, outcome string) {
+	go func() {
+		if err := utils.SendReportOutcomeEmail(report.Email, report.Subject, outcome); err != nil {
+			log.Printf("Failed to send report outcome email to %s: %v", report.Email, err)
+		}
+	}()
+}
+
+// คิวรายงานเรียงจากเก่าไปใหม่ กรองด้วย status และ assignee (ใช้ "me" แทนตัวเองได้)
+func ListModerationReports(c *gin.Context) {
+	filter := bson.M{}
+	status := models.ReportStatus(c.DefaultQuery("status", string(models.ReportOpen)))
+	switch status {
+	case models.ReportOpen:
+		filter["status"] = bson.M{"$in": []interface{}{models.ReportOpen, nil}}
+	case models.ReportTriaged, models.ReportActioned, models.ReportDismissed:
+		filter["status"] = status
+	case "all":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status"})
+		return
+	}
+	if assignee := c.Query("assignee"); assignee != "" {
+		if assignee == "me" {
+			assignee = c.GetString("email")
+		}
+		filter["assignedTo"] = assignee
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	collection := config.GetCollection("report_issues_post")
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count reports"})
+		return
+	}
+
+	limit, skip := adminPage(c)
+	cursor, err := collection.Find(ctx, filter, options.Find().
+		SetSort(bson.M{"createdAt": 1}).
+		SetSkip(skip).
+		SetLimit(limit),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch reports"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	reports := []models.ReportIssuePost{}
+	if err := cursor.All(ctx, &reports); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read reports"})
+		return
+	}
+	for i := range reports {
+		reports[i].Status = reports[i].Status.OrOpen()
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": reports, "total": total})
+}
+
+func GetModerationReport(c *gin.Context) {
+	report, ok := loadModerationReport(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// มอบหมายรายงานให้ผู้ดูแล (ค่าเริ่มต้นคือตัวเอง) รายงานที่ยัง open จะเป็น triaged
+func AssignModerationReport(c *gin.Context) {
+	report, ok := loadModerationReport(c)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Assignee string `json:"assignee"`
+	}
+	_ = c.ShouldBindJSON(&input)
+	assignee := strings.TrimSpace(input.Assignee)
+	if assignee == "" {
+		assignee = c.GetString("email")
+	}
+
+	ctx := c.Request.Context()
+	if assignee != c.GetString("email") {
+		var user models.User
+		err := config.GetCollection("users").FindOne(ctx, bson.M{"email": assignee}).Decode(&user)
+		if err != nil || (user.EffectiveRole() != models.RoleModerator && user.EffectiveRole() != models.RoleAdmin) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ผู้รับมอบหมายต้องเป็น moderator หรือ admin"})
+			return
+		}
+	}
+
+	now := time.Now()
+	set := bson.M{"assignedTo": assignee, "updatedAt": now}
+	if report.Status == models.ReportOpen {
+		set["status"] = models.ReportTriaged
+	}
+	result, err := config.GetCollection("report_issues_post").UpdateOne(ctx,
+		bson.M{"_id": report.ID, "status": reportStatusFilter(models.ReportActioned)},
+		bson.M{"$set": set},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assign report"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "รายงานนี้ปิดไปแล้ว"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Report assigned", "assignedTo": assignee})
+}
+
+func AddModerationNote(c *gin.Context) {
+	report, ok := loadModerationReport(c)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Note string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || strings.TrimSpace(input.Note) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ต้องระบุข้อความบันทึก"})
+		return
+	}
+
+	now := time.Now()
+	note := models.ModerationNote{By: c.GetString("email"), Text: strings.TrimSpace(input.Note), At: now}
+	_, err := config.GetCollection("report_issues_post").UpdateOne(c.Request.Context(),
+		bson.M{"_id": report.ID},
+		bson.M{"$push": bson.M{"notes": note}, "$set": bson.M{"updatedAt": now}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add note"})
+		return
+	}
+
+	c.JSON(http.StatusOK, note)
+}
+
+// ซ่อนประกาศที่ถูกรายงาน ถ้าซ่อนหรือลบไปแล้วถือว่าสำเร็จ
+func hideReportedListing(ctx context.Context, report models.ReportIssuePost) (int, string) {
+	if report.ListingID == nil {
+		return http.StatusBadRequest, "รายงานนี้ไม่ได้ระบุประกาศ"
+	}
+	listingID, err := primitive.ObjectIDFromHex(*report.ListingID)
+	if err != nil {
+		return http.StatusBadRequest, "Invalid listing ID in report"
+	}
+
+	err = transitionListingStatus(ctx, listingID, models.ListingHidden)
+	if err == nil {
+		return http.StatusOK, ""
+	}
+	if err != errIllegalListingTransition {
+		return http.StatusInternalServerError, "Failed to hide listing"
+	}
+
+	var listing models.Listing
+	if err := config.GetCollection("listings").FindOne(ctx, bson.M{"_id": listingID}).Decode(&listing); err != nil {
+		return http.StatusNotFound, "Listing not found"
+	}
+	if listing.Status == models.ListingHidden || listing.Status == models.ListingRemoved {
+		return http.StatusOK, ""
+	}
+	return http.StatusConflict, "ไม่สามารถซ่อนประกาศที่อยู่ในสถานะ " + string(listing.Status) + " ได้"
+}
+
+// ดำเนินการกับรายงาน: ซ่อนประกาศ หรือระงับผู้ใช้ที่ถูกรายงาน แล้วแจ้งผู้รายงาน
+func ActionModerationReport(c *gin.Context) {
+	report, ok := loadModerationReport(c)
+	if !ok {
+		return
+	}
+	if !report.Status.CanTransitionTo(models.ReportActioned) {
+		c.JSON(http.StatusConflict, gin.H{"error": "รายงานนี้ปิดไปแล้ว"})
+		return
+	}
+
+	var input struct {
+		Action        string `json:"action"`
+		Reason        string `json:"reason"`
+		DurationHours int    `json:"durationHours"` // 0 = ระงับถาวร
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if strings.TrimSpace(input.Reason) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ต้องระบุเหตุผล"})
+		return
+	}
+	if input.DurationHours < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid duration"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	moderator := c.GetString("email")
+
+	// ตรวจเงื่อนไขทั้งหมดก่อนปิดรายงาน
+	var target models.User
+	switch input.Action {
+	case models.ModerationHideListing:
+		if report.ListingID == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "รายงานนี้ไม่ได้ระบุประกาศ"})
+			return
+		}
+	case models.ModerationSuspendUser:
+		if report.ReportedEmail == nil || *report.ReportedEmail == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "รายงานนี้ไม่ได้ระบุผู้ใช้"})
+			return
+		}
+		err := config.GetCollection("users").FindOne(ctx, bson.M{"email": *report.ReportedEmail}).Decode(&target)
+		if err == mongo.ErrNoDocuments {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+			return
+		}
+		if status, msg := checkSuspendTarget(c, target); status != http.StatusOK {
+			c.JSON(status, gin.H{"error": msg})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid action"})
+		return
+	}
+
+	// ปิดรายงานแบบ atomic ก่อน ผู้ดูแลที่กดพร้อมกันจะได้ดำเนินการแค่คนเดียว
+	if !resolveModerationReport(c, report, models.ReportActioned, input.Action, input.Reason) {
+		return
+	}
+
+	var outcome string
+	switch input.Action {
+	case models.ModerationHideListing:
+		if status, msg := hideReportedListing(ctx, report); status != http.StatusOK {
+			reopenModerationReport(ctx, report)
+			c.JSON(status, gin.H{"error": msg})
+			return
+		}
+		outcome = "ประกาศที่คุณรายงานถูกซ่อนจากระบบแล้ว"
+	case models.ModerationSuspendUser:
+		duration := time.Duration(input.DurationHours) * time.Hour
+		_, err := suspendUser(ctx, target.Email, input.Reason, duration, moderator, &report.ID)
+		if err != nil {
+			reopenModerationReport(ctx, report)
+			if err == mongo.ErrNoDocuments {
+				c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to suspend user"})
+			return
+		}
+		outcome = "ผู้ใช้ที่คุณรายงานถูกระงับการใช้งานแล้ว"
+	}
+	notifyReporter(report, outcome)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Report actioned", "action": input.Action})
+}
+
+func DismissModerationReport(c *gin.Context) {
+	report, ok := loadModerationReport(c)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || strings.TrimSpace(input.Reason) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ต้องระบุเหตุผล"})
+		return
+	}
+
+	if !resolveModerationReport(c, report, models.ReportDismissed, "", input.Reason) {
+		return
+	}
+	notifyReporter(report, "เราตรวจสอบรายงานของคุณแล้ว และไม่พบการละเมิดกฎของระบบ")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Report dismissed"})
+}
+
+func resolveModerationReport(c *gin.Context, report models.ReportIssuePost, to models.ReportStatus, action, reason string) bool {
+	now := time.Now()
+	set := bson.M{
+		"status":     to,
+		"resolution": reason,
+		"resolvedBy": c.GetString("email"),
+		"resolvedAt": now,
+		"updatedAt":  now,
+	}
+	if action != "" {
+		set["action"] = action
+	}
+
+	result, err := config.GetCollection("report_issues_post").UpdateOne(c.Request.Context(),
+		bson.M{"_id": report.ID, "status": reportStatusFilter(to)},
+		bson.M{"$set": set},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update report"})
+		return false
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "รายงานนี้ปิดไปแล้ว"})
+		return false
+	}
+	return true
+}
+
+// ดำเนินการไม่สำเร็จหลังปิดรายงานไปแล้ว คืนรายงานกลับสถานะเดิมให้ทำใหม่ได้
+func reopenModerationReport(ctx context.Context, report models.ReportIssuePost) {
+	_, err := config.GetCollection("report_issues_post").UpdateOne(ctx,
+		bson.M{"_id": report.ID, "status": models.ReportActioned},
+		bson.M{
+			"$set":   bson.M{"status": report.Status, "updatedAt": time.Now()},
+			"$unset": bson.M{"action": "", "resolution": "", "resolvedBy": "", "resolvedAt": ""},
+		},
+	)
+	if err != nil {
+		log.Println("Failed to reopen report", report.ID.Hex(), ":", err)
+	}
+}
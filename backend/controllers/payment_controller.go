@@ -1,19 +1,32 @@
 package controllers
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"github.com/omise/omise-go"
 	"github.com/omise/omise-go/operations"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// ราคาถูกดึงจาก listing ฝั่ง server เสมอ client ระบุได้แค่ว่าจะจ่ายให้กลุ่มหรือ listing ไหน
 type QRRequest struct {
-	Amount int64 `json:"amount"`
+	GroupID   string `json:"group_id"`
+	ListingID string `json:"listing_id"`
 }
 
 type QRResponse struct {
@@ -21,10 +34,38 @@ type QRResponse struct {
 	QRImage  string `json:"qr_image"`
 }
 
-type PaymentController struct{}
+type PaymentController struct {
+	refunds RefundGateway
+}
 
-func NewPaymentController() *PaymentController {
-	return &PaymentController{}
+// refunds ใช้คืนเงินที่จ่ายเข้ามาหลัง escrow ถูกยกเลิกหรือถูกจ่ายด้วย QR อื่นไปแล้ว
+func NewPaymentController(refunds RefundGateway) *PaymentController {
+	return &PaymentController{refunds: refunds}
+}
+
+func newOmiseClient() (*omise.Client, error) {
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found - using environment variables from system")
+	}
+
+	// อ่าน key จาก environment
+	publicKey := os.Getenv("OMISE_PUBLICKEY")
+	secretKey := os.Getenv("OMISE_SECRETKEY")
+	if publicKey == "" || secretKey == "" {
+		return nil, errors.New("OMISE_PUBLICKEY or OMISE_SECRETKEY is not set")
+	}
+
+	client, err := omise.NewClient(publicKey, secretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// ชี้ไปที่ fake Omise server ในเครื่องได้ตอนทดสอบ
+	if apiURL := os.Getenv("OMISE_API_URL"); apiURL != "" {
+		client.Endpoints["https://api.omise.co"] = apiURL
+	}
+
+	return client, nil
 }
 
 func (ctl *PaymentController) CreateQR(c *gin.Context) {
@@ -34,22 +75,76 @@ func (ctl *PaymentController) CreateQR(c *gin.Context) {
 		return
 	}
 
-	if err := godotenv.Load(); err != nil {
-		log.Println("No .env file found - using environment variables from system")
+	email := c.GetString("email")
+	ctx := c.Request.Context()
+	groupsCollection := config.GetCollection("groups")
+
+	var group models.Group
+	switch {
+	case body.GroupID != "":
+		groupID, err := primitive.ObjectIDFromHex(body.GroupID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid group_id"})
+			return
+		}
+		if err := groupsCollection.FindOne(ctx, bson.M{"_id": groupID}).Decode(&group); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "group not found"})
+			return
+		}
+	case body.ListingID != "":
+		if _, err := primitive.ObjectIDFromHex(body.ListingID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid listing_id"})
+			return
+		}
+		err := groupsCollection.FindOne(ctx,
+			bson.M{"product_id": body.ListingID, "buyer": email},
+			options.FindOne().SetSort(bson.D{{Key: "created_at", Value: -1}}),
+		).Decode(&group)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no trade found for this listing"})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "group_id or listing_id is required"})
+		return
 	}
 
-	// อ่าน key จาก environment
-	publicKey := os.Getenv("OMISE_PUBLICKEY")
-	secretKey := os.Getenv("OMISE_SECRETKEY")
-	log.Printf("OMISE_PUBLICKEY: %s", publicKey)
-	log.Printf("OMISE_SECRETKEY: %s", secretKey)
+	if group.Buyer != email {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the buyer can pay for this trade"})
+		return
+	}
+	if body.ListingID != "" && group.ProductID != body.ListingID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "listing does not belong to this group"})
+		return
+	}
 
-	if publicKey == "" || secretKey == "" {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "OMISE_PUBLICKEY or OMISE_SECRETKEY is not set"})
+	escrow, err := findEscrowByGroup(ctx, group.ID)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "both sides must confirm the trade before payment"})
+		return
+	}
+	if escrow.Status != models.EscrowPendingPayment {
+		c.JSON(http.StatusConflict, gin.H{"error": "trade is not awaiting payment"})
 		return
 	}
 
-	client, err := omise.NewClient(publicKey, secretKey)
+	var listing models.Listing
+	if err := config.GetCollection("listings").FindOne(ctx, bson.M{"_id": escrow.ListingID}).Decode(&listing); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "listing not found"})
+		return
+	}
+	if listing.Status != models.ListingReserved {
+		c.JSON(http.StatusConflict, gin.H{"error": "listing is no longer available"})
+		return
+	}
+	// ราคาเปลี่ยนหลังจากยืนยันการซื้อขายแล้ว ต้องยืนยันใหม่ก่อนจ่าย
+	amount := int64(listing.Price) * 100
+	if amount <= 0 || amount != escrow.Amount {
+		c.JSON(http.StatusConflict, gin.H{"error": "listing price has changed, please confirm the trade again"})
+		return
+	}
+
+	client, err := newOmiseClient()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "cannot init client: " + err.Error()})
 		return
@@ -58,7 +153,7 @@ func (ctl *PaymentController) CreateQR(c *gin.Context) {
 	source := &omise.Source{}
 	err = client.Do(source, &operations.CreateSource{
 		Type:     "promptpay",
-		Amount:   body.Amount * 100,
+		Amount:   amount,
 		Currency: "THB",
 	})
 	if err != nil {
@@ -68,6 +163,53 @@ func (ctl *PaymentController) CreateQR(c *gin.Context) {
 
 	log.Printf("Source data: %+v\n", source)
 
+	// ต้องสร้าง charge จาก source ก่อน Omise ถึงจะส่ง webhook charge.complete กลับมา
+	charge := &omise.Charge{}
+	err = client.Do(charge, &operations.CreateCharge{
+		Amount:   source.Amount,
+		Currency: source.Currency,
+		Source:   source.ID,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if charge.Source != nil && charge.Source.ScannableCode != nil {
+		source.ScannableCode = charge.Source.ScannableCode
+	}
+
+	now := time.Now()
+	payment := models.Payment{
+		ID:        primitive.NewObjectID(),
+		SourceID:  source.ID,
+		ChargeID:  charge.ID,
+		EscrowID:  escrow.ID,
+		GroupID:   escrow.GroupID,
+		ListingID: escrow.ListingID,
+		Buyer:     email,
+		Seller:    escrow.Seller,
+		Amount:    source.Amount,
+		Currency:  source.Currency,
+		Status:    models.PaymentPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	_, err = config.GetCollection("payments").InsertOne(ctx, payment)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save payment"})
+		return
+	}
+
+	_, err = config.GetCollection("escrows").UpdateOne(ctx,
+		bson.M{"_id": escrow.ID, "status": models.EscrowPendingPayment},
+		bson.M{"$set": bson.M{"sourceId": source.ID, "chargeId": charge.ID, "updatedAt": now}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to link payment to trade"})
+		return
+	}
+
 	qrImage := ""
 	if source.ScannableCode != nil && source.ScannableCode.Image != nil {
 		qrImage = source.ScannableCode.Image.DownloadURI
@@ -84,3 +226,156 @@ func (ctl *PaymentController) CreateQR(c *gin.Context) {
 	jsonData, _ := json.MarshalIndent(source, "", "  ")
 	log.Println("Source full JSON:", string(jsonData))
 }
+
+func parseHistoryDate(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.Add(24 * time.Hour)
+	}
+	return t, nil
+}
+
+const (
+	defaultPaymentHistoryPageSize = 30
+	maxPaymentHistoryPageSize     = 100
+)
+
+type paymentHistoryCursor struct {
+	At time.Time          `bson:"at"`
+	ID primitive.ObjectID `bson:"id"`
+}
+
+func encodePaymentHistoryCursor(payment models.Payment) string {
+	raw, err := bson.Marshal(paymentHistoryCursor{At: payment.CreatedAt, ID: payment.ID})
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodePaymentHistoryCursor(s string) (*paymentHistoryCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var cursor paymentHistoryCursor
+	if err := bson.Unmarshal(raw, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// ประวัติการชำระเงินของผู้ใช้ทั้งฝั่งผู้ซื้อและผู้ขาย
+// รองรับ ?role=buyer|seller, ?status=pending|successful|failed|refunded, ?from=, ?to=, ?limit= และ ?cursor=
+func (ctl *PaymentController) History(c *gin.Context) {
+	email := c.GetString("email")
+	if email == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	filter := bson.M{}
+	switch c.Query("role") {
+	case "buyer":
+		filter["buyer"] = email
+	case "seller":
+		filter["seller"] = email
+	case "":
+		filter["$or"] = []bson.M{{"buyer": email}, {"seller": email}}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be buyer or seller"})
+		return
+	}
+
+	if status := c.Query("status"); status != "" {
+		switch models.PaymentStatus(status) {
+		case models.PaymentPending, models.PaymentSuccessful, models.PaymentFailed, models.PaymentRefunded:
+			filter["status"] = status
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid status"})
+			return
+		}
+	}
+
+	createdAt := bson.M{}
+	if from := c.Query("from"); from != "" {
+		t, err := parseHistoryDate(from, false)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from date"})
+			return
+		}
+		createdAt["$gte"] = t
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := parseHistoryDate(to, true)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to date"})
+			return
+		}
+		createdAt["$lt"] = t
+	}
+	if len(createdAt) > 0 {
+		filter["createdAt"] = createdAt
+	}
+
+	limit := int64(defaultPaymentHistoryPageSize)
+	if raw := c.Query("limit"); raw != "" {
+		v, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || v <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+		if v > maxPaymentHistoryPageSize {
+			v = maxPaymentHistoryPageSize
+		}
+		limit = v
+	}
+	if raw := c.Query("cursor"); raw != "" {
+		after, err := decodePaymentHistoryCursor(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return
+		}
+		// filter อาจมี $or ของ role อยู่แล้ว จึงรวมเงื่อนไข cursor ด้วย $and
+		filter["$and"] = []bson.M{{"$or": []bson.M{
+			{"createdAt": bson.M{"$lt": after.At}},
+			{"createdAt": after.At, "_id": bson.M{"$lt": after.ID}},
+		}}}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// ดึงเกิน limit มาหนึ่งรายการเพื่อบอกว่ามีหน้าถัดไปหรือไม่
+	cursor, err := config.GetCollection("payments").Find(ctx, filter,
+		options.Find().
+			SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}).
+			SetLimit(limit+1),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch payments"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	payments := []models.Payment{}
+	if err := cursor.All(ctx, &payments); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read payments"})
+		return
+	}
+
+	hasMore := int64(len(payments)) > limit
+	nextCursor := ""
+	if hasMore {
+		payments = payments[:limit]
+		nextCursor = encodePaymentHistoryCursor(payments[len(payments)-1])
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": payments, "has_more": hasMore, "next_cursor": nextCursor})
+}
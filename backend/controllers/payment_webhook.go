@@ -0,0 +1,281 @@
+package controllers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/omise/omise-go"
+	"github.com/omise/omise-go/operations"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const omiseSignatureTolerance = 5 * time.Minute
+
+type omiseWebhookEvent struct {
+	ID   string `json:"id"`
+	Key  string `json:"key"`
+	Data struct {
+		Object string `json:"object"`
+		ID     string `json:"id"`
+	} `json:"data"`
+}
+
+// ตรวจลายเซ็นของ webhook ตามที่ Omise กำหนด (HMAC-SHA256 ของ "timestamp.body")
+// ถ้าไม่ได้ตั้ง OMISE_WEBHOOK_SECRET จะปฏิเสธทุก request
+// ข้ามการตรวจได้เฉพาะเมื่อตั้ง OMISE_WEBHOOK_SKIP_VERIFY=true เองตอนพัฒนา และใช้ไม่ได้บน production
+func verifyOmiseSignature(r *http.Request, body []byte) bool {
+	if os.Getenv("OMISE_WEBHOOK_SKIP_VERIFY") == "true" {
+		if os.Getenv("ENV") == "production" {
+			log.Println("OMISE_WEBHOOK_SKIP_VERIFY is ignored in production")
+		} else {
+			log.Println("OMISE_WEBHOOK_SKIP_VERIFY is set, accepting unsigned webhook")
+			return true
+		}
+	}
+
+	secret := os.Getenv("OMISE_WEBHOOK_SECRET")
+	if secret == "" {
+		log.Println("OMISE_WEBHOOK_SECRET is not set, rejecting webhook")
+		return false
+	}
+
+	key, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		log.Println("OMISE_WEBHOOK_SECRET is not valid base64:", err)
+		return false
+	}
+
+	timestamp := r.Header.Get("Omise-Signature-Timestamp")
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(unix, 0))
+	if age > omiseSignatureTolerance || age < -omiseSignatureTolerance {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	for _, sig := range strings.Split(r.Header.Get("Omise-Signature"), ",") {
+		decoded, err := hex.DecodeString(strings.TrimSpace(sig))
+		if err == nil && hmac.Equal(decoded, expected) {
+			return true
+		}
+	}
+	return false
+}
+
+func paymentStatusFromCharge(charge *omise.Charge) models.PaymentStatus {
+	switch {
+	case charge.Status == omise.ChargeSuccessful && charge.Paid:
+		return models.PaymentSuccessful
+	case charge.Status == omise.ChargeFailed:
+		return models.PaymentFailed
+	}
+	return models.PaymentPending
+}
+
+// บันทึกผลการชำระเงินโดยใช้ source ID เป็น key จึงเรียกซ้ำได้โดยไม่สร้างข้อมูลซ้ำ
+func recordChargeResult(ctx context.Context, charge *omise.Charge) (models.Payment, error) {
+	now := time.Now()
+	status := paymentStatusFromCharge(charge)
+
+	sourceID := ""
+	if charge.Source != nil {
+		sourceID = charge.Source.ID
+	}
+
+	set := bson.M{
+		"chargeId":  charge.ID,
+		"amount":    charge.Amount,
+		"currency":  strings.ToUpper(charge.Currency),
+		"status":    status,
+		"updatedAt": now,
+	}
+	if status == models.PaymentSuccessful {
+		set["paidAt"] = now
+	}
+
+	filter := bson.M{"sourceId": sourceID}
+	if sourceID == "" {
+		filter = bson.M{"chargeId": charge.ID}
+	}
+
+	collection := config.GetCollection("payments")
+
+	// webhook ที่ส่งซ้ำจะไม่ย้อนสถานะของรายการที่ชำระสำเร็จหรือคืนเงินไปแล้ว
+	var payment models.Payment
+	err := collection.FindOne(ctx, filter).Decode(&payment)
+	if err == nil && (payment.Status == models.PaymentSuccessful || payment.Status == models.PaymentRefunded) {
+		return payment, nil
+	}
+	if err != nil && err != mongo.ErrNoDocuments {
+		return payment, err
+	}
+
+	err = collection.FindOneAndUpdate(ctx, filter,
+		bson.M{
+			"$set":         set,
+			"$setOnInsert": bson.M{"sourceId": sourceID, "createdAt": now},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&payment)
+	return payment, err
+}
+
+// ผูกการชำระเงินเข้ากับ escrow, listing และกลุ่มแชทที่เกี่ยวข้อง
+// escrow ถูกหาจาก escrowId ที่บันทึกไว้ตอนสร้าง QR เพราะ sourceId ของ escrow จะเปลี่ยนทุกครั้งที่สร้าง QR ใหม่
+func applySuccessfulPayment(ctx context.Context, gateway RefundGateway, payment models.Payment) error {
+	filter := bson.M{"_id": payment.EscrowID}
+	if payment.EscrowID.IsZero() {
+		filter = bson.M{"sourceId": payment.SourceID}
+	}
+
+	var escrow models.Escrow
+	err := config.GetCollection("escrows").FindOne(ctx, filter).Decode(&escrow)
+	if err == mongo.ErrNoDocuments {
+		log.Println("No escrow linked to payment", payment.ChargeID)
+		return flagPaymentForReview(ctx, payment, "no escrow linked to this payment")
+	}
+	if err != nil {
+		return err
+	}
+
+	err = transitionEscrow(ctx, &escrow, models.EscrowPaid, escrowSystemActor, "omise charge "+payment.ChargeID,
+		bson.M{"chargeId": payment.ChargeID})
+	if err == nil {
+		escrow.ChargeID = payment.ChargeID
+	}
+	if err != nil && err != errIllegalEscrowTransition {
+		return err
+	}
+
+	_, err = config.GetCollection("payments").UpdateOne(ctx,
+		bson.M{"_id": payment.ID},
+		bson.M{"$set": bson.M{"escrowId": escrow.ID, "groupId": escrow.GroupID, "listingId": escrow.ListingID}},
+	)
+	if err != nil {
+		return err
+	}
+
+	// escrow ถูกยกเลิกไปแล้ว หรือถูกจ่ายด้วย QR อื่น เงินก้อนนี้ไม่มีการซื้อขายรองรับ ต้องคืนให้ผู้ซื้อ
+	if escrow.Status == models.EscrowCancelled || escrow.Status == models.EscrowRefunded || escrow.ChargeID != payment.ChargeID {
+		log.Println("Payment", payment.ChargeID, "arrived for escrow", escrow.ID.Hex(), "in status", escrow.Status, ", refunding")
+		return refundOrphanedPayment(ctx, gateway, payment)
+	}
+	if escrow.Status != models.EscrowPaid {
+		return nil
+	}
+
+	if err := postPaymentReceived(ctx, escrow); err != nil {
+		return err
+	}
+
+	_, err = config.GetCollection("groups").UpdateOne(ctx,
+		bson.M{"_id": escrow.GroupID},
+		bson.M{"$set": bson.M{"payment_status": string(models.PaymentSuccessful)}},
+	)
+	return err
+}
+
+// คืนเงินที่ถูกจ่ายเข้ามาหลัง escrow ปิดไปแล้ว ถ้าคืนไม่สำเร็จจะพักไว้ให้ผู้ดูแลตรวจสอบ
+func refundOrphanedPayment(ctx context.Context, gateway RefundGateway, payment models.Payment) error {
+	omiseRefundID, err := gateway.RefundCharge(payment.ChargeID, payment.Amount)
+	if err != nil {
+		log.Println("Failed to refund orphaned payment", payment.ChargeID, ":", err)
+		return flagPaymentForReview(ctx, payment, "automatic refund failed: "+err.Error())
+	}
+
+	_, err = config.GetCollection("payments").UpdateOne(ctx,
+		bson.M{"_id": payment.ID},
+		bson.M{"$set": bson.M{"status": models.PaymentRefunded, "omiseRefundId": omiseRefundID, "updatedAt": time.Now()}},
+	)
+	return err
+}
+
+func flagPaymentForReview(ctx context.Context, payment models.Payment, reason string) error {
+	_, err := config.GetCollection("payments").UpdateOne(ctx,
+		bson.M{"_id": payment.ID},
+		bson.M{"$set": bson.M{"needsReview": true, "reviewReason": reason, "updatedAt": time.Now()}},
+	)
+	return err
+}
+
+func (ctl *PaymentController) Webhook(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot read body"})
+		return
+	}
+
+	if !verifyOmiseSignature(c.Request, body) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid signature"})
+		return
+	}
+
+	var event omiseWebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid payload"})
+		return
+	}
+
+	if event.Key != "charge.complete" || event.Data.Object != "charge" {
+		c.JSON(http.StatusOK, gin.H{"message": "ignored"})
+		return
+	}
+
+	client, err := newOmiseClient()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "cannot init client: " + err.Error()})
+		return
+	}
+
+	// ไม่เชื่อข้อมูลใน body โดยตรง ดึง charge จาก Omise อีกครั้งเพื่อยืนยันสถานะจริง
+	charge := &omise.Charge{}
+	if err := client.Do(charge, &operations.RetrieveCharge{ChargeID: event.Data.ID}); err != nil {
+		log.Println("Failed to retrieve charge", event.Data.ID, ":", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "cannot verify charge"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	payment, err := recordChargeResult(ctx, charge)
+	if err != nil {
+		log.Println("Failed to record payment for charge", charge.ID, ":", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record payment"})
+		return
+	}
+
+	if payment.Status == models.PaymentSuccessful {
+		if err := applySuccessfulPayment(ctx, ctl.refunds, payment); err != nil {
+			log.Println("Failed to apply payment", payment.ChargeID, ":", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to apply payment"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "ok", "status": payment.Status})
+}
@@ -0,0 +1,320 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const testWebhookSecret = "dGVzdC13ZWJob29rLXNlY3JldA=="
+
+type fakeRefundGateway struct {
+	mu    sync.Mutex
+	calls []string
+	err   error
+	// เรียกก่อนตอบกลับ ใช้จำลองเหตุการณ์ที่เกิดขึ้นระหว่างรอ Omise
+	onRefund func()
+}
+
+func (g *fakeRefundGateway) RefundCharge(chargeID string, amount int64) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.calls = append(g.calls, chargeID)
+	if g.onRefund != nil {
+		g.onRefund()
+	}
+	if g.err != nil {
+		return "", g.err
+	}
+	return "rfnd_test_" + strconv.Itoa(len(g.calls)), nil
+}
+
+func (g *fakeRefundGateway) FindChargeRefund(chargeID string) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i := len(g.calls) - 1; i >= 0; i-- {
+		if g.calls[i] == chargeID && g.err == nil {
+			return "rfnd_test_" + strconv.Itoa(i+1), nil
+		}
+	}
+	return "", nil
+}
+
+func (g *fakeRefundGateway) Calls() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.calls...)
+}
+
+// fake Omise API ที่ตอบ GET /charges/:id จาก charge ที่กำหนดไว้
+func newFakeOmise(t *testing.T, charges map[string]map[string]interface{}) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/charges/")
+		charge, ok := charges[id]
+		if r.Method != http.MethodGet || !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"object": "error", "code": "not_found"})
+			return
+		}
+		json.NewEncoder(w).Encode(charge)
+	}))
+	t.Cleanup(srv.Close)
+
+	t.Setenv("OMISE_API_URL", srv.URL)
+	t.Setenv("OMISE_PUBLICKEY", "pkey_test_fake")
+	t.Setenv("OMISE_SECRETKEY", "skey_test_fake")
+}
+
+func successfulCharge(chargeID, sourceID string, amount int64) map[string]interface{} {
+	return map[string]interface{}{
+		"object":   "charge",
+		"id":       chargeID,
+		"status":   "successful",
+		"paid":     true,
+		"amount":   amount,
+		"currency": "thb",
+		"source":   map[string]interface{}{"object": "source", "id": sourceID},
+	}
+}
+
+func signWebhook(req *http.Request, body []byte, at time.Time) {
+	key, _ := base64.StdEncoding.DecodeString(testWebhookSecret)
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	req.Header.Set("Omise-Signature-Timestamp", timestamp)
+	req.Header.Set("Omise-Signature", hex.EncodeToString(mac.Sum(nil)))
+}
+
+func postWebhook(t *testing.T, ctl *PaymentController, chargeID string) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":   "evnt_test_" + chargeID,
+		"key":  "charge.complete",
+		"data": map[string]string{"object": "charge", "id": chargeID},
+	})
+
+	r := gin.New()
+	r.POST("/payment/webhook", ctl.Webhook)
+
+	req := httptest.NewRequest(http.MethodPost, "/payment/webhook", bytes.NewReader(body))
+	signWebhook(req, body, time.Now())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestVerifyOmiseSignature(t *testing.T) {
+	body := []byte(`{"key":"charge.complete"}`)
+
+	tests := []struct {
+		name   string
+		secret string
+		env    string
+		skip   string
+		sign   func(*http.Request)
+		want   bool
+	}{
+		{"valid", testWebhookSecret, "", "", func(r *http.Request) { signWebhook(r, body, time.Now()) }, true},
+		{"tampered signature", testWebhookSecret, "", "", func(r *http.Request) {
+			signWebhook(r, []byte(`{"key":"other"}`), time.Now())
+		}, false},
+		{"stale timestamp", testWebhookSecret, "", "", func(r *http.Request) {
+			signWebhook(r, body, time.Now().Add(-time.Hour))
+		}, false},
+		{"missing headers", testWebhookSecret, "", "", func(*http.Request) {}, false},
+		{"no secret in development", "", "development", "", func(*http.Request) {}, false},
+		{"no secret without ENV", "", "", "", func(*http.Request) {}, false},
+		{"no secret in production", "", "production", "", func(*http.Request) {}, false},
+		{"skip verify opted in", "", "development", "true", func(*http.Request) {}, true},
+		{"skip verify ignored in production", "", "production", "true", func(*http.Request) {}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OMISE_WEBHOOK_SECRET", tt.secret)
+			t.Setenv("ENV", tt.env)
+			t.Setenv("OMISE_WEBHOOK_SKIP_VERIFY", tt.skip)
+			req := httptest.NewRequest(http.MethodPost, "/payment/webhook", bytes.NewReader(body))
+			tt.sign(req)
+			if got := verifyOmiseSignature(req, body); got != tt.want {
+				t.Fatalf("verifyOmiseSignature() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func seedPendingEscrow(t *testing.T, status models.EscrowStatus, sourceID, chargeID string) models.Escrow {
+	t.Helper()
+	now := time.Now()
+	escrow := models.Escrow{
+		ID:        primitive.NewObjectID(),
+		GroupID:   primitive.NewObjectID(),
+		ListingID: primitive.NewObjectID(),
+		Buyer:     "buyer@example.com",
+		Seller:    "seller@example.com",
+		Amount:    50000,
+		Currency:  "THB",
+		SourceID:  sourceID,
+		ChargeID:  chargeID,
+		Status:    status,
+		History:   []models.EscrowEvent{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	insertTestDoc(t, "escrows", escrow)
+	return escrow
+}
+
+func seedPendingPayment(t *testing.T, escrow models.Escrow, sourceID, chargeID string) {
+	t.Helper()
+	now := time.Now()
+	insertTestDoc(t, "payments", models.Payment{
+		ID:        primitive.NewObjectID(),
+		SourceID:  sourceID,
+		ChargeID:  chargeID,
+		EscrowID:  escrow.ID,
+		GroupID:   escrow.GroupID,
+		ListingID: escrow.ListingID,
+		Buyer:     escrow.Buyer,
+		Seller:    escrow.Seller,
+		Amount:    escrow.Amount,
+		Currency:  "THB",
+		Status:    models.PaymentPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	})
+}
+
+func loadTestEscrow(t *testing.T, id primitive.ObjectID) models.Escrow {
+	t.Helper()
+	var escrow models.Escrow
+	if err := config.GetCollection("escrows").FindOne(context.Background(), bson.M{"_id": id}).Decode(&escrow); err != nil {
+		t.Fatal("load escrow:", err)
+	}
+	return escrow
+}
+
+func loadTestPayment(t *testing.T, chargeID string) models.Payment {
+	t.Helper()
+	var payment models.Payment
+	if err := config.GetCollection("payments").FindOne(context.Background(), bson.M{"chargeId": chargeID}).Decode(&payment); err != nil {
+		t.Fatal("load payment:", err)
+	}
+	return payment
+}
+
+// ผู้ซื้อสร้าง QR สองครั้งแล้วจ่าย QR อันแรก escrow ต้องถูกจ่ายด้วย charge นั้น และ webhook ซ้ำต้องไม่ลงบัญชีซ้ำ
+func TestWebhookPaysEscrowFromOlderQR(t *testing.T) {
+	useTestDB(t)
+	t.Setenv("OMISE_WEBHOOK_SECRET", testWebhookSecret)
+
+	escrow := seedPendingEscrow(t, models.EscrowPendingPayment, "src_new", "chrg_new")
+	seedPendingPayment(t, escrow, "src_old", "chrg_old")
+	seedPendingPayment(t, escrow, "src_new", "chrg_new")
+	newFakeOmise(t, map[string]map[string]interface{}{
+		"chrg_old": successfulCharge("chrg_old", "src_old", escrow.Amount),
+	})
+
+	gateway := &fakeRefundGateway{}
+	ctl := NewPaymentController(gateway)
+
+	for i := 0; i < 2; i++ {
+		if w := postWebhook(t, ctl, "chrg_old"); w.Code != http.StatusOK {
+			t.Fatalf("webhook #%d: status %d body %s", i+1, w.Code, w.Body.String())
+		}
+	}
+
+	got := loadTestEscrow(t, escrow.ID)
+	if got.Status != models.EscrowPaid || got.ChargeID != "chrg_old" {
+		t.Fatalf("escrow = %s/%s, want paid/chrg_old", got.Status, got.ChargeID)
+	}
+	if payment := loadTestPayment(t, "chrg_old"); payment.Status != models.PaymentSuccessful {
+		t.Fatalf("payment status = %s, want successful", payment.Status)
+	}
+
+	count, err := config.GetCollection("ledger_entries").CountDocuments(context.Background(),
+		bson.M{"escrowId": escrow.ID, "kind": ledgerKindPaymentReceived})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("payment_received entries = %d, want 2 (one balanced posting)", count)
+	}
+	if calls := gateway.Calls(); len(calls) != 0 {
+		t.Fatalf("unexpected refunds: %v", calls)
+	}
+}
+
+// เงินที่เข้ามาหลัง escrow ถูกยกเลิกเพราะหมดเวลาต้องถูกคืน และ webhook ซ้ำต้องไม่คืนซ้ำ
+func TestWebhookRefundsChargeForCancelledEscrow(t *testing.T) {
+	useTestDB(t)
+	t.Setenv("OMISE_WEBHOOK_SECRET", testWebhookSecret)
+
+	escrow := seedPendingEscrow(t, models.EscrowCancelled, "src_late", "chrg_late")
+	seedPendingPayment(t, escrow, "src_late", "chrg_late")
+	newFakeOmise(t, map[string]map[string]interface{}{
+		"chrg_late": successfulCharge("chrg_late", "src_late", escrow.Amount),
+	})
+
+	gateway := &fakeRefundGateway{}
+	ctl := NewPaymentController(gateway)
+
+	for i := 0; i < 2; i++ {
+		if w := postWebhook(t, ctl, "chrg_late"); w.Code != http.StatusOK {
+			t.Fatalf("webhook #%d: status %d body %s", i+1, w.Code, w.Body.String())
+		}
+	}
+
+	if calls := gateway.Calls(); len(calls) != 1 || calls[0] != "chrg_late" {
+		t.Fatalf("refund calls = %v, want [chrg_late]", calls)
+	}
+	if payment := loadTestPayment(t, "chrg_late"); payment.Status != models.PaymentRefunded || payment.OmiseRefundID == "" {
+		t.Fatalf("payment = %s/%q, want refunded with refund ID", payment.Status, payment.OmiseRefundID)
+	}
+	if got := loadTestEscrow(t, escrow.ID); got.Status != models.EscrowCancelled {
+		t.Fatalf("escrow status = %s, want cancelled", got.Status)
+	}
+}
+
+// คืนเงินอัตโนมัติไม่สำเร็จต้องพักรายการไว้ให้ผู้ดูแล
+func TestWebhookFlagsLateChargeWhenRefundFails(t *testing.T) {
+	useTestDB(t)
+	t.Setenv("OMISE_WEBHOOK_SECRET", testWebhookSecret)
+
+	escrow := seedPendingEscrow(t, models.EscrowCancelled, "src_late", "chrg_late")
+	seedPendingPayment(t, escrow, "src_late", "chrg_late")
+	newFakeOmise(t, map[string]map[string]interface{}{
+		"chrg_late": successfulCharge("chrg_late", "src_late", escrow.Amount),
+	})
+
+	ctl := NewPaymentController(&fakeRefundGateway{err: errors.New("omise unavailable")})
+	if w := postWebhook(t, ctl, "chrg_late"); w.Code != http.StatusOK {
+		t.Fatalf("webhook: status %d body %s", w.Code, w.Body.String())
+	}
+
+	if payment := loadTestPayment(t, "chrg_late"); !payment.NeedsReview {
+		t.Fatalf("payment was not flagged for review: %+v", payment)
+	}
+}
@@ -0,0 +1,240 @@
+package controllers
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func formatSatang(amount int64) string {
+	return fmt.Sprintf("%d.%02d", amount/100, amount%100)
+}
+
+func GetPayoutBalance(c *gin.Context) {
+	email := c.GetString("email")
+	if email == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	account := sellerPayableAccount(email)
+	balances, err := ledgerCreditBalances(ctx, bson.M{"account": account})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate balance"})
+		return
+	}
+
+	paidOut, err := ledgerCreditBalances(ctx, bson.M{
+		"account": account,
+		"kind":    bson.M{"$in": []string{ledgerKindPayout, ledgerKindPayoutReversal}},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate balance"})
+		return
+	}
+
+	// เงินที่ยังพักอยู่ใน escrow และจะเข้าบัญชีผู้ขายเมื่อผู้ซื้อยืนยัน
+	cursor, err := config.GetCollection("escrows").Find(ctx, bson.M{
+		"seller": email,
+		"status": bson.M{"$in": []models.EscrowStatus{
+			models.EscrowPaid, models.EscrowDelivered, models.EscrowAccepted, models.EscrowDisputed,
+		}},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch escrows"})
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var held []models.Escrow
+	if err := cursor.All(ctx, &held); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read escrows"})
+		return
+	}
+	var pending int64
+	for _, e := range held {
+		pending += e.Amount - platformFeeFor(e.Amount)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"available": balances[account],
+		"pending":   pending,
+		"paidOut":   -paidOut[account],
+		"currency":  "THB",
+	})
+}
+
+const (
+	payoutBatchLock    = "payout_batch"
+	payoutBatchLockTTL = 5 * time.Minute
+)
+
+var errLockHeld = errors.New("lock is held by another request")
+
+// จอง lock ด้วย _id ที่ไม่ซ้ำ ถ้ามีคนถือไว้อยู่จะได้ errLockHeld
+func acquireLock(ctx context.Context, name string, ttl time.Duration) error {
+	now := time.Now()
+	_, err := config.GetCollection("locks").InsertOne(ctx, bson.M{"_id": name, "at": now, "expiresAt": now.Add(ttl)})
+	if mongo.IsDuplicateKeyError(err) {
+		return errLockHeld
+	}
+	return err
+}
+
+func releaseLock(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := config.GetCollection("locks").DeleteOne(ctx, bson.M{"_id": name}); err != nil {
+		log.Println("Failed to release lock", name, ":", err)
+	}
+}
+
+// สร้างรอบโอนเงินให้ผู้ขายทุกคนที่มียอดค้างจ่าย โดยใช้บัญชีหลักของผู้ขาย
+// ตัดยอดใน ledger ก่อนบันทึกรอบโอน ผู้ขายที่ตัดยอดไม่สำเร็จจะไม่อยู่ในรอบนี้
+// และสร้างได้ทีละรอบเพื่อไม่ให้ยอดเดียวกันถูกจ่ายซ้ำ
+func CreatePayoutBatch(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := acquireLock(ctx, payoutBatchLock, payoutBatchLockTTL); err != nil {
+		if err == errLockHeld {
+			c.JSON(http.StatusConflict, gin.H{"error": "กำลังสร้างรอบโอนเงินอื่นอยู่ กรุณาลองใหม่ภายหลัง"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to lock payout batch"})
+		return
+	}
+	defer releaseLock(payoutBatchLock)
+
+	balances, err := ledgerCreditBalances(ctx, bson.M{"account": bson.M{"$regex": "^seller_payable:"}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate balances"})
+		return
+	}
+
+	bankCollection := config.DB.Collection("bank_accounts")
+	batch := models.PayoutBatch{
+		ID:        primitive.NewObjectID(),
+		Items:     []models.PayoutItem{},
+		CreatedBy: c.GetString("email"),
+		CreatedAt: time.Now(),
+	}
+	skipped := []string{}
+
+	for account, balance := range balances {
+		if balance <= 0 {
+			continue
+		}
+		seller := strings.TrimPrefix(account, "seller_payable:")
+
+		var bank models.BankAccount
+		err := bankCollection.FindOne(ctx, bson.M{"email": seller, "isDefault": true}).Decode(&bank)
+		if err != nil {
+			skipped = append(skipped, seller)
+			continue
+		}
+
+		err = postLedgerTxn(ctx, []models.LedgerEntry{
+			{Kind: ledgerKindPayout, Account: account, Debit: balance, PayoutBatchID: batch.ID},
+			{Kind: ledgerKindPayout, Account: ledgerPayoutClearing, Credit: balance, PayoutBatchID: batch.ID},
+		})
+		if err != nil {
+			log.Println("Failed to post payout for", seller, "in batch", batch.ID.Hex(), ":", err)
+			skipped = append(skipped, seller)
+			continue
+		}
+
+		batch.Items = append(batch.Items, models.PayoutItem{
+			Seller:        seller,
+			Amount:        balance,
+			BankAccountID: bank.ID,
+			Type:          bank.Type,
+			BankName:      bank.BankName,
+			AccountNo:     bank.AccountNo,
+			AccountName:   bank.AccountName,
+		})
+		batch.Total += balance
+	}
+
+	if len(batch.Items) == 0 {
+		c.JSON(http.StatusOK, gin.H{"message": "No payouts due", "skipped": skipped})
+		return
+	}
+
+	_, err = config.GetCollection("payout_batches").InsertOne(ctx, batch)
+	if err != nil {
+		// บันทึกรอบโอนไม่ได้ คืนยอดที่ตัดไปแล้วให้ผู้ขาย รอบหน้าจะได้จ่ายยอดนี้
+		reversePayoutBatch(ctx, batch)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payout batch"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Payout batch created", "batch": batch, "skipped": skipped})
+}
+
+func reversePayoutBatch(ctx context.Context, batch models.PayoutBatch) {
+	for _, item := range batch.Items {
+		err := postLedgerTxn(ctx, []models.LedgerEntry{
+			{Kind: ledgerKindPayoutReversal, Account: ledgerPayoutClearing, Debit: item.Amount, PayoutBatchID: batch.ID},
+			{Kind: ledgerKindPayoutReversal, Account: sellerPayableAccount(item.Seller), Credit: item.Amount, PayoutBatchID: batch.ID},
+		})
+		if err != nil {
+			log.Println("Failed to reverse payout for", item.Seller, "in batch", batch.ID.Hex(), ":", err)
+		}
+	}
+}
+
+// ส่งออกรอบโอนเงินเป็นไฟล์ CSV ให้ฝ่ายการเงิน
+func ExportPayoutBatch(c *gin.Context) {
+	batchID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid batch ID"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var batch models.PayoutBatch
+	err = config.GetCollection("payout_batches").FindOne(ctx, bson.M{"_id": batchID}).Decode(&batch)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payout batch not found"})
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", "attachment; filename=payout-"+batch.ID.Hex()+".csv")
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"seller_email", "type", "bank_name", "account_no", "account_name", "amount_thb"})
+	for _, item := range batch.Items {
+		w.Write([]string{
+			item.Seller,
+			item.Type,
+			item.BankName,
+			item.AccountNo,
+			item.AccountName,
+			formatSatang(item.Amount),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Println("Failed to write payout CSV:", err)
+	}
+}
@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// เลื่อนตำแหน่งอ่านล่าสุดของสมาชิกไปที่ msg เฉพาะเมื่อใหม่กว่าตำแหน่งเดิม
+// คืน false ถ้าสมาชิกเคยอ่านถึงข้อความนี้หรือใหม่กว่าแล้ว
+func markGroupRead(ctx context.Context, groupID primitive.ObjectID, email string, msg models.Message) (bool, error) {
+	encodedEmail := encodeEmailKey(email)
+	key := "last_read." + encodedEmail
+
+	result, err := config.GetCollection("groups").UpdateOne(ctx,
+		bson.M{"_id": groupID, "$or": []bson.M{
+			{key: bson.M{"$exists": false}},
+			{key + ".timestamp": bson.M{"$lt": msg.Timestamp}},
+			{key + ".timestamp": msg.Timestamp, key + ".message_id": bson.M{"$lt": msg.ID}},
+		}},
+		bson.M{"$set": bson.M{
+			key:                           models.ReadMarker{MessageID: msg.ID, Timestamp: msg.Timestamp},
+			"read_status." + encodedEmail: msg.Timestamp,
+		}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+func latestGroupMessage(ctx context.Context, groupID primitive.ObjectID) (models.Message, error) {
+	var msg models.Message
+	err := config.GetCollection("messages").FindOne(ctx,
+		bson.M{"group_id": groupID},
+		options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}),
+	).Decode(&msg)
+	return msg, err
+}
+
+// แจ้งสมาชิกคนอื่นในห้องว่า email อ่านถึงข้อความ msg แล้ว
+func publishReadReceipt(groupID primitive.ObjectID, senderID, email string, msg models.Message) {
+	publishGroupEvent(groupID, senderID, models.SocketEventReadReceipt, models.ReadReceiptPayload{
+		GroupID:   groupID,
+		Email:     email,
+		MessageID: msg.ID,
+		ReadAt:    time.Now().Format(time.RFC3339),
+	})
+}
+
+func handleReadReceipt(client *Client, group models.Group, envelope models.SocketEnvelope) {
+	var payload struct {
+		MessageID string `json:"message_id"`
+	}
+	if err := json.Unmarshal(envelope.Payload, &payload); err != nil {
+		client.sendError(envelope.ID, "invalid_payload", "Invalid read receipt payload")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msg, err := findGroupMessage(ctx, group.ID, payload.MessageID)
+	if err != nil {
+		client.sendError(envelope.ID, "invalid_payload", "Message not found")
+		return
+	}
+
+	advanced, err := markGroupRead(ctx, group.ID, client.Email, msg)
+	if err != nil {
+		fmt.Println("Failed to update read receipt for", client.Email, ":", err)
+		client.sendError(envelope.ID, "internal", "Failed to update read status")
+		return
+	}
+	if advanced {
+		publishReadReceipt(group.ID, client.ID, client.Email, msg)
+	}
+}
+
+// จำนวนข้อความจากสมาชิกคนอื่นที่ใหม่กว่าตำแหน่งอ่านล่าสุดของ email
+// กลุ่มเก่าที่ยังไม่มี last_read จะเทียบกับเวลาใน read_status แทน
+func unreadCountLookup(email string) bson.D {
+	encodedEmail := encodeEmailKey(email)
+	return bson.D{{Key: "$lookup", Value: bson.M{
+		"from": "messages",
+		"let": bson.M{
+			"gid": "$_id",
+			"ts":  bson.M{"$ifNull": bson.A{"$last_read." + encodedEmail + ".timestamp", "$read_status." + encodedEmail}},
+			"mid": "$last_read." + encodedEmail + ".message_id",
+		},
+		"pipeline": bson.A{
+			bson.M{"$match": bson.M{"$expr": bson.M{"$and": bson.A{
+				bson.M{"$eq": bson.A{"$group_id", "$$gid"}},
+				bson.M{"$ne": bson.A{"$senderEmail", email}},
+				bson.M{"$or": bson.A{
+					bson.M{"$gt": bson.A{"$timestamp", "$$ts"}},
+					bson.M{"$and": bson.A{
+						bson.M{"$eq": bson.A{"$timestamp", "$$ts"}},
+						bson.M{"$gt": bson.A{"$_id", "$$mid"}},
+					}},
+				}},
+			}}}},
+			bson.M{"$count": "n"},
+		},
+		"as": "unread",
+	}}}
+}
@@ -0,0 +1,595 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/omise/omise-go"
+	"github.com/omise/omise-go/operations"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// RefundGateway แยกการเรียก Omise ออกมาเพื่อให้ใช้ fake ในการทดสอบได้
+type RefundGateway interface {
+	RefundCharge(chargeID string, amount int64) (string, error)
+	// คืน ID ของการคืนเงินล่าสุดของ charge หรือ "" ถ้ายังไม่เคยคืน
+	FindChargeRefund(chargeID string) (string, error)
+}
+
+type omiseRefundGateway struct{}
+
+func NewOmiseRefundGateway() RefundGateway {
+	return omiseRefundGateway{}
+}
+
+func (omiseRefundGateway) RefundCharge(chargeID string, amount int64) (string, error) {
+	client, err := newOmiseClient()
+	if err != nil {
+		return "", err
+	}
+
+	refund := &omise.Refund{}
+	err = client.Do(refund, &operations.CreateRefund{
+		ChargeID: chargeID,
+		Amount:   amount,
+	})
+	if err != nil {
+		return "", err
+	}
+	return refund.ID, nil
+}
+
+func (omiseRefundGateway) FindChargeRefund(chargeID string) (string, error) {
+	client, err := newOmiseClient()
+	if err != nil {
+		return "", err
+	}
+
+	refunds := &omise.RefundList{}
+	if err := client.Do(refunds, &operations.ListRefunds{ChargeID: chargeID}); err != nil {
+		return "", err
+	}
+	if len(refunds.Data) == 0 {
+		return "", nil
+	}
+	return refunds.Data[len(refunds.Data)-1].ID, nil
+}
+
+// คำขอที่อยู่ในสถานะ processing นานกว่านี้ถือว่าค้าง และจะถูกตรวจกับ gateway
+const (
+	staleRefundAfter     = 10 * time.Minute
+	refundReconcileEvery = 5 * time.Minute
+)
+
+type RefundController struct {
+	gateway RefundGateway
+}
+
+func NewRefundController(gateway RefundGateway) *RefundController {
+	return &RefundController{gateway: gateway}
+}
+
+func loadRefund(c *gin.Context) (models.Refund, bool) {
+	refundID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid refund ID"})
+		return models.Refund{}, false
+	}
+
+	var refund models.Refund
+	err = config.GetCollection("refunds").FindOne(c.Request.Context(), bson.M{"_id": refundID}).Decode(&refund)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Refund not found"})
+		return models.Refund{}, false
+	}
+	return refund, true
+}
+
+// ผู้ซื้อขอคืนเงิน การซื้อขายจะถูกพักไว้ในสถานะโต้แย้งจนกว่าจะมีการตัดสิน
+func (ctl *RefundController) Request(c *gin.Context) {
+	email := c.GetString("email")
+
+	var reqBody struct {
+		GroupID string `json:"group_id"`
+		Reason  string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&reqBody); err != nil || reqBody.Reason == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ต้องระบุกลุ่มและเหตุผลในการขอคืนเงิน"})
+		return
+	}
+
+	groupID, err := primitive.ObjectIDFromHex(reqBody.GroupID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		return
+	}
+
+	ctx := c.Request.Context()
+
+	escrow, err := findEscrowByGroup(ctx, groupID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "ยังไม่มีการซื้อขายผ่านระบบกลางในกลุ่มนี้"})
+		return
+	}
+	if escrow.Buyer != email {
+		c.JSON(http.StatusForbidden, gin.H{"error": "เฉพาะผู้ซื้อเท่านั้นที่ขอคืนเงินได้"})
+		return
+	}
+
+	count, err := config.GetCollection("refunds").CountDocuments(ctx, bson.M{
+		"escrowId": escrow.ID,
+		"status":   bson.M{"$in": []models.RefundStatus{models.RefundRequested, models.RefundProcessing, models.RefundFailed}},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check refunds"})
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "มีคำขอคืนเงินที่รอดำเนินการอยู่แล้ว"})
+		return
+	}
+
+	if escrow.Status != models.EscrowDisputed {
+		err := transitionEscrow(ctx, &escrow, models.EscrowDisputed, email, "refund requested: "+reqBody.Reason, nil)
+		if err != nil {
+			respondEscrowTransitionError(c, err)
+			return
+		}
+	}
+
+	now := time.Now()
+	refund := models.Refund{
+		ID:        primitive.NewObjectID(),
+		EscrowID:  escrow.ID,
+		GroupID:   escrow.GroupID,
+		ListingID: escrow.ListingID,
+		ChargeID:  escrow.ChargeID,
+		Buyer:     escrow.Buyer,
+		Seller:    escrow.Seller,
+		Amount:    escrow.Amount,
+		Reason:    reqBody.Reason,
+		Status:    models.RefundRequested,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	if _, err := config.GetCollection("refunds").InsertOne(ctx, refund); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create refund"})
+		return
+	}
+
+	c.JSON(http.StatusOK, refund)
+}
+
+func (ctl *RefundController) Get(c *gin.Context) {
+	refund, ok := loadRefund(c)
+	if !ok {
+		return
+	}
+
+	email := c.GetString("email")
+	if refund.Buyer != email && refund.Seller != email {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return
+	}
+
+	c.JSON(http.StatusOK, refund)
+}
+
+// ผู้ขายยอมคืนเงินได้ทันที ถ้าปฏิเสธจะรอผู้ดูแลตัดสิน
+func (ctl *RefundController) SellerDecision(c *gin.Context) {
+	refund, ok := loadRefund(c)
+	if !ok {
+		return
+	}
+
+	email := c.GetString("email")
+	if refund.Seller != email {
+		c.JSON(http.StatusForbidden, gin.H{"error": "เฉพาะผู้ขายเท่านั้นที่ตอบคำขอนี้ได้"})
+		return
+	}
+
+	var reqBody struct {
+		Approve bool `json:"approve"`
+	}
+	if err := c.ShouldBindJSON(&reqBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if refund.Status != models.RefundRequested {
+		c.JSON(http.StatusConflict, gin.H{"error": "คำขอคืนเงินนี้ถูกดำเนินการไปแล้ว"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	_, err := config.GetCollection("refunds").UpdateOne(ctx,
+		bson.M{"_id": refund.ID},
+		bson.M{"$set": bson.M{"sellerApproved": reqBody.Approve, "updatedAt": time.Now()}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update refund"})
+		return
+	}
+	refund.SellerApproved = &reqBody.Approve
+
+	if !reqBody.Approve {
+		c.JSON(http.StatusOK, refund)
+		return
+	}
+
+	ctl.execute(c, refund, email)
+}
+
+// ผู้ดูแลตัดสินคำขอคืนเงิน ถ้าปฏิเสธเงินจะถูกปล่อยให้ผู้ขาย
+func (ctl *RefundController) AdminDecision(c *gin.Context) {
+	refund, ok := loadRefund(c)
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		Approve bool `json:"approve"`
+	}
+	if err := c.ShouldBindJSON(&reqBody); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	email := c.GetString("email")
+	if reqBody.Approve {
+		ctl.execute(c, refund, email)
+		return
+	}
+
+	ctx := c.Request.Context()
+	result, err := config.GetCollection("refunds").UpdateOne(ctx,
+		bson.M{"_id": refund.ID, "status": bson.M{"$in": openRefundStatuses}},
+		bson.M{"$set": bson.M{"status": models.RefundRejected, "decidedBy": email, "updatedAt": time.Now()}},
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update refund"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "คำขอคืนเงินนี้ถูกดำเนินการไปแล้ว"})
+		return
+	}
+	refund.Status = models.RefundRejected
+	refund.DecidedBy = email
+
+	var escrow models.Escrow
+	err = config.GetCollection("escrows").FindOne(ctx, bson.M{"_id": refund.EscrowID}).Decode(&escrow)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load escrow"})
+		return
+	}
+	if err := releaseEscrow(ctx, &escrow, email); err != nil {
+		respondEscrowTransitionError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, refund)
+}
+
+var openRefundStatuses = []models.RefundStatus{models.RefundRequested, models.RefundFailed}
+
+// ผู้ดูแลตัดสิน escrow ที่อยู่ในสถานะโต้แย้ง ปล่อยเงินให้ผู้ขายหรือคืนเงินให้ผู้ซื้อ
+// ใช้ได้ทั้งกรณีที่มีคำขอคืนเงินและกรณีที่ระบบพักไว้เพราะผู้ขายไม่ส่งมอบ
+func (ctl *RefundController) ResolveDispute(c *gin.Context) {
+	escrowID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid escrow ID"})
+		return
+	}
+
+	var reqBody struct {
+		Decision string `json:"decision"`
+		Note     string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&reqBody); err != nil || (reqBody.Decision != "release" && reqBody.Decision != "refund") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "decision ต้องเป็น release หรือ refund"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	email := c.GetString("email")
+
+	var escrow models.Escrow
+	err = config.GetCollection("escrows").FindOne(ctx, bson.M{"_id": escrowID}).Decode(&escrow)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Escrow not found"})
+		return
+	}
+	if escrow.Status != models.EscrowDisputed {
+		c.JSON(http.StatusConflict, gin.H{"error": "การซื้อขายนี้ไม่ได้อยู่ในสถานะโต้แย้ง"})
+		return
+	}
+
+	refunds := config.GetCollection("refunds")
+
+	if reqBody.Decision == "release" {
+		_, err := refunds.UpdateMany(ctx,
+			bson.M{"escrowId": escrow.ID, "status": bson.M{"$in": openRefundStatuses}},
+			bson.M{"$set": bson.M{"status": models.RefundRejected, "decidedBy": email, "updatedAt": time.Now()}},
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update refund"})
+			return
+		}
+		if err := releaseEscrow(ctx, &escrow, email); err != nil {
+			respondEscrowTransitionError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, escrow)
+		return
+	}
+
+	// ใช้คำขอคืนเงินที่ค้างอยู่ ถ้าไม่มีให้สร้างใหม่ในนามผู้ดูแล
+	var refund models.Refund
+	err = refunds.FindOne(ctx, bson.M{"escrowId": escrow.ID, "status": bson.M{"$in": openRefundStatuses}}).Decode(&refund)
+	if err == mongo.ErrNoDocuments {
+		now := time.Now()
+		refund = models.Refund{
+			ID:        primitive.NewObjectID(),
+			EscrowID:  escrow.ID,
+			GroupID:   escrow.GroupID,
+			ListingID: escrow.ListingID,
+			ChargeID:  escrow.ChargeID,
+			Buyer:     escrow.Buyer,
+			Seller:    escrow.Seller,
+			Amount:    escrow.Amount,
+			Reason:    reqBody.Note,
+			Status:    models.RefundRequested,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		_, err = refunds.InsertOne(ctx, refund)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create refund"})
+		return
+	}
+
+	ctl.execute(c, refund, email)
+}
+
+// เรียกคืนเงินผ่าน gateway แล้วปิด escrow ซึ่งจะเปิดขาย listing อีกครั้ง
+// escrow ถูกล็อกเป็น refunding ระหว่างเรียก gateway เพื่อไม่ให้ถูกปล่อยเงินพร้อมกัน
+func (ctl *RefundController) execute(c *gin.Context, refund models.Refund, by string) {
+	// หลังจองคำขอแล้วต้องทำให้จบแม้ client จะตัดการเชื่อมต่อ
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	refunds := config.GetCollection("refunds")
+
+	// จองคำขอไว้ก่อนเพื่อไม่ให้คืนเงินซ้ำเมื่อมีการกดพร้อมกัน
+	var claimed models.Refund
+	err := refunds.FindOneAndUpdate(ctx,
+		bson.M{"_id": refund.ID, "status": bson.M{"$in": openRefundStatuses}},
+		bson.M{"$set": bson.M{"status": models.RefundProcessing, "decidedBy": by, "updatedAt": time.Now()}},
+	).Decode(&claimed)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusConflict, gin.H{"error": "คำขอคืนเงินนี้ถูกดำเนินการไปแล้ว"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update refund"})
+		return
+	}
+	refund = claimed
+	refund.Status = models.RefundProcessing
+	refund.DecidedBy = by
+
+	var escrow models.Escrow
+	err = config.GetCollection("escrows").FindOne(ctx, bson.M{"_id": refund.EscrowID}).Decode(&escrow)
+	if err == nil {
+		err = transitionEscrow(ctx, &escrow, models.EscrowRefunding, by, "refund "+refund.ID.Hex(), nil)
+	}
+	if err != nil {
+		// คืนคำขอกลับสถานะเดิม ผู้ดูแลจะลองใหม่ได้
+		_, revertErr := refunds.UpdateOne(ctx,
+			bson.M{"_id": refund.ID, "status": models.RefundProcessing},
+			bson.M{"$set": bson.M{"status": claimed.Status, "updatedAt": time.Now()}},
+		)
+		if revertErr != nil {
+			log.Println("Failed to revert refund", refund.ID.Hex(), ":", revertErr)
+		}
+		respondEscrowTransitionError(c, err)
+		return
+	}
+
+	omiseRefundID, err := ctl.gateway.RefundCharge(refund.ChargeID, refund.Amount)
+	if err != nil {
+		log.Println("Refund failed for charge", refund.ChargeID, ":", err)
+		if err := failRefund(ctx, &refund, &escrow, err.Error()); err != nil {
+			log.Println("Failed to record refund failure", refund.ID.Hex(), ", will reconcile:", err)
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"error": "ไม่สามารถคืนเงินผ่านระบบชำระเงินได้"})
+		return
+	}
+
+	// เก็บ ID ไว้ก่อน ถ้าขั้นต่อไปล้มเหลว reconcileProcessingRefunds จะทำต่อให้
+	_, err = refunds.UpdateOne(ctx,
+		bson.M{"_id": refund.ID},
+		bson.M{"$set": bson.M{"omiseRefundId": omiseRefundID, "updatedAt": time.Now()}},
+	)
+	if err != nil {
+		log.Println("Failed to record gateway refund", omiseRefundID, "for", refund.ID.Hex(), ":", err)
+	}
+
+	err = completeRefund(ctx, &refund, omiseRefundID)
+	if err == errRefundNeedsReview {
+		c.JSON(http.StatusConflict, gin.H{"error": "คืนเงินแล้วแต่การซื้อขายถูกปิดไปก่อน รอผู้ดูแลตรวจสอบ", "refund": refund})
+		return
+	}
+	if err != nil {
+		log.Println("Failed to complete refund", refund.ID.Hex(), ":", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "คืนเงินแล้วแต่ไม่สามารถอัปเดตสถานะได้"})
+		return
+	}
+
+	c.JSON(http.StatusOK, refund)
+}
+
+// gateway ไม่ได้คืนเงิน: คำขอเป็น failed และ escrow กลับไปรอผู้ดูแลตัดสิน
+func failRefund(ctx context.Context, refund *models.Refund, escrow *models.Escrow, reason string) error {
+	_, err := config.GetCollection("refunds").UpdateOne(ctx,
+		bson.M{"_id": refund.ID, "status": models.RefundProcessing},
+		bson.M{"$set": bson.M{"status": models.RefundFailed, "failureReason": reason, "updatedAt": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	refund.Status = models.RefundFailed
+	refund.FailureReason = reason
+
+	err = transitionEscrow(ctx, escrow, models.EscrowDisputed, escrowSystemActor, "refund failed: "+reason, nil)
+	if err == errIllegalEscrowTransition {
+		return nil
+	}
+	return err
+}
+
+// จัดการคำขอที่ค้างใน processing เช่น process ตายระหว่างรอ gateway หรือบันทึกผลไม่สำเร็จ
+// ถามผลจาก gateway ก่อน ถ้าคืนเงินไปแล้วให้บันทึกต่อ ถ้ายังไม่ได้คืนให้ถือว่าล้มเหลว
+func reconcileProcessingRefunds(ctx context.Context, gateway RefundGateway) error {
+	refunds := config.GetCollection("refunds")
+	cursor, err := refunds.Find(ctx, bson.M{
+		"status":      models.RefundProcessing,
+		"needsReview": bson.M{"$ne": true},
+		"updatedAt":   bson.M{"$lte": time.Now().Add(-staleRefundAfter)},
+	})
+	if err != nil {
+		return err
+	}
+	var stale []models.Refund
+	if err := cursor.All(ctx, &stale); err != nil {
+		return err
+	}
+
+	for i := range stale {
+		refund := &stale[i]
+		omiseRefundID := refund.OmiseRefundID
+		if omiseRefundID == "" {
+			omiseRefundID, err = gateway.FindChargeRefund(refund.ChargeID)
+			if err != nil {
+				log.Println("Failed to look up gateway refund for", refund.ID.Hex(), ":", err)
+				continue
+			}
+		}
+
+		if omiseRefundID == "" {
+			var escrow models.Escrow
+			if err := config.GetCollection("escrows").FindOne(ctx, bson.M{"_id": refund.EscrowID}).Decode(&escrow); err != nil {
+				log.Println("Failed to load escrow for refund", refund.ID.Hex(), ":", err)
+				continue
+			}
+			if err := failRefund(ctx, refund, &escrow, "interrupted before the gateway refunded"); err != nil {
+				log.Println("Failed to reconcile refund", refund.ID.Hex(), ":", err)
+				continue
+			}
+			log.Println("Reconciled interrupted refund", refund.ID.Hex(), "as failed")
+			continue
+		}
+
+		if err := completeRefund(ctx, refund, omiseRefundID); err != nil && err != errRefundNeedsReview {
+			log.Println("Failed to reconcile refund", refund.ID.Hex(), ":", err)
+			continue
+		}
+		log.Println("Reconciled refund", refund.ID.Hex(), "with gateway refund", omiseRefundID)
+	}
+	return nil
+}
+
+func RefundReconciler(gateway RefundGateway) {
+	ticker := time.NewTicker(refundReconcileEvery)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if err := reconcileProcessingRefunds(ctx, gateway); err != nil {
+			log.Println("Failed to reconcile processing refunds:", err)
+		}
+		cancel()
+	}
+}
+
+var errRefundNeedsReview = errors.New("refund completed at the gateway but escrow was already closed")
+
+// บันทึกผลการคืนเงินที่ gateway คืนสำเร็จแล้ว ถ้า escrow ถูกปิดไปก่อน (เช่นถูกปล่อยเงินพร้อมกัน)
+// จะไม่ลงบัญชีคืนเงินซ้อน แต่พักคำขอไว้ให้ผู้ดูแลตรวจสอบ
+func completeRefund(ctx context.Context, refund *models.Refund, omiseRefundID string) error {
+	now := time.Now()
+	refunds := config.GetCollection("refunds")
+
+	var escrow models.Escrow
+	err := config.GetCollection("escrows").FindOne(ctx, bson.M{"_id": refund.EscrowID}).Decode(&escrow)
+	if err != nil {
+		return err
+	}
+	err = transitionEscrow(ctx, &escrow, models.EscrowRefunded, refund.DecidedBy, omiseRefundID, nil)
+	if err == errIllegalEscrowTransition && escrow.Status != models.EscrowRefunded {
+		reason := "escrow was " + string(escrow.Status) + " when refund " + omiseRefundID + " completed"
+		log.Println("Refund", refund.ID.Hex(), "needs review:", reason)
+		_, err = refunds.UpdateOne(ctx,
+			bson.M{"_id": refund.ID},
+			bson.M{"$set": bson.M{
+				"omiseRefundId": omiseRefundID,
+				"needsReview":   true,
+				"reviewReason":  reason,
+				"updatedAt":     now,
+			}},
+		)
+		if err != nil {
+			return err
+		}
+		refund.OmiseRefundID = omiseRefundID
+		refund.NeedsReview = true
+		refund.ReviewReason = reason
+		return errRefundNeedsReview
+	}
+	if err != nil && err != errIllegalEscrowTransition {
+		return err
+	}
+
+	_, err = refunds.UpdateOne(ctx,
+		bson.M{"_id": refund.ID},
+		bson.M{"$set": bson.M{"status": models.RefundCompleted, "omiseRefundId": omiseRefundID, "updatedAt": now}},
+	)
+	if err != nil {
+		return err
+	}
+	refund.Status = models.RefundCompleted
+	refund.OmiseRefundID = omiseRefundID
+
+	if err := postEscrowRefund(ctx, escrow, omiseRefundID); err != nil {
+		return err
+	}
+
+	_, err = config.GetCollection("payments").UpdateOne(ctx,
+		bson.M{"chargeId": refund.ChargeID},
+		bson.M{"$set": bson.M{"status": models.PaymentRefunded, "updatedAt": now}},
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = config.GetCollection("groups").UpdateOne(ctx,
+		bson.M{"_id": refund.GroupID},
+		bson.M{"$set": bson.M{
+			"payment_status":   string(models.PaymentRefunded),
+			"buyer_confirmed":  false,
+			"seller_confirmed": false,
+		}},
+	)
+	return err
+}
@@ -0,0 +1,274 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	testBuyer  = "buyer@example.com"
+	testSeller = "seller@example.com"
+)
+
+// router ของ refund ที่ใส่ email จาก header แทน JWT
+func newRefundRouter(gateway RefundGateway) *gin.Engine {
+	ctl := NewRefundController(gateway)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("email", c.GetHeader("X-Test-Email"))
+	})
+	r.POST("/refund", ctl.Request)
+	r.PATCH("/refund/:id/seller", ctl.SellerDecision)
+	r.PATCH("/refund/:id/admin", ctl.AdminDecision)
+	return r
+}
+
+func doJSON(t *testing.T, r http.Handler, method, path, email string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	raw, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, path, bytes.NewReader(raw))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Test-Email", email)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// listing ที่ถูกจองไว้กับ escrow ที่จ่ายเงินแล้ว
+func seedPaidTrade(t *testing.T) (models.Listing, models.Escrow) {
+	t.Helper()
+	now := time.Now()
+	listing := models.Listing{
+		ID:        primitive.NewObjectID(),
+		UserEmail: testSeller,
+		Title:     "test account",
+		Price:     500,
+		Status:    models.ListingReserved,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	insertTestDoc(t, "listings", listing)
+
+	escrow := models.Escrow{
+		ID:        primitive.NewObjectID(),
+		GroupID:   primitive.NewObjectID(),
+		ListingID: listing.ID,
+		Buyer:     testBuyer,
+		Seller:    testSeller,
+		Amount:    int64(listing.Price) * 100,
+		Currency:  "THB",
+		ChargeID:  "chrg_test_paid",
+		Status:    models.EscrowPaid,
+		History:   []models.EscrowEvent{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	insertTestDoc(t, "escrows", escrow)
+	return listing, escrow
+}
+
+func requestTestRefund(t *testing.T, r http.Handler, escrow models.Escrow) models.Refund {
+	t.Helper()
+	w := doJSON(t, r, http.MethodPost, "/refund", testBuyer, gin.H{"group_id": escrow.GroupID.Hex(), "reason": "wrong account"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("request refund: status %d body %s", w.Code, w.Body.String())
+	}
+	var refund models.Refund
+	if err := json.Unmarshal(w.Body.Bytes(), &refund); err != nil {
+		t.Fatal(err)
+	}
+	return refund
+}
+
+func loadTestRefund(t *testing.T, id primitive.ObjectID) models.Refund {
+	t.Helper()
+	var refund models.Refund
+	if err := config.GetCollection("refunds").FindOne(context.Background(), bson.M{"_id": id}).Decode(&refund); err != nil {
+		t.Fatal("load refund:", err)
+	}
+	return refund
+}
+
+func countRefundLedger(t *testing.T, escrowID primitive.ObjectID) int64 {
+	t.Helper()
+	count, err := config.GetCollection("ledger_entries").CountDocuments(context.Background(),
+		bson.M{"escrowId": escrowID, "kind": ledgerKindRefund})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestSellerApprovedRefundCompletes(t *testing.T) {
+	useTestDB(t)
+	gateway := &fakeRefundGateway{}
+	r := newRefundRouter(gateway)
+	listing, escrow := seedPaidTrade(t)
+
+	refund := requestTestRefund(t, r, escrow)
+	if got := loadTestEscrow(t, escrow.ID); got.Status != models.EscrowDisputed {
+		t.Fatalf("escrow status after request = %s, want disputed", got.Status)
+	}
+
+	if w := doJSON(t, r, http.MethodPatch, "/refund/"+refund.ID.Hex()+"/seller", testBuyer, gin.H{"approve": true}); w.Code != http.StatusForbidden {
+		t.Fatalf("buyer approving own refund: status %d, want 403", w.Code)
+	}
+	if w := doJSON(t, r, http.MethodPatch, "/refund/"+refund.ID.Hex()+"/seller", testSeller, gin.H{"approve": true}); w.Code != http.StatusOK {
+		t.Fatalf("seller approve: status %d body %s", w.Code, w.Body.String())
+	}
+
+	if calls := gateway.Calls(); len(calls) != 1 || calls[0] != escrow.ChargeID {
+		t.Fatalf("gateway calls = %v, want [%s]", calls, escrow.ChargeID)
+	}
+	if got := loadTestRefund(t, refund.ID); got.Status != models.RefundCompleted || got.OmiseRefundID == "" {
+		t.Fatalf("refund = %s/%q, want completed with refund ID", got.Status, got.OmiseRefundID)
+	}
+	if got := loadTestEscrow(t, escrow.ID); got.Status != models.EscrowRefunded {
+		t.Fatalf("escrow status = %s, want refunded", got.Status)
+	}
+	if n := countRefundLedger(t, escrow.ID); n != 2 {
+		t.Fatalf("refund ledger entries = %d, want 2", n)
+	}
+
+	var got models.Listing
+	if err := config.GetCollection("listings").FindOne(context.Background(), bson.M{"_id": listing.ID}).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != models.ListingActive {
+		t.Fatalf("listing status = %s, want active", got.Status)
+	}
+
+	// อนุมัติซ้ำต้องไม่เรียก gateway อีก
+	if w := doJSON(t, r, http.MethodPatch, "/refund/"+refund.ID.Hex()+"/admin", "admin@example.com", gin.H{"approve": true}); w.Code != http.StatusConflict {
+		t.Fatalf("second approval: status %d, want 409", w.Code)
+	}
+	if calls := gateway.Calls(); len(calls) != 1 {
+		t.Fatalf("gateway called again: %v", calls)
+	}
+}
+
+func TestRefundGatewayFailureKeepsEscrowDisputed(t *testing.T) {
+	useTestDB(t)
+	gateway := &fakeRefundGateway{err: errors.New("omise unavailable")}
+	r := newRefundRouter(gateway)
+	_, escrow := seedPaidTrade(t)
+
+	refund := requestTestRefund(t, r, escrow)
+	if w := doJSON(t, r, http.MethodPatch, "/refund/"+refund.ID.Hex()+"/admin", "admin@example.com", gin.H{"approve": true}); w.Code != http.StatusBadGateway {
+		t.Fatalf("admin approve: status %d, want 502", w.Code)
+	}
+
+	if got := loadTestRefund(t, refund.ID); got.Status != models.RefundFailed || got.FailureReason == "" {
+		t.Fatalf("refund = %s/%q, want failed with reason", got.Status, got.FailureReason)
+	}
+	if got := loadTestEscrow(t, escrow.ID); got.Status != models.EscrowDisputed {
+		t.Fatalf("escrow status = %s, want disputed", got.Status)
+	}
+	if n := countRefundLedger(t, escrow.ID); n != 0 {
+		t.Fatalf("refund ledger entries = %d, want 0", n)
+	}
+}
+
+// escrow ถูกล็อกเป็น refunding ระหว่างรอ Omise การปล่อยเงินพร้อมกันต้องไม่สำเร็จ
+func TestReleaseBlockedWhileRefundProcessing(t *testing.T) {
+	useTestDB(t)
+	gateway := &fakeRefundGateway{}
+	r := newRefundRouter(gateway)
+	_, escrow := seedPaidTrade(t)
+
+	refund := requestTestRefund(t, r, escrow)
+	gateway.onRefund = func() {
+		locked := loadTestEscrow(t, escrow.ID)
+		if locked.Status != models.EscrowRefunding {
+			t.Errorf("escrow status during refund = %s, want refunding", locked.Status)
+		}
+		if err := releaseEscrow(context.Background(), &locked, "admin@example.com"); err != errIllegalEscrowTransition {
+			t.Errorf("concurrent release = %v, want errIllegalEscrowTransition", err)
+		}
+	}
+
+	w := doJSON(t, r, http.MethodPatch, "/refund/"+refund.ID.Hex()+"/admin", "admin@example.com", gin.H{"approve": true})
+	if w.Code != http.StatusOK {
+		t.Fatalf("admin approve: status %d body %s, want 200", w.Code, w.Body.String())
+	}
+	if got := loadTestRefund(t, refund.ID); got.Status != models.RefundCompleted {
+		t.Fatalf("refund status = %s, want completed", got.Status)
+	}
+	if e := loadTestEscrow(t, escrow.ID); e.Status != models.EscrowRefunded {
+		t.Fatalf("escrow status = %s, want refunded", e.Status)
+	}
+}
+
+// คำขอที่ค้างใน processing: ถ้า gateway คืนเงินแล้วต้องปิดให้ครบ ถ้ายังไม่คืนต้องกลับไปรอผู้ดูแล
+func TestReconcileProcessingRefunds(t *testing.T) {
+	useTestDB(t)
+	gateway := &fakeRefundGateway{}
+	ctx := context.Background()
+	stale := time.Now().Add(-2 * staleRefundAfter)
+
+	seedStuckRefund := func(chargeID string) (models.Escrow, models.Refund) {
+		_, escrow := seedPaidTrade(t)
+		_, err := config.GetCollection("escrows").UpdateOne(ctx,
+			bson.M{"_id": escrow.ID},
+			bson.M{"$set": bson.M{"status": models.EscrowRefunding, "chargeId": chargeID}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refund := models.Refund{
+			ID:        primitive.NewObjectID(),
+			EscrowID:  escrow.ID,
+			GroupID:   escrow.GroupID,
+			ListingID: escrow.ListingID,
+			ChargeID:  chargeID,
+			Buyer:     testBuyer,
+			Seller:    testSeller,
+			Amount:    escrow.Amount,
+			Status:    models.RefundProcessing,
+			DecidedBy: "admin@example.com",
+			CreatedAt: stale,
+			UpdatedAt: stale,
+		}
+		insertTestDoc(t, "refunds", refund)
+		return escrow, refund
+	}
+
+	refundedEscrow, refunded := seedStuckRefund("chrg_refunded")
+	if _, err := gateway.RefundCharge("chrg_refunded", refunded.Amount); err != nil {
+		t.Fatal(err)
+	}
+	untouchedEscrow, untouched := seedStuckRefund("chrg_untouched")
+
+	if err := reconcileProcessingRefunds(ctx, gateway); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := loadTestRefund(t, refunded.ID); got.Status != models.RefundCompleted || got.OmiseRefundID == "" {
+		t.Fatalf("refunded at gateway: refund = %s/%q, want completed", got.Status, got.OmiseRefundID)
+	}
+	if e := loadTestEscrow(t, refundedEscrow.ID); e.Status != models.EscrowRefunded {
+		t.Fatalf("refunded at gateway: escrow = %s, want refunded", e.Status)
+	}
+	if got := loadTestRefund(t, untouched.ID); got.Status != models.RefundFailed {
+		t.Fatalf("not refunded at gateway: refund = %s, want failed", got.Status)
+	}
+	if e := loadTestEscrow(t, untouchedEscrow.ID); e.Status != models.EscrowDisputed {
+		t.Fatalf("not refunded at gateway: escrow = %s, want disputed", e.Status)
+	}
+	if calls := gateway.Calls(); len(calls) != 1 {
+		t.Fatalf("reconcile called the gateway refund: %v", calls)
+	}
+}
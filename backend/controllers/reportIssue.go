@@ -42,10 +42,19 @@ func CreateReportIssue(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Report created", "id": report.ID.Hex()})
 }
 
+// ผู้รายงานกรอกได้เฉพาะรายละเอียดของปัญหา ส่วนการจัดการเป็นของผู้ดูแล
+type reportIssuePostInput struct {
+	IssueType     string  `json:"issueType"`
+	Subject       string  `json:"subject"`
+	Description   string  `json:"description"`
+	ListingID     *string `json:"listingId"`
+	ReportedEmail *string `json:"reportedEmail"`
+}
+
 func CreateReportIssuePost(c *gin.Context) {
-	var report models.ReportIssuePost
+	var input reportIssuePostInput
 
-	if err := c.ShouldBindJSON(&report); err != nil {
+	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
 		return
 	}
@@ -55,9 +64,17 @@ func CreateReportIssuePost(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
-	report.Email = email.(string)
-	report.ID = primitive.NewObjectID()
-	report.CreatedAt = time.Now()
+	report := models.ReportIssuePost{
+		ID:            primitive.NewObjectID(),
+		Email:         email.(string),
+		IssueType:     input.IssueType,
+		Subject:       input.Subject,
+		Description:   input.Description,
+		ListingID:     input.ListingID,
+		ReportedEmail: input.ReportedEmail,
+		CreatedAt:     time.Now(),
+		Status:        models.ReportOpen,
+	}
 
 	collection := config.DB.Collection("report_issues_post")
 	_, err := collection.InsertOne(context.Background(), report)
@@ -0,0 +1,109 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ถ้าพลาดไปมากกว่านี้ client ต้องดึงส่วนที่เหลือผ่าน GetMessagesHandler
+const maxCatchUpMessages = 500
+
+type catchUpFrame struct {
+	at    time.Time
+	frame []byte
+}
+
+// ส่งข้อความและ event การซื้อขายที่เกิดหลัง lastSeen ตามลำดับเวลา แล้วปิดท้ายด้วย catch_up_complete
+// ต้องเรียกระหว่างที่ client ถูก hold ไว้ event สดจะได้ไม่แทรกก่อน
+func replayMissedEvents(ctx context.Context, client *Client, lastSeen models.Message) error {
+	since, err := time.Parse(time.RFC3339, lastSeen.Timestamp)
+	if err != nil {
+		return err
+	}
+
+	cursor, err := config.GetCollection("messages").Find(ctx,
+		bson.M{"group_id": lastSeen.GroupID, "$or": messageCursorFilter(lastSeen, "$gt")},
+		options.Find().
+			SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}).
+			SetLimit(maxCatchUpMessages+1),
+	)
+	if err != nil {
+		return err
+	}
+	var messages []models.Message
+	if err := cursor.All(ctx, &messages); err != nil {
+		return err
+	}
+
+	hasMore := len(messages) > maxCatchUpMessages
+	if hasMore {
+		messages = messages[:maxCatchUpMessages]
+	}
+
+	// timestamp ของข้อความละเอียดแค่ระดับวินาที จึงใช้ $gte ยอมให้ event ซ้ำได้ดีกว่าหายไป
+	eventFilter := bson.M{"group_id": lastSeen.GroupID, "at": bson.M{"$gte": since}}
+	if hasMore {
+		until, _ := time.Parse(time.RFC3339, messages[len(messages)-1].Timestamp)
+		eventFilter["at"] = bson.M{"$gte": since, "$lte": until}
+	}
+	cursor, err = config.GetCollection("chat_events").Find(ctx, eventFilter,
+		options.Find().SetSort(bson.D{{Key: "at", Value: 1}, {Key: "_id", Value: 1}}),
+	)
+	if err != nil {
+		return err
+	}
+	var events []models.ChatEvent
+	if err := cursor.All(ctx, &events); err != nil {
+		return err
+	}
+
+	frames := make([]catchUpFrame, 0, len(messages)+len(events))
+	for _, msg := range messages {
+		at, _ := time.Parse(time.RFC3339, msg.Timestamp)
+		frame, err := encodeEnvelope(models.SocketEventMessage, "", msg)
+		if err != nil {
+			return err
+		}
+		frames = append(frames, catchUpFrame{at: at, frame: frame})
+	}
+	for _, event := range events {
+		frame, err := json.Marshal(models.SocketEnvelope{
+			Version: models.SocketProtocolVersion,
+			Type:    event.Type,
+			Payload: event.Payload,
+		})
+		if err != nil {
+			return err
+		}
+		frames = append(frames, catchUpFrame{at: event.At.Truncate(time.Second), frame: frame})
+	}
+	// ข้อความมาก่อน event ที่เกิดในวินาทีเดียวกัน
+	sort.SliceStable(frames, func(i, j int) bool {
+		return frames[i].at.Before(frames[j].at)
+	})
+
+	for _, f := range frames {
+		if !client.pushWait(f.frame) {
+			return nil
+		}
+	}
+
+	done, err := encodeEnvelope(models.SocketEventCatchUpDone, "", models.CatchUpCompletePayload{
+		Messages: len(messages),
+		Events:   len(events),
+		HasMore:  hasMore,
+	})
+	if err != nil {
+		return err
+	}
+	client.pushWait(done)
+	return nil
+}
@@ -2,41 +2,43 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"go-auth-mongo/config"
 	"go-auth-mongo/models"
 	"go-auth-mongo/utils"
 	"net/http"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
-type Client struct {
-	Conn    *websocket.Conn
-	Email   string
-	GroupID primitive.ObjectID
-}
-
+// event ที่ส่งผ่าน pubsub จึงต้องแปลงเป็น JSON ได้และไม่อ้างถึง connection โดยตรง
 type BroadcastMessage struct {
-	Message    models.Message
-	SenderConn *websocket.Conn
+	Message  models.Message `json:"message"`
+	SenderID string         `json:"sender_id"`
+	Members  []string       `json:"members"`
 }
 
 type NewGroupNotification struct {
-	Group      models.Group
-	ReceiverEM string
+	Group      models.Group `json:"group"`
+	ReceiverEM string       `json:"receiver"`
 }
 
-var broadcastNewGroup = make(chan NewGroupNotification)
-var clients = make(map[*websocket.Conn]Client)
-var clientsMutex_chat = sync.RWMutex{}
-var broadcast = make(chan BroadcastMessage)
+type UserDisconnectEvent struct {
+	Email string `json:"email"`
+}
+
+const (
+	chatMessageTopic    = "chat.message"
+	groupCreatedTopic   = "chat.group_created"
+	userDisconnectTopic = "chat.user_disconnect"
+)
 
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
@@ -51,186 +53,160 @@ func encodeEmailKey_(email string) string {
 	)
 }
 
+// upgrade โดยตอบ subprotocol กลับไปถ้า client ส่ง token มาทาง Sec-WebSocket-Protocol
+func upgradeSocket(c *gin.Context) (*websocket.Conn, error) {
+	header := http.Header{}
+	if protocol := c.GetString("wsSubprotocol"); protocol != "" {
+		header.Set("Sec-WebSocket-Protocol", protocol)
+	}
+	return upgrader.Upgrade(c.Writer, c.Request, header)
+}
+
 func WebSocketHandlerChat(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	email := c.GetString("email")
+
+	groupID, err := primitive.ObjectIDFromHex(c.Query("group_id"))
 	if err != nil {
-		fmt.Println("WebSocket upgrade error:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upgrade connection"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid GroupID"})
 		return
 	}
 
-	email := c.Query("email")
-	groupIDStr := c.Query("group_id")
-	encodedEmail := encodeEmailKey_(email)
-
-	groupID, err := primitive.ObjectIDFromHex(groupIDStr)
+	group, err := authorizeGroupMember(c.Request.Context(), groupID, email)
 	if err != nil {
-		fmt.Println("Invalid GroupID:", err)
-		conn.Close()
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid GroupID"})
+		respondGroupAccessError(c, err)
 		return
 	}
 
-	client := Client{
-		Conn:    conn,
-		Email:   email,
-		GroupID: groupID,
+	// client ที่เชื่อมต่อใหม่ส่ง last_seen มาเพื่อรับข้อความที่พลาดไประหว่างหลุด
+	var lastSeen *models.Message
+	if raw := c.Query("last_seen"); raw != "" {
+		ref, err := findGroupMessage(c.Request.Context(), groupID, raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid last_seen"})
+			return
+		}
+		lastSeen = &ref
 	}
 
-	clientsMutex_chat.Lock()
-	clients[conn] = client
+	conn, err := upgradeSocket(c)
+	if err != nil {
+		fmt.Println("WebSocket upgrade error:", err)
+		return
+	}
+
+	client := newClient(conn, email, groupID)
+	if lastSeen != nil {
+		client.hold()
+	}
+	registerClient(client)
 	fmt.Println("Client connected:", email, "in group", groupID.Hex())
-	clientsMutex_chat.Unlock()
-
-	done := make(chan struct{})
-	go func() {
-		ticker := time.NewTicker(30 * time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				groupsCollection := config.GetCollection("groups")
-				filter := bson.M{"_id": groupID}
-				update := bson.M{
-					"$set": bson.M{
-						"read_status." + encodedEmail: time.Now().Format(time.RFC3339),
-					},
-				}
-				_, err := groupsCollection.UpdateOne(context.Background(), filter, update)
-				if err != nil {
-					fmt.Println("Failed to update read_statuses for", email, ":", err)
-				} else {
-					fmt.Println("Updated read_statuses for", email)
-				}
-			case <-done:
-				return
-			}
+
+	if lastSeen != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := replayMissedEvents(ctx, client, *lastSeen); err != nil {
+			fmt.Println("Failed to replay missed events for", email, ":", err)
+			client.sendError("", "catch_up_failed", "ไม่สามารถดึงข้อความที่พลาดไปได้")
 		}
-	}()
+		cancel()
+		client.resume()
+	}
 
 	defer func() {
-		clientsMutex_chat.Lock()
-		delete(clients, conn)
-		clientsMutex_chat.Unlock()
-		conn.Close()
-		close(done)
+		unregisterClient(client)
 		fmt.Println("Client disconnected:", email)
 	}()
 
 	for {
-		var msg models.Message
-		err := conn.ReadJSON(&msg)
+		_, data, err := conn.ReadMessage()
 		if err != nil {
-			fmt.Println("Error reading json from", email, ":", err)
+			fmt.Println("Error reading frame from", email, ":", err)
 			break
 		}
+		handleChatFrame(client, group, data)
+	}
+}
 
-		msg.GroupID = groupID
-		msg.Timestamp = time.Now().Format(time.RFC3339)
-
-		fmt.Println("Received message from", email, ":", msg.Content)
+func findMessageByClientID(ctx context.Context, groupID primitive.ObjectID, email, clientID string) (models.Message, error) {
+	var msg models.Message
+	err := config.GetCollection("messages").FindOne(ctx, bson.M{
+		"group_id":    groupID,
+		"senderEmail": email,
+		"client_id":   clientID,
+	}).Decode(&msg)
+	return msg, err
+}
 
-		collection := config.GetCollection("messages")
-		_, err = collection.InsertOne(context.Background(), msg)
-		if err != nil {
-			fmt.Println("Error saving message to DB:", err)
-			continue
-		}
-		fmt.Println("Message saved to DB:", msg.Content)
+// บันทึกข้อความ ถ้า client ส่ง id เดิมซ้ำจะคืนข้อความที่บันทึกไว้แล้วพร้อม duplicate = true
+func saveChatMessage(ctx context.Context, msg models.Message) (models.Message, bool, error) {
+	collection := config.GetCollection("messages")
+	_, err := collection.InsertOne(ctx, msg)
+	if err != nil && msg.ClientID != "" && mongo.IsDuplicateKeyError(err) {
+		existing, err := findMessageByClientID(ctx, msg.GroupID, msg.SenderEmail, msg.ClientID)
+		return existing, err == nil, err
+	}
+	if err != nil {
+		return msg, false, err
+	}
 
-		groupsCollection := config.GetCollection("groups")
+	groupsCollection := config.GetCollection("groups")
 
-		var groupData struct {
-			Members       []string `bson:"members"`
-			LastMessageAt string   `bson:"last_message_at"`
-		}
+	var groupData struct {
+		Members       []string `bson:"members"`
+		LastMessageAt string   `bson:"last_message_at"`
+	}
 
-		err = groupsCollection.FindOne(context.Background(), bson.M{"_id": groupID}).Decode(&groupData)
-		if err != nil {
-			fmt.Println("Failed to fetch group data:", err)
-		} else {
-			// ตรวจสอบเวลาห่างจาก last_message_at
-			lastTime, err := time.Parse(time.RFC3339, groupData.LastMessageAt)
-			if err == nil {
-				if time.Since(lastTime) > 30*time.Minute {
-					fmt.Println("Sending email notifications to group members (inactive > 30m)")
-					for _, member := range groupData.Members {
-						if member != msg.SenderEmail {
-							go func(m string) {
-								err := utils.SendNewMessageNotificationEmail(m)
-								if err != nil {
-									fmt.Println("Failed to send email to", m, ":", err)
-								} else {
-									fmt.Println("Sent email to", m)
-								}
-							}(member)
+	err = groupsCollection.FindOne(ctx, bson.M{"_id": msg.GroupID}).Decode(&groupData)
+	if err != nil {
+		fmt.Println("Failed to fetch group data:", err)
+	} else {
+		// ตรวจสอบเวลาห่างจาก last_message_at
+		lastTime, err := time.Parse(time.RFC3339, groupData.LastMessageAt)
+		if err == nil && time.Since(lastTime) > 30*time.Minute {
+			fmt.Println("Sending email notifications to group members (inactive > 30m)")
+			for _, member := range groupData.Members {
+				if member != msg.SenderEmail {
+					go func(m string) {
+						if err := utils.SendNewMessageNotificationEmail(m); err != nil {
+							fmt.Println("Failed to send email to", m, ":", err)
 						}
-					}
+					}(member)
 				}
 			}
 		}
+	}
 
-		// อัปเดต last_message_at
-		_, err = groupsCollection.UpdateOne(
-			context.Background(),
-			bson.M{"_id": groupID},
-			bson.M{"$set": bson.M{"last_message_at": msg.Timestamp}},
-		)
-		if err != nil {
-			fmt.Println("Failed to update last_message_at:", err)
-		} else {
-			fmt.Println("Updated last_message_at")
-		}
-
-		// อัปเดต read_status สำหรับ sender
-		encodedSender := encodeEmailKey_(msg.SenderEmail)
-		_, err = groupsCollection.UpdateOne(
-			context.Background(),
-			bson.M{"_id": groupID},
-			bson.M{"$set": bson.M{"read_status." + encodedSender: msg.Timestamp}},
-		)
-		if err != nil {
-			fmt.Println("Failed to update read_status for sender:", err)
-		}
-
-		broadcast <- BroadcastMessage{
-			Message:    msg,
-			SenderConn: conn,
-		}
-		fmt.Println("Message sent to broadcast channel")
+	// อัปเดต last_message_at และถือว่าผู้ส่งอ่านถึงข้อความของตัวเองแล้ว
+	encodedSender := encodeEmailKey_(msg.SenderEmail)
+	_, err = groupsCollection.UpdateOne(ctx,
+		bson.M{"_id": msg.GroupID},
+		bson.M{"$set": bson.M{
+			"last_message_at":              msg.Timestamp,
+			"read_status." + encodedSender: msg.Timestamp,
+			"last_read." + encodedSender:   models.ReadMarker{MessageID: msg.ID, Timestamp: msg.Timestamp},
+		}},
+	)
+	if err != nil {
+		fmt.Println("Failed to update last_message_at:", err)
 	}
+
+	return msg, false, nil
 }
 
 func WebSocketHandlerListenAllGroups(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	email := c.GetString("email")
+
+	conn, err := upgradeSocket(c)
 	if err != nil {
 		fmt.Println("WebSocket upgrade error:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upgrade connection"})
 		return
 	}
 
-	email := c.Query("email")
-	if email == "" {
-		conn.Close()
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Email is required"})
-		return
-	}
-
-	client := Client{
-		Conn:  conn,
-		Email: email,
-	}
-
-	clientsMutex_chat.Lock()
-	clients[conn] = client
+	client := newClient(conn, email, primitive.NilObjectID)
+	registerClient(client)
 	fmt.Println("Client connected to group-listener:", email)
-	clientsMutex_chat.Unlock()
 
 	defer func() {
-		clientsMutex_chat.Lock()
-		delete(clients, conn)
-		clientsMutex_chat.Unlock()
-		conn.Close()
+		unregisterClient(client)
 		fmt.Println("Client disconnected:", email)
 	}()
 
@@ -244,35 +220,20 @@ func WebSocketHandlerListenAllGroups(c *gin.Context) {
 }
 
 func WebSocketHandlerWatchNewGroups(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	email := c.GetString("email")
+
+	conn, err := upgradeSocket(c)
 	if err != nil {
 		fmt.Println("WebSocket upgrade error:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upgrade connection"})
 		return
 	}
 
-	email := c.Query("email")
-	if email == "" {
-		conn.Close()
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Email is required"})
-		return
-	}
-
-	client := Client{
-		Conn:  conn,
-		Email: email,
-	}
-
-	clientsMutex_chat.Lock()
-	clients[conn] = client
+	client := newClient(conn, email, primitive.NilObjectID)
+	registerClient(client)
 	fmt.Println("Client connected to group-creation-listener:", email)
-	clientsMutex_chat.Unlock()
 
 	defer func() {
-		clientsMutex_chat.Lock()
-		delete(clients, conn)
-		clientsMutex_chat.Unlock()
-		conn.Close()
+		unregisterClient(client)
 		fmt.Println("Client disconnected from group-creation-listener:", email)
 	}()
 
@@ -285,89 +246,109 @@ func WebSocketHandlerWatchNewGroups(c *gin.Context) {
 	}
 }
 
-func Broadcaster() {
+func publishEvent(topic string, event interface{}) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		fmt.Println("Failed to encode", topic, "event:", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := config.PubSub.Publish(ctx, topic, payload); err != nil {
+		fmt.Println("Failed to publish", topic, "event:", err)
+	}
+}
+
+// รับ event จาก pubsub ตลอดอายุของ process และ subscribe ใหม่ถ้าหลุด
+func subscribeEvents(topic string, handle func(payload []byte)) {
 	for {
-		b := <-broadcast
+		ch, err := config.PubSub.Subscribe(context.Background(), topic)
+		if err != nil {
+			fmt.Println("Failed to subscribe", topic, ":", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		for payload := range ch {
+			handle(payload)
+		}
+		fmt.Println("Subscription closed, resubscribing:", topic)
+		time.Sleep(time.Second)
+	}
+}
+
+func Broadcaster() {
+	subscribeEvents(chatMessageTopic, func(payload []byte) {
+		var b BroadcastMessage
+		if err := json.Unmarshal(payload, &b); err != nil {
+			fmt.Println("Invalid chat message event:", err)
+			return
+		}
 		msg := b.Message
-		sender := b.SenderConn
 
-		fmt.Println("Broadcasting message:", msg.Content)
+		rawMessage, err := encodeEnvelope(models.SocketEventMessage, "", msg)
+		if err != nil {
+			fmt.Println("Failed to encode message event:", err)
+			return
+		}
+		notification, err := encodeEnvelope(models.SocketEventNewMessage, "", models.NewMessageNotificationPayload{
+			GroupID:     msg.GroupID,
+			SenderEmail: msg.SenderEmail,
+			Timestamp:   msg.Timestamp,
+		})
+		if err != nil {
+			fmt.Println("Failed to encode notification event:", err)
+			return
+		}
 
-		clientsMutex_chat.RLock()
-		for conn, client := range clients {
-			if conn == sender {
-				continue
+		deliverToClients(func(client *Client) bool {
+			if client.ID == b.SenderID {
+				return false
 			}
-
 			if client.GroupID != primitive.NilObjectID {
-				if client.GroupID == msg.GroupID {
-					err := conn.WriteJSON(msg)
-					if err != nil {
-						fmt.Println("Error sending to", client.Email, ":", err)
-						conn.Close()
-						clientsMutex_chat.RUnlock()
-						clientsMutex_chat.Lock()
-						delete(clients, conn)
-						clientsMutex_chat.Unlock()
-						break
-					}
-					fmt.Println("Message sent to", client.Email)
-				}
-			} else {
-				notification := map[string]interface{}{
-					"type":      "new_message_notification",
-					"group_id":  msg.GroupID.Hex(),
-					"timestamp": msg.Timestamp,
-				}
-				err := conn.WriteJSON(notification)
-				if err != nil {
-					fmt.Println("Error sending notification to", client.Email, ":", err)
-					conn.Close()
-					clientsMutex_chat.RUnlock()
-					clientsMutex_chat.Lock()
-					delete(clients, conn)
-					clientsMutex_chat.Unlock()
-					break
-				}
-				fmt.Println("Notification sent to", client.Email)
+				return client.GroupID == msg.GroupID
 			}
-		}
-		clientsMutex_chat.RUnlock()
-	}
+			return containsEmail(b.Members, client.Email)
+		}, func(client *Client) []byte {
+			if client.GroupID != primitive.NilObjectID {
+				return rawMessage
+			}
+			return notification
+		})
+	})
 }
 
 func GroupCreationBroadcaster() {
-	for {
-		notification := <-broadcastNewGroup
-
-		clientsMutex_chat.RLock()
-		for conn, client := range clients {
-			if client.Email == notification.ReceiverEM {
-				err := conn.WriteJSON(map[string]interface{}{
-					"type": "new_group_created",
-					"group": map[string]interface{}{
-						"id":              notification.Group.ID.Hex(),
-						"name":            notification.Group.Name,
-						"members":         notification.Group.Members,
-						"product_id":      notification.Group.ProductID,
-						"cover_image":     notification.Group.CoverImage,
-						"created_at":      notification.Group.CreatedAt,
-						"last_message_at": notification.Group.LastMessageAt,
-						"read_status":     notification.Group.ReadStatus,
-					},
-				})
-				if err != nil {
-					fmt.Println("Error sending new group to", client.Email, ":", err)
-					conn.Close()
-					clientsMutex_chat.RUnlock()
-					clientsMutex_chat.Lock()
-					delete(clients, conn)
-					clientsMutex_chat.Unlock()
-					break
-				}
-				fmt.Println("New group notification sent to", client.Email)
-			}
+	subscribeEvents(groupCreatedTopic, func(payload []byte) {
+		var notification NewGroupNotification
+		if err := json.Unmarshal(payload, &notification); err != nil {
+			fmt.Println("Invalid group created event:", err)
+			return
+		}
+
+		message, err := encodeEnvelope(models.SocketEventGroupCreated, "", notification.Group)
+		if err != nil {
+			fmt.Println("Failed to encode group created event:", err)
+			return
 		}
-		clientsMutex_chat.RUnlock()
+
+		deliverToClients(func(client *Client) bool {
+			return client.Email == notification.ReceiverEM
+		}, func(*Client) []byte {
+			return message
+		})
+	})
+}
+
+func handleUserDisconnect(payload []byte) {
+	var event UserDisconnectEvent
+	if err := json.Unmarshal(payload, &event); err != nil || event.Email == "" {
+		fmt.Println("Invalid user disconnect event:", err)
+		return
 	}
+	closeLocalUserSockets(event.Email)
+}
+
+func UserDisconnectBroadcaster() {
+	subscribeEvents(userDisconnectTopic, handleUserDisconnect)
 }
@@ -0,0 +1,230 @@
+package controllers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	socketWriteWait  = 10 * time.Second
+	socketPongWait   = 60 * time.Second
+	socketPingPeriod = (socketPongWait * 9) / 10
+	socketMaxMessage = 64 * 1024
+	// client ที่ค้างเกินจำนวนนี้ถือว่าช้าเกินไปและจะถูกตัดการเชื่อมต่อ
+	socketSendBuffer = 256
+)
+
+// แต่ละ connection มีคิวส่งและ goroutine เขียนของตัวเอง
+// ผู้ broadcast จึงไม่ต้องรอ client ที่ช้า
+type Client struct {
+	ID      string
+	Conn    *websocket.Conn
+	Email   string
+	GroupID primitive.ObjectID
+
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// ระหว่าง replay ข้อความที่พลาดไป event สดจะถูกพักไว้ใน held ก่อน
+	mu      sync.Mutex
+	holding bool
+	held    [][]byte
+}
+
+var clients = make(map[*websocket.Conn]*Client)
+var clientsMutex_chat = sync.RWMutex{}
+
+func newClient(conn *websocket.Conn, email string, groupID primitive.ObjectID) *Client {
+	return &Client{
+		ID:      primitive.NewObjectID().Hex(),
+		Conn:    conn,
+		Email:   email,
+		GroupID: groupID,
+		send:    make(chan []byte, socketSendBuffer),
+		done:    make(chan struct{}),
+	}
+}
+
+// ลงทะเบียน client เริ่ม write pump และตั้ง keepalive ฝั่งอ่าน
+func registerClient(client *Client) {
+	client.Conn.SetReadLimit(socketMaxMessage)
+	client.Conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	client.Conn.SetPongHandler(func(string) error {
+		return client.Conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	})
+
+	clientsMutex_chat.Lock()
+	clients[client.Conn] = client
+	clientsMutex_chat.Unlock()
+
+	go client.writePump()
+}
+
+func unregisterClient(client *Client) {
+	clientsMutex_chat.Lock()
+	delete(clients, client.Conn)
+	clientsMutex_chat.Unlock()
+	client.close()
+}
+
+// สั่งให้ write pump ส่ง close frame แล้วปิด connection เรียกซ้ำได้
+func (client *Client) close() {
+	client.closeOnce.Do(func() {
+		close(client.done)
+	})
+}
+
+// ใส่ payload ลงคิวโดยไม่บล็อก ถ้าคิวเต็มจะตัด client ทิ้ง
+func (client *Client) enqueue(payload []byte) bool {
+	client.mu.Lock()
+	if client.holding {
+		defer client.mu.Unlock()
+		if len(client.held) >= socketSendBuffer {
+			fmt.Println("Evicting slow WebSocket client:", client.Email)
+			client.close()
+			return false
+		}
+		client.held = append(client.held, payload)
+		return true
+	}
+	client.mu.Unlock()
+	return client.push(payload)
+}
+
+func (client *Client) push(payload []byte) bool {
+	select {
+	case <-client.done:
+		return false
+	default:
+	}
+
+	select {
+	case client.send <- payload:
+		return true
+	default:
+		fmt.Println("Evicting slow WebSocket client:", client.Email)
+		client.close()
+		return false
+	}
+}
+
+// ส่งแบบรอคิวว่างได้ไม่เกิน socketWriteWait ใช้ตอน replay ที่มีข้อความจำนวนมาก
+func (client *Client) pushWait(payload []byte) bool {
+	timer := time.NewTimer(socketWriteWait)
+	defer timer.Stop()
+
+	select {
+	case client.send <- payload:
+		return true
+	case <-client.done:
+		return false
+	case <-timer.C:
+		fmt.Println("Evicting slow WebSocket client:", client.Email)
+		client.close()
+		return false
+	}
+}
+
+// พัก event สดไว้จนกว่าจะเรียก resume
+func (client *Client) hold() {
+	client.mu.Lock()
+	client.holding = true
+	client.mu.Unlock()
+}
+
+// ส่ง event ที่พักไว้ตามลำดับแล้วกลับไปส่งสดตามปกติ
+// ไม่ถือ mu ระหว่างรอคิว เพื่อไม่ให้ผู้ broadcast ต้องรอ client นี้
+func (client *Client) resume() {
+	for {
+		client.mu.Lock()
+		pending := client.held
+		client.held = nil
+		if len(pending) == 0 {
+			client.holding = false
+			client.mu.Unlock()
+			return
+		}
+		client.mu.Unlock()
+
+		for _, payload := range pending {
+			if !client.pushWait(payload) {
+				client.mu.Lock()
+				client.held = nil
+				client.holding = false
+				client.mu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+func (client *Client) writePump() {
+	ticker := time.NewTicker(socketPingPeriod)
+	defer func() {
+		ticker.Stop()
+		client.Conn.Close()
+	}()
+
+	for {
+		select {
+		case payload := <-client.send:
+			client.Conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+			if err := client.Conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				fmt.Println("Error sending to", client.Email, ":", err)
+				client.close()
+				return
+			}
+		case <-ticker.C:
+			client.Conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+			if err := client.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				client.close()
+				return
+			}
+		case <-client.done:
+			client.Conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(socketWriteWait))
+			return
+		}
+	}
+}
+
+// ส่ง payload ให้ client ที่ผ่าน match โดยถือ lock แค่ตอนเลือก client
+func deliverToClients(match func(*Client) bool, payload func(*Client) []byte) {
+	clientsMutex_chat.RLock()
+	targets := make([]*Client, 0)
+	for _, client := range clients {
+		if match(client) {
+			targets = append(targets, client)
+		}
+	}
+	clientsMutex_chat.RUnlock()
+
+	for _, client := range targets {
+		if p := payload(client); p != nil {
+			client.enqueue(p)
+		}
+	}
+}
+
+// ปิดทุกการเชื่อมต่อ WebSocket ของผู้ใช้ในทุก instance เช่นเมื่อถูกระงับบัญชี
+// socket ไม่ได้ตรวจสิทธิ์ซ้ำทุก frame จึงต้องปิดผ่าน pubsub ไม่ใช่แค่ใน process นี้
+func disconnectUserSockets(email string) {
+	closeLocalUserSockets(email)
+	publishEvent(userDisconnectTopic, UserDisconnectEvent{Email: email})
+}
+
+func closeLocalUserSockets(email string) {
+	clientsMutex_chat.RLock()
+	defer clientsMutex_chat.RUnlock()
+	for _, client := range clients {
+		if client.Email == email {
+			client.close()
+		}
+	}
+}
@@ -0,0 +1,503 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// test ในไฟล์นี้ไม่ต้องใช้ MongoDB ควรรันด้วย go test -race
+
+// client ที่ไม่มี connection และไม่มี write pump ใช้ทดสอบคิวโดยตรง
+func newQueueClient() *Client {
+	return newClient(nil, "queue@example.com", primitive.NewObjectID())
+}
+
+func isClosed(client *Client) bool {
+	select {
+	case <-client.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// อ่านคิวส่งของ client จนได้ n รายการ
+func drainSend(t *testing.T, client *Client, n int) []string {
+	t.Helper()
+	got := make([]string, 0, n)
+	timeout := time.After(10 * time.Second)
+	for len(got) < n {
+		select {
+		case payload := <-client.send:
+			got = append(got, string(payload))
+		case <-timeout:
+			t.Fatalf("received %d of %d payloads", len(got), n)
+		}
+	}
+	return got
+}
+
+func TestEnqueueEvictsSlowClient(t *testing.T) {
+	client := newQueueClient()
+	for i := 0; i < socketSendBuffer; i++ {
+		if !client.enqueue([]byte("x")) {
+			t.Fatalf("enqueue %d failed before the buffer was full", i)
+		}
+	}
+	if client.enqueue([]byte("overflow")) {
+		t.Fatal("enqueue succeeded on a full buffer")
+	}
+	if !isClosed(client) {
+		t.Fatal("slow client was not closed")
+	}
+	if client.enqueue([]byte("after close")) {
+		t.Fatal("enqueue succeeded after close")
+	}
+}
+
+func TestHeldQueueEvictsSlowClient(t *testing.T) {
+	client := newQueueClient()
+	client.hold()
+	for i := 0; i < socketSendBuffer; i++ {
+		if !client.enqueue([]byte("x")) {
+			t.Fatalf("enqueue %d failed before the held queue was full", i)
+		}
+	}
+	if client.enqueue([]byte("overflow")) {
+		t.Fatal("enqueue succeeded on a full held queue")
+	}
+	if !isClosed(client) {
+		t.Fatal("slow held client was not closed")
+	}
+}
+
+func waitQueueBelow(client *Client, n int) {
+	for {
+		client.mu.Lock()
+		queued := len(client.held) + len(client.send)
+		client.mu.Unlock()
+		if queued < n {
+			return
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+}
+
+// event สดที่เข้ามาระหว่าง resume ต้องต่อท้าย event ที่พักไว้ ไม่แซงและไม่หาย
+func TestResumeKeepsOrderWithConcurrentEnqueue(t *testing.T) {
+	const held, live = 200, 2000
+	client := newQueueClient()
+	client.hold()
+	for i := 0; i < held; i++ {
+		client.enqueue([]byte(strconv.Itoa(i)))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		client.resume()
+	}()
+	go func() {
+		defer wg.Done()
+		for i := held; i < held+live; i++ {
+			// รอให้ผู้อ่านตามทัน จะได้ไม่ถูกตัดเพราะคิวเต็ม
+			waitQueueBelow(client, socketSendBuffer/2)
+			if !client.enqueue([]byte(strconv.Itoa(i))) {
+				t.Errorf("enqueue %d failed", i)
+				return
+			}
+		}
+	}()
+
+	got := drainSend(t, client, held+live)
+	wg.Wait()
+
+	for i, payload := range got {
+		if payload != strconv.Itoa(i) {
+			t.Fatalf("payload %d = %s, want %d", i, payload, i)
+		}
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.holding || len(client.held) != 0 {
+		t.Fatalf("client still holding %d payloads after resume", len(client.held))
+	}
+}
+
+// client ถูกปิดระหว่าง resume รออยู่ใน pushWait ต้องคืนทันทีและเลิกพัก event
+func TestResumeStopsWhenClientCloses(t *testing.T) {
+	client := newQueueClient()
+	for i := 0; i < socketSendBuffer; i++ {
+		client.push([]byte("fill"))
+	}
+	client.hold()
+	for i := 0; i < 10; i++ {
+		client.enqueue([]byte("held"))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		client.resume()
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	client.close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("resume did not return after close")
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.holding || client.held != nil {
+		t.Fatal("client still holding after close")
+	}
+}
+
+func TestPushWaitReturnsWhenClosed(t *testing.T) {
+	client := newQueueClient()
+	for i := 0; i < socketSendBuffer; i++ {
+		client.push([]byte("fill"))
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		client.close()
+	}()
+	if client.pushWait([]byte("x")) {
+		t.Fatal("pushWait succeeded on a closed full client")
+	}
+}
+
+// enqueue, hold/resume และ close จากหลาย goroutine พร้อมกันต้องไม่ race หรือ panic
+func TestEnqueueCloseRace(t *testing.T) {
+	for round := 0; round < 50; round++ {
+		client := newQueueClient()
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+
+		// ผู้อ่านคิว แทน write pump
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-client.send:
+				case <-stop:
+					return
+				}
+			}
+		}()
+
+		var senders sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			senders.Add(1)
+			go func() {
+				defer senders.Done()
+				for i := 0; i < 100; i++ {
+					client.enqueue([]byte("x"))
+				}
+			}()
+		}
+		senders.Add(2)
+		go func() {
+			defer senders.Done()
+			client.hold()
+			client.resume()
+		}()
+		go func() {
+			defer senders.Done()
+			time.Sleep(time.Duration(round%5) * time.Millisecond)
+			client.close()
+			client.close()
+		}()
+
+		senders.Wait()
+		close(stop)
+		wg.Wait()
+
+		if !isClosed(client) {
+			t.Fatal("client not closed")
+		}
+	}
+}
+
+// server ทดสอบที่ลงทะเบียน client เหมือน handler จริง กลุ่มมาจาก ?group=
+func newHubServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		groupID, err := primitive.ObjectIDFromHex(r.URL.Query().Get("group"))
+		if err != nil {
+			http.Error(w, "bad group", http.StatusBadRequest)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := newClient(conn, r.URL.Query().Get("email"), groupID)
+		registerClient(client)
+		defer unregisterClient(client)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func registeredClients() int {
+	clientsMutex_chat.RLock()
+	defer clientsMutex_chat.RUnlock()
+	return len(clients)
+}
+
+func waitForClients(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for registeredClients() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("registered clients = %d, want %d", registeredClients(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// client หลายร้อยตัวในหลายกลุ่ม ผู้ broadcast หลายคนส่งพร้อมกัน
+// ทุก client ต้องได้ข้อความของกลุ่มตัวเองครบ ตามลำดับของผู้ส่งแต่ละคน และไม่ได้ของกลุ่มอื่น
+func TestHubBroadcastToManyClients(t *testing.T) {
+	const (
+		numGroups   = 4
+		perGroup    = 75
+		senders     = 4
+		perSender   = 25
+		perClient   = senders * perSender
+		totalClient = numGroups * perGroup
+	)
+	before := registeredClients()
+	server := newHubServer(t)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	groups := make([]primitive.ObjectID, numGroups)
+	for i := range groups {
+		groups[i] = primitive.NewObjectID()
+	}
+
+	type conn struct {
+		ws    *websocket.Conn
+		group int
+	}
+	conns := make([]conn, 0, totalClient)
+	var connsMu sync.Mutex
+	var dialers sync.WaitGroup
+	for g := range groups {
+		for i := 0; i < perGroup; i++ {
+			dialers.Add(1)
+			go func(g, i int) {
+				defer dialers.Done()
+				ws, _, err := websocket.DefaultDialer.Dial(
+					fmt.Sprintf("%s/?group=%s&email=user%d-%d@example.com", wsURL, groups[g].Hex(), g, i), nil)
+				if err != nil {
+					t.Error("dial:", err)
+					return
+				}
+				connsMu.Lock()
+				conns = append(conns, conn{ws: ws, group: g})
+				connsMu.Unlock()
+			}(g, i)
+		}
+	}
+	dialers.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+	waitForClients(t, before+totalClient)
+
+	var readers sync.WaitGroup
+	for _, c := range conns {
+		readers.Add(1)
+		go func(c conn) {
+			defer readers.Done()
+			next := make([]int, senders)
+			c.ws.SetReadDeadline(time.Now().Add(20 * time.Second))
+			for received := 0; received < perClient; received++ {
+				_, data, err := c.ws.ReadMessage()
+				if err != nil {
+					t.Errorf("group %d: read after %d messages: %v", c.group, received, err)
+					return
+				}
+				var g, s, n int
+				if _, err := fmt.Sscanf(string(data), "%d/%d/%d", &g, &s, &n); err != nil {
+					t.Errorf("bad payload %q", data)
+					return
+				}
+				if g != c.group {
+					t.Errorf("client in group %d received message for group %d", c.group, g)
+					return
+				}
+				if n != next[s] {
+					t.Errorf("group %d sender %d: got message %d, want %d", g, s, n, next[s])
+					return
+				}
+				next[s]++
+			}
+		}(c)
+	}
+
+	var broadcasters sync.WaitGroup
+	for s := 0; s < senders; s++ {
+		broadcasters.Add(1)
+		go func(s int) {
+			defer broadcasters.Done()
+			for n := 0; n < perSender; n++ {
+				for g, groupID := range groups {
+					payload := []byte(fmt.Sprintf("%d/%d/%d", g, s, n))
+					deliverToClients(func(client *Client) bool {
+						return client.GroupID == groupID
+					}, func(*Client) []byte {
+						return payload
+					})
+				}
+			}
+		}(s)
+	}
+	broadcasters.Wait()
+	readers.Wait()
+
+	// ปิดฝั่ง client ทั้งหมดพร้อมกัน hub ต้องถอนทะเบียนครบ
+	for _, c := range conns {
+		go c.ws.Close()
+	}
+	waitForClients(t, before)
+}
+
+// ตัดการเชื่อมต่อของผู้ใช้ระหว่างที่ยังมีการ broadcast อยู่ ต้องไม่ race และผู้ใช้อื่นยังต่ออยู่
+func TestDisconnectUserSocketsDuringBroadcast(t *testing.T) {
+	before := registeredClients()
+	server := newHubServer(t)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	groupID := primitive.NewObjectID()
+
+	const perUser = 50
+	var conns []*websocket.Conn
+	for _, email := range []string{"kicked@example.com", "stays@example.com"} {
+		for i := 0; i < perUser; i++ {
+			ws, _, err := websocket.DefaultDialer.Dial(wsURL+"/?group="+groupID.Hex()+"&email="+email, nil)
+			if err != nil {
+				t.Fatal("dial:", err)
+			}
+			conns = append(conns, ws)
+		}
+	}
+	waitForClients(t, before+2*perUser)
+
+	// client ฝั่งทดสอบต้องอ่านไว้ตลอด ไม่งั้น close frame จะไม่ถูกประมวลผล
+	for _, ws := range conns {
+		go func(ws *websocket.Conn) {
+			for {
+				if _, _, err := ws.ReadMessage(); err != nil {
+					ws.Close()
+					return
+				}
+			}
+		}(ws)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			deliverToClients(func(client *Client) bool {
+				return client.GroupID == groupID
+			}, func(*Client) []byte {
+				return []byte("ping")
+			})
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	closeLocalUserSockets("kicked@example.com")
+	waitForClients(t, before+perUser)
+	close(stop)
+	wg.Wait()
+
+	clientsMutex_chat.RLock()
+	for _, client := range clients {
+		if client.Email == "kicked@example.com" {
+			t.Error("disconnected user still registered")
+		}
+	}
+	clientsMutex_chat.RUnlock()
+
+	for _, ws := range conns {
+		ws.Close()
+	}
+	waitForClients(t, before)
+}
+
+// event ที่มาจาก instance อื่นผ่าน pubsub ต้องปิด socket ของผู้ใช้ใน instance นี้ด้วย
+func TestUserDisconnectEventClosesLocalSockets(t *testing.T) {
+	before := registeredClients()
+	server := newHubServer(t)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	groupID := primitive.NewObjectID()
+
+	var conns []*websocket.Conn
+	for _, email := range []string{"kicked@example.com", "stays@example.com"} {
+		ws, _, err := websocket.DefaultDialer.Dial(wsURL+"/?group="+groupID.Hex()+"&email="+email, nil)
+		if err != nil {
+			t.Fatal("dial:", err)
+		}
+		conns = append(conns, ws)
+		go func(ws *websocket.Conn) {
+			for {
+				if _, _, err := ws.ReadMessage(); err != nil {
+					ws.Close()
+					return
+				}
+			}
+		}(ws)
+	}
+	waitForClients(t, before+2)
+
+	payload, err := json.Marshal(UserDisconnectEvent{Email: "kicked@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handleUserDisconnect(payload)
+	waitForClients(t, before+1)
+
+	clientsMutex_chat.RLock()
+	for _, client := range clients {
+		if client.Email == "kicked@example.com" {
+			t.Error("disconnected user still registered")
+		}
+	}
+	clientsMutex_chat.RUnlock()
+
+	for _, ws := range conns {
+		ws.Close()
+	}
+	waitForClients(t, before)
+}
@@ -0,0 +1,245 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	groupEventTopic      = "chat.group_event"
+	maxChatMessageLength = 4000
+	maxClientIDLength    = 64
+)
+
+// event อื่นนอกจากข้อความที่ส่งถึงทุก socket ในห้องแชทของกลุ่ม เช่น typing หรือสถานะการซื้อขาย
+type GroupEvent struct {
+	GroupID  primitive.ObjectID    `json:"group_id"`
+	SenderID string                `json:"sender_id,omitempty"`
+	Event    models.SocketEnvelope `json:"event"`
+}
+
+func newEnvelope(eventType models.SocketEventType, id string, payload interface{}) (models.SocketEnvelope, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return models.SocketEnvelope{}, err
+	}
+	return models.SocketEnvelope{
+		Version: models.SocketProtocolVersion,
+		Type:    eventType,
+		ID:      id,
+		Payload: raw,
+	}, nil
+}
+
+func encodeEnvelope(eventType models.SocketEventType, id string, payload interface{}) ([]byte, error) {
+	envelope, err := newEnvelope(eventType, id, payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope)
+}
+
+func (client *Client) sendEvent(eventType models.SocketEventType, id string, payload interface{}) {
+	frame, err := encodeEnvelope(eventType, id, payload)
+	if err != nil {
+		fmt.Println("Failed to encode", eventType, "event:", err)
+		return
+	}
+	client.enqueue(frame)
+}
+
+func (client *Client) sendError(id, code, message string) {
+	client.sendEvent(models.SocketEventError, id, models.SocketErrorPayload{Code: code, Message: message})
+}
+
+// อ่าน frame จาก client ในห้องแชทแล้วส่งต่อตามชนิดของ event
+func handleChatFrame(client *Client, group models.Group, data []byte) {
+	var envelope models.SocketEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		client.sendError("", "invalid_frame", "Invalid frame")
+		return
+	}
+	if envelope.Version != models.SocketProtocolVersion {
+		client.sendError(envelope.ID, "unsupported_version", "Unsupported protocol version")
+		return
+	}
+	if len(envelope.ID) > maxClientIDLength {
+		client.sendError("", "invalid_frame", "Client ID too long")
+		return
+	}
+
+	switch envelope.Type {
+	case models.SocketEventMessage:
+		handleSendMessage(client, group, envelope)
+	case models.SocketEventTyping:
+		handleTyping(client, group, envelope)
+	case models.SocketEventReadReceipt:
+		handleReadReceipt(client, group, envelope)
+	default:
+		client.sendError(envelope.ID, "unknown_type", "Unknown event type")
+	}
+}
+
+func handleSendMessage(client *Client, group models.Group, envelope models.SocketEnvelope) {
+	var payload models.SendMessagePayload
+	if err := json.Unmarshal(envelope.Payload, &payload); err != nil {
+		client.sendError(envelope.ID, "invalid_payload", "Invalid message payload")
+		return
+	}
+	content := strings.TrimSpace(payload.Content)
+	if content == "" && payload.AttachmentID == "" {
+		client.sendError(envelope.ID, "invalid_payload", "ข้อความว่างเปล่า")
+		return
+	}
+	if utf8.RuneCountInString(content) > maxChatMessageLength {
+		client.sendError(envelope.ID, "message_too_long", "ข้อความยาวเกินไป")
+		return
+	}
+
+	// ผู้ส่งคือผู้ใช้ที่ยืนยันตัวตนแล้วเสมอ ไม่เชื่อค่าที่ client ส่งมา
+	msg := models.Message{
+		ID:          primitive.NewObjectID(),
+		GroupID:     group.ID,
+		SenderEmail: client.Email,
+		Content:     content,
+		Timestamp:   time.Now().Format(time.RFC3339),
+		ClientID:    envelope.ID,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// ส่งซ้ำด้วย id เดิม ตอบ ack ของข้อความเดิมก่อนจะไปแตะไฟล์แนบที่ถูกใช้ไปแล้ว
+	if msg.ClientID != "" {
+		if existing, err := findMessageByClientID(ctx, group.ID, client.Email, msg.ClientID); err == nil {
+			client.sendEvent(models.SocketEventAck, envelope.ID, models.AckPayload{
+				MessageID: existing.ID,
+				Timestamp: existing.Timestamp,
+				Duplicate: true,
+			})
+			return
+		}
+	}
+
+	if payload.AttachmentID != "" {
+		attachment, err := claimChatAttachment(ctx, group.ID, client.Email, payload.AttachmentID, msg.ID)
+		if err != nil {
+			client.sendError(envelope.ID, "invalid_attachment", "ไม่พบไฟล์แนบหรือไฟล์ถูกใช้ไปแล้ว")
+			return
+		}
+		msg.Attachment = attachment.Summary()
+	}
+
+	saved, duplicate, err := saveChatMessage(ctx, msg)
+	if err != nil || duplicate {
+		if msg.Attachment != nil {
+			releaseChatAttachment(ctx, msg.Attachment.ID, msg.ID)
+		}
+	}
+	if err != nil {
+		fmt.Println("Error saving message to DB:", err)
+		client.sendError(envelope.ID, "internal", "ไม่สามารถส่งข้อความได้")
+		return
+	}
+
+	client.sendEvent(models.SocketEventAck, envelope.ID, models.AckPayload{
+		MessageID: saved.ID,
+		Timestamp: saved.Timestamp,
+		Duplicate: duplicate,
+	})
+	if duplicate {
+		return
+	}
+
+	publishEvent(chatMessageTopic, BroadcastMessage{
+		Message:  saved,
+		SenderID: client.ID,
+		Members:  group.Members,
+	})
+}
+
+func handleTyping(client *Client, group models.Group, envelope models.SocketEnvelope) {
+	var payload models.TypingPayload
+	if err := json.Unmarshal(envelope.Payload, &payload); err != nil {
+		client.sendError(envelope.ID, "invalid_payload", "Invalid typing payload")
+		return
+	}
+
+	publishGroupEvent(group.ID, client.ID, models.SocketEventTyping, models.TypingPayload{
+		GroupID: group.ID,
+		Email:   client.Email,
+		Typing:  payload.Typing,
+	})
+}
+
+func publishGroupEvent(groupID primitive.ObjectID, senderID string, eventType models.SocketEventType, payload interface{}) {
+	envelope, err := newEnvelope(eventType, "", payload)
+	if err != nil {
+		fmt.Println("Failed to encode", eventType, "event:", err)
+		return
+	}
+	publishEvent(groupEventTopic, GroupEvent{GroupID: groupID, SenderID: senderID, Event: envelope})
+}
+
+// แจ้งทุกคนในห้องแชทเมื่อสถานะการยืนยันหรือ escrow ของกลุ่มเปลี่ยน
+// event จะถูกบันทึกไว้ด้วยเพื่อให้ client ที่หลุดอยู่ได้รับตอนเชื่อมต่อใหม่
+func publishTradeStatus(payload models.TradeStatusPayload) {
+	payload.At = time.Now()
+
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		fmt.Println("Failed to encode trade status:", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = config.GetCollection("chat_events").InsertOne(ctx, models.ChatEvent{
+		GroupID: payload.GroupID,
+		Type:    models.SocketEventTradeStatus,
+		Payload: raw,
+		At:      payload.At,
+	})
+	if err != nil {
+		fmt.Println("Failed to store trade status event:", err)
+	}
+
+	publishEvent(groupEventTopic, GroupEvent{
+		GroupID: payload.GroupID,
+		Event: models.SocketEnvelope{
+			Version: models.SocketProtocolVersion,
+			Type:    models.SocketEventTradeStatus,
+			Payload: raw,
+		},
+	})
+}
+
+func GroupEventBroadcaster() {
+	subscribeEvents(groupEventTopic, func(payload []byte) {
+		var event GroupEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			fmt.Println("Invalid group event:", err)
+			return
+		}
+
+		frame, err := json.Marshal(event.Event)
+		if err != nil {
+			fmt.Println("Failed to encode group event:", err)
+			return
+		}
+
+		deliverToClients(func(client *Client) bool {
+			return client.GroupID == event.GroupID && client.ID != event.SenderID
+		}, func(*Client) []byte {
+			return frame
+		})
+	})
+}
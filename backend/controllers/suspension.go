@@ -0,0 +1,215 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ระงับบัญชีผู้ใช้ duration เป็น 0 หมายถึงระงับถาวร
+func suspendUser(ctx context.Context, email, reason string, duration time.Duration, by string, reportID *primitive.ObjectID) (models.Suspension, error) {
+	now := time.Now()
+	suspension := models.Suspension{Reason: reason, By: by, At: now, ReportID: reportID}
+	if duration > 0 {
+		until := now.Add(duration)
+		suspension.Until = &until
+	}
+
+	result, err := config.GetCollection("users").UpdateOne(ctx,
+		bson.M{"email": email},
+		bson.M{"$set": bson.M{"suspension": suspension}},
+	)
+	if err != nil {
+		return suspension, err
+	}
+	if result.MatchedCount == 0 {
+		return suspension, mongo.ErrNoDocuments
+	}
+	if err := markSellerListings(ctx, email, &suspension); err != nil {
+		return suspension, err
+	}
+
+	// ตัดการเชื่อมต่อแชทที่เปิดค้างอยู่
+	disconnectUserSockets(email)
+	return suspension, nil
+}
+
+// ห้ามระงับบัญชีตัวเอง และเฉพาะ admin เท่านั้นที่ระงับ admin ด้วยกันได้
+func checkSuspendTarget(c *gin.Context, user models.User) (int, string) {
+	if user.Email == c.GetString("email") {
+		return http.StatusConflict, "ไม่สามารถระงับบัญชีของตัวเองได้"
+	}
+	if user.EffectiveRole() == models.RoleAdmin && models.Role(c.GetString("role")) != models.RoleAdmin {
+		return http.StatusForbidden, "Forbidden"
+	}
+	return http.StatusOK, ""
+}
+
+// การตรวจสถานะระงับต่อ request อยู่ที่ middleware.lookupSuspension ที่เดียว
+// ส่วนเงื่อนไขว่ายังระงับอยู่หรือไม่คือ models.User.ActiveSuspension
+func respondSuspended(c *gin.Context, suspension *models.Suspension) {
+	c.JSON(http.StatusForbidden, gin.H{"error": "บัญชีของคุณถูกระงับการใช้งาน", "suspension": suspension})
+}
+
+// คัดลอกสถานะการระงับไปที่ประกาศของผู้ขาย suspension เป็น nil คือยกเลิกการระงับ
+func markSellerListings(ctx context.Context, email string, suspension *models.Suspension) error {
+	update := bson.M{"$unset": bson.M{"sellerSuspended": "", "sellerSuspendedUntil": ""}}
+	if suspension != nil {
+		update = bson.M{"$set": bson.M{"sellerSuspended": true}}
+		if suspension.Until != nil {
+			update["$set"].(bson.M)["sellerSuspendedUntil"] = *suspension.Until
+		} else {
+			update["$unset"] = bson.M{"sellerSuspendedUntil": ""}
+		}
+	}
+	_, err := config.GetCollection("listings").UpdateMany(ctx, bson.M{"userEmail": email}, update)
+	return err
+}
+
+// เงื่อนไขซ่อนประกาศของผู้ขายที่ยังถูกระงับอยู่ การระงับแบบมีกำหนดจะหมดผลเองเมื่อถึงเวลา
+func hideSuspendedSellersFilter(now time.Time) []bson.M {
+	return []bson.M{{
+		"sellerSuspended":      true,
+		"sellerSuspendedUntil": bson.M{"$not": bson.M{"$lte": now}},
+	}}
+}
+
+// ตั้งค่าสถานะการระงับบนประกาศให้ตรงกับผู้ใช้ที่ถูกระงับอยู่ตอนเริ่มระบบ
+// สำหรับข้อมูลที่ระงับไว้ก่อนมีการคัดลอกสถานะไปที่ประกาศ
+func SyncSellerSuspensions() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	cursor, err := config.GetCollection("users").Find(ctx, bson.M{
+		"suspension": bson.M{"$exists": true},
+		"$or": []bson.M{
+			{"suspension.until": nil},
+			{"suspension.until": bson.M{"$gt": time.Now()}},
+		},
+	}, options.Find().SetProjection(bson.M{"email": 1, "suspension": 1}))
+	if err != nil {
+		log.Println("Failed to load suspended users:", err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var user models.User
+		if err := cursor.Decode(&user); err != nil {
+			log.Println("Failed to decode suspended user:", err)
+			continue
+		}
+		if err := markSellerListings(ctx, user.Email, user.Suspension); err != nil {
+			log.Println("Failed to mark listings of suspended seller", user.Email, ":", err)
+		}
+	}
+}
+
+func SuspendUserHandler(c *gin.Context) {
+	userID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var input struct {
+		Reason        string `json:"reason"`
+		DurationHours int    `json:"durationHours"` // 0 = ระงับถาวร
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || strings.TrimSpace(input.Reason) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ต้องระบุเหตุผล"})
+		return
+	}
+	if input.DurationHours < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid duration"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user models.User
+	if err := config.GetCollection("users").FindOne(ctx, bson.M{"_id": userID}).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if status, msg := checkSuspendTarget(c, user); status != http.StatusOK {
+		c.JSON(status, gin.H{"error": msg})
+		return
+	}
+
+	suspension, err := suspendUser(ctx, user.Email, strings.TrimSpace(input.Reason),
+		time.Duration(input.DurationHours)*time.Hour, c.GetString("email"), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to suspend user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User suspended", "email": user.Email, "suspension": suspension})
+}
+
+func UnsuspendUserHandler(c *gin.Context) {
+	userID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// moderator ยกเลิกการระงับ admin ไม่ได้ เช่นเดียวกับตอนระงับ
+	var user models.User
+	if err := config.GetCollection("users").FindOne(ctx, bson.M{"_id": userID}).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if status, msg := checkSuspendTarget(c, user); status != http.StatusOK {
+		c.JSON(status, gin.H{"error": msg})
+		return
+	}
+	// การระงับที่ admin เป็นคนสั่ง ให้ admin เท่านั้นที่ยกเลิกได้
+	if user.Suspension != nil && models.Role(c.GetString("role")) != models.RoleAdmin {
+		var by models.User
+		err := config.GetCollection("users").FindOne(ctx, bson.M{"email": user.Suspension.By}).Decode(&by)
+		if err != nil && err != mongo.ErrNoDocuments {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load suspension"})
+			return
+		}
+		if err == nil && by.EffectiveRole() == models.RoleAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			return
+		}
+	}
+
+	err = config.GetCollection("users").FindOneAndUpdate(ctx,
+		bson.M{"_id": userID},
+		bson.M{"$unset": bson.M{"suspension": ""}},
+		options.FindOneAndUpdate().SetProjection(bson.M{"email": 1}),
+	).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to lift suspension"})
+		return
+	}
+	if err := markSellerListings(ctx, user.Email, nil); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore listings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Suspension lifted"})
+}
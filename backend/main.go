@@ -4,6 +4,7 @@ import (
 	"go-auth-mongo/config"
 	"go-auth-mongo/controllers"
 	"go-auth-mongo/routes"
+	"go-auth-mongo/utils"
 	"log"
 	"os"
 	"strings"
@@ -25,8 +26,19 @@ func main() {
 		env = "development"
 	}
 
+	if err := utils.LoadEncryptionKeys(); err != nil {
+		log.Fatal("Failed to load encryption keys: ", err)
+	}
+	log.Println("Encryption keys loaded, primary key:", utils.PrimaryKeyID())
+
 	config.ConnectDB()
+	config.EnsureIndexes()
+	controllers.SeedAdminRoles()
+	controllers.MigrateLegacyListingStatuses()
+	controllers.SyncSellerSuspensions()
+	controllers.MigrateGroupLastMessageAt()
 	config.InitS3Client()
+	config.InitPubSub()
 
 	if env == "production" {
 		gin.SetMode(gin.ReleaseMode)
@@ -34,6 +46,15 @@ func main() {
 
 	r := gin.Default()
 
+	// เชื่อ X-Forwarded-For เฉพาะจาก proxy ที่กำหนด ไม่อย่างนั้นใครก็ปลอม IP ใน log ได้
+	trustedProxies := getTrustedProxies()
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES: ", err)
+	}
+	if trustedProxies == nil {
+		log.Println("TRUSTED_PROXIES not set - client IP is taken from the direct connection")
+	}
+
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     getAllowedOrigins(),
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
@@ -47,6 +68,11 @@ func main() {
 
 	go controllers.Broadcaster()
 	go controllers.GroupCreationBroadcaster()
+	go controllers.GroupEventBroadcaster()
+	go controllers.UserDisconnectBroadcaster()
+	go controllers.EscrowTimeoutWatcher()
+	go controllers.RefundReconciler(controllers.NewOmiseRefundGateway())
+	go controllers.ChatAttachmentSweeper()
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -68,3 +94,18 @@ func getAllowedOrigins() []string {
 	}
 	return []string{"https://goosenest.onrender.com"}
 }
+
+// TRUSTED_PROXIES="10.0.0.0/8,192.168.1.10" IP หรือ CIDR ของ load balancer หน้า backend
+func getTrustedProxies() []string {
+	raw := os.Getenv("TRUSTED_PROXIES")
+	if raw == "" {
+		return nil
+	}
+	var proxies []string
+	for _, p := range strings.Split(raw, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			proxies = append(proxies, p)
+		}
+	}
+	return proxies
+}
@@ -1,14 +1,23 @@
 package middleware
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func JWTAuthMiddleware() gin.HandlerFunc {
@@ -24,30 +33,117 @@ func JWTAuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return []byte(os.Getenv("JWT_SECRET")), nil
-		})
+		authenticate(c, strings.TrimPrefix(authHeader, "Bearer "))
+	}
+}
 
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token", "details": err.Error()})
-			c.Abort()
-			return
-		}
+// subprotocol ที่ใช้ส่ง token ตอนเปิด WebSocket: new WebSocket(url, ["goosenest.jwt", token])
+const WebSocketTokenProtocol = "goosenest.jwt"
+
+// ตรวจ JWT ของ WebSocket ก่อน upgrade เพราะเบราว์เซอร์ตั้ง Authorization header เองไม่ได้
+// รับ token จาก query ?token= หรือจาก Sec-WebSocket-Protocol
+func WebSocketAuthMiddleware() gin.HandlerFunc {
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found - using environment variables from system")
+	}
 
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			email, ok := claims["email"].(string)
-			if !ok || email == "" {
-				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
-				c.Abort()
-				return
+	return func(c *gin.Context) {
+		tokenString := c.Query("token")
+		if tokenString == "" {
+			protocols := websocketProtocols(c.GetHeader("Sec-WebSocket-Protocol"))
+			for i, p := range protocols {
+				if p == WebSocketTokenProtocol && i+1 < len(protocols) {
+					tokenString = protocols[i+1]
+					c.Set("wsSubprotocol", WebSocketTokenProtocol)
+					break
+				}
 			}
-			c.Set("email", email)
-			c.Next()
-		} else {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		}
+		if tokenString == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 			c.Abort()
 			return
 		}
+
+		authenticate(c, tokenString)
+	}
+}
+
+func websocketProtocols(header string) []string {
+	var protocols []string
+	for _, p := range strings.Split(header, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			protocols = append(protocols, p)
+		}
+	}
+	return protocols
+}
+
+// ตรวจ token แล้วใส่ email/role ลงใน context ใช้ร่วมกันทั้ง HTTP และ WebSocket
+func authenticate(c *gin.Context, tokenString string) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(os.Getenv("JWT_SECRET")), nil
+	})
+
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token", "details": err.Error()})
+		c.Abort()
+		return
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		c.Abort()
+		return
+	}
+
+	email, ok := claims["email"].(string)
+	if !ok || email == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		c.Abort()
+		return
+	}
+	// ตรวจการระงับบัญชีทุก request เพื่อให้มีผลทันทีโดยไม่ต้องรอ token หมดอายุ
+	// ถ้าตรวจไม่ได้ให้ปฏิเสธไว้ก่อน ไม่ปล่อยผู้ใช้ที่อาจถูกระงับเข้ามา
+	suspension, err := lookupSuspension(email)
+	if err != nil {
+		log.Println("Failed to check suspension for", email, ":", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "ไม่สามารถตรวจสอบสถานะบัญชีได้ กรุณาลองใหม่"})
+		c.Abort()
+		return
+	}
+	if suspension != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "บัญชีของคุณถูกระงับการใช้งาน", "suspension": suspension})
+		c.Abort()
+		return
+	}
+
+	role, _ := claims["role"].(string)
+	if role == "" {
+		role = "user"
+	}
+	c.Set("email", email)
+	c.Set("role", role)
+	c.Next()
+}
+
+func lookupSuspension(email string) (*models.Suspension, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var user models.User
+	err := config.GetCollection("users").FindOne(ctx, bson.M{"email": email},
+		options.FindOne().SetProjection(bson.M{"suspension": 1}),
+	).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
+	return user.ActiveSuspension(time.Now()), nil
 }
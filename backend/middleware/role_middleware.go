@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/models"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// อนุญาตเฉพาะ role ที่กำหนด ต้องใช้ต่อจาก JWTAuthMiddleware
+// ตรวจ role ใน token ก่อน แล้วยืนยันกับฐานข้อมูลอีกครั้ง เพื่อให้การถอดสิทธิ์มีผลทันที
+func RequireRole(roles ...models.Role) gin.HandlerFunc {
+	allowed := make(map[models.Role]bool, len(roles))
+	for _, role := range roles {
+		allowed[role] = true
+	}
+
+	return func(c *gin.Context) {
+		if !allowed[models.Role(c.GetString("role"))] {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			c.Abort()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var user models.User
+		err := config.GetCollection("users").FindOne(ctx, bson.M{"email": c.GetString("email")}).Decode(&user)
+		if err != nil || !allowed[user.EffectiveRole()] {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			c.Abort()
+			return
+		}
+
+		c.Set("role", string(user.EffectiveRole()))
+		c.Next()
+	}
+}
@@ -3,18 +3,26 @@ package models
 import "go.mongodb.org/mongo-driver/bson/primitive"
 
 type Group struct {
-	ID              primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	Name            string             `bson:"name" json:"name"`
-	Members         []string           `bson:"members" json:"members"`
-	ProductID       string             `bson:"product_id" json:"product_id"`
-	CoverImage      string             `bson:"cover_image" json:"cover_image"`
-	CreatedAt       string             `bson:"created_at" json:"created_at"`
-	LastMessageAt   string             `bson:"last_message_at,omitempty" json:"last_message_at,omitempty"`
-	ReadStatus      map[string]string  `bson:"read_status,omitempty" json:"read_status,omitempty"`
-	Buyer           string             `bson:"buyer" json:"buyer"`
-	Seller          string             `bson:"seller" json:"seller"`
-	BuyerConfirmed  bool               `bson:"buyer_confirmed" json:"buyer_confirmed"`
-	SellerConfirmed bool               `bson:"seller_confirmed" json:"seller_confirmed"`
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name          string             `bson:"name" json:"name"`
+	Members       []string           `bson:"members" json:"members"`
+	ProductID     string             `bson:"product_id" json:"product_id"`
+	CoverImage    string             `bson:"cover_image" json:"cover_image"`
+	CreatedAt     string             `bson:"created_at" json:"created_at"`
+	LastMessageAt string             `bson:"last_message_at,omitempty" json:"last_message_at,omitempty"`
+	ReadStatus    map[string]string  `bson:"read_status,omitempty" json:"read_status,omitempty"`
+	// ข้อความล่าสุดที่สมาชิกแต่ละคนอ่านแล้ว key เป็นอีเมลที่ encode แบบเดียวกับ read_status
+	LastRead        map[string]ReadMarker `bson:"last_read,omitempty" json:"last_read,omitempty"`
+	Buyer           string                `bson:"buyer" json:"buyer"`
+	Seller          string                `bson:"seller" json:"seller"`
+	BuyerConfirmed  bool                  `bson:"buyer_confirmed" json:"buyer_confirmed"`
+	SellerConfirmed bool                  `bson:"seller_confirmed" json:"seller_confirmed"`
+	PaymentStatus   string                `bson:"payment_status,omitempty" json:"payment_status,omitempty"`
+}
+
+type ReadMarker struct {
+	MessageID primitive.ObjectID `bson:"message_id" json:"message_id"`
+	Timestamp string             `bson:"timestamp" json:"timestamp"`
 }
 
 type Message struct {
@@ -23,4 +31,7 @@ type Message struct {
 	SenderEmail string             `bson:"senderEmail" json:"senderEmail"`
 	Content     string             `bson:"content" json:"content"`
 	Timestamp   string             `bson:"timestamp" json:"timestamp"`
+	Attachment  *MessageAttachment `bson:"attachment,omitempty" json:"attachment,omitempty"`
+	// id ที่ client สร้างเอง ใช้กันข้อความซ้ำเมื่อ client ส่งใหม่
+	ClientID string `bson:"client_id,omitempty" json:"client_id,omitempty"`
 }
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ไฟล์ที่สมาชิกอัปโหลดเข้าแชท เก็บใน S3 แบบ private และเปิดดูผ่าน presigned URL เท่านั้น
+type ChatAttachment struct {
+	ID           primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	GroupID      primitive.ObjectID  `bson:"group_id" json:"group_id"`
+	Uploader     string              `bson:"uploader" json:"uploader"`
+	Key          string              `bson:"key" json:"-"`
+	ThumbnailKey string              `bson:"thumbnail_key,omitempty" json:"-"`
+	Name         string              `bson:"name" json:"name"`
+	ContentType  string              `bson:"content_type" json:"content_type"`
+	Size         int64               `bson:"size" json:"size"`
+	Width        int                 `bson:"width,omitempty" json:"width,omitempty"`
+	Height       int                 `bson:"height,omitempty" json:"height,omitempty"`
+	MessageID    *primitive.ObjectID `bson:"message_id,omitempty" json:"message_id,omitempty"`
+	// จองโควตาไว้ระหว่างอัปโหลดขึ้น S3 ยังใช้กับข้อความไม่ได้จนกว่าจะอัปโหลดเสร็จ
+	Uploading bool `bson:"uploading,omitempty" json:"-"`
+	// ตั้งเมื่อไฟล์ไม่ถูกส่งจนหมดเวลาและกำลังจะถูกลบ ไฟล์นี้จะผูกกับข้อความไม่ได้อีก
+	ExpiredAt *time.Time `bson:"expired_at,omitempty" json:"-"`
+	CreatedAt time.Time  `bson:"created_at" json:"created_at"`
+}
+
+// ข้อมูลไฟล์แนบที่เก็บไปกับข้อความ
+type MessageAttachment struct {
+	ID           primitive.ObjectID `bson:"id" json:"id"`
+	Name         string             `bson:"name" json:"name"`
+	ContentType  string             `bson:"content_type" json:"content_type"`
+	Size         int64              `bson:"size" json:"size"`
+	Width        int                `bson:"width,omitempty" json:"width,omitempty"`
+	Height       int                `bson:"height,omitempty" json:"height,omitempty"`
+	HasThumbnail bool               `bson:"has_thumbnail" json:"has_thumbnail"`
+}
+
+func (a ChatAttachment) Summary() *MessageAttachment {
+	return &MessageAttachment{
+		ID:           a.ID,
+		Name:         a.Name,
+		ContentType:  a.ContentType,
+		Size:         a.Size,
+		Width:        a.Width,
+		Height:       a.Height,
+		HasThumbnail: a.ThumbnailKey != "",
+	}
+}
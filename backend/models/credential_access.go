@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// บันทึกทุกครั้งที่มีการเปิดดูรหัสผ่านของ listing โค้ดในระบบ insert อย่างเดียว (ดู credentialAccessLogCollection)
+type CredentialAccessLog struct {
+	ID        primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	ListingID primitive.ObjectID  `bson:"listingId" json:"listingId"`
+	EscrowID  *primitive.ObjectID `bson:"escrowId,omitempty" json:"escrowId,omitempty"`
+	Viewer    string              `bson:"viewer" json:"viewer"`
+	Role      string              `bson:"role" json:"role"` // owner หรือ buyer
+	IP        string              `bson:"ip" json:"ip"`
+	UserAgent string              `bson:"userAgent,omitempty" json:"userAgent,omitempty"`
+	At        time.Time           `bson:"at" json:"at"`
+}
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type EscrowStatus string
+
+const (
+	EscrowPendingPayment EscrowStatus = "pending_payment"
+	EscrowPaid           EscrowStatus = "paid"
+	EscrowDelivered      EscrowStatus = "delivered"
+	EscrowAccepted       EscrowStatus = "accepted"
+	EscrowReleased       EscrowStatus = "released"
+	EscrowDisputed       EscrowStatus = "disputed"
+	// กำลังคืนเงินผ่าน gateway ห้ามปล่อยเงินระหว่างนี้
+	EscrowRefunding EscrowStatus = "refunding"
+	EscrowCancelled EscrowStatus = "cancelled"
+	EscrowRefunded  EscrowStatus = "refunded"
+)
+
+// สถานะถัดไปที่อนุญาตจากแต่ละสถานะ
+var escrowTransitions = map[EscrowStatus][]EscrowStatus{
+	EscrowPendingPayment: {EscrowPaid, EscrowCancelled},
+	EscrowPaid:           {EscrowDelivered, EscrowDisputed},
+	EscrowDelivered:      {EscrowAccepted, EscrowDisputed},
+	EscrowAccepted:       {EscrowReleased},
+	EscrowDisputed:       {EscrowReleased, EscrowRefunding},
+	EscrowRefunding:      {EscrowRefunded, EscrowDisputed},
+}
+
+func (s EscrowStatus) CanTransitionTo(next EscrowStatus) bool {
+	for _, allowed := range escrowTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+func (s EscrowStatus) IsTerminal() bool {
+	return len(escrowTransitions[s]) == 0
+}
+
+type EscrowEvent struct {
+	From EscrowStatus `bson:"from" json:"from"`
+	To   EscrowStatus `bson:"to" json:"to"`
+	By   string       `bson:"by" json:"by"`
+	Note string       `bson:"note,omitempty" json:"note,omitempty"`
+	At   time.Time    `bson:"at" json:"at"`
+}
+
+type Escrow struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	GroupID   primitive.ObjectID `bson:"groupId" json:"groupId"`
+	ListingID primitive.ObjectID `bson:"listingId" json:"listingId"`
+	Buyer     string             `bson:"buyer" json:"buyer"`
+	Seller    string             `bson:"seller" json:"seller"`
+	Amount    int64              `bson:"amount" json:"amount"` // หน่วยสตางค์
+	Currency  string             `bson:"currency" json:"currency"`
+	SourceID  string             `bson:"sourceId,omitempty" json:"sourceId,omitempty"`
+	ChargeID  string             `bson:"chargeId,omitempty" json:"chargeId,omitempty"`
+	Status    EscrowStatus       `bson:"status" json:"status"`
+	Deadline  *time.Time         `bson:"deadline,omitempty" json:"deadline,omitempty"`
+	// ผู้ซื้อเปิดดูรหัสของ listing ได้ครั้งเดียวต่อ escrow
+	CredentialsRevealedAt *time.Time    `bson:"credentialsRevealedAt,omitempty" json:"credentialsRevealedAt,omitempty"`
+	History               []EscrowEvent `bson:"history" json:"history"`
+	CreatedAt             time.Time     `bson:"createdAt" json:"createdAt"`
+	UpdatedAt             time.Time     `bson:"updatedAt" json:"updatedAt"`
+}
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type HandoverStatus string
+
+const (
+	HandoverSubmitted HandoverStatus = "submitted" // ผู้ขายส่งข้อมูลบัญชีแล้ว
+	HandoverRevealed  HandoverStatus = "revealed"  // ผู้ซื้อเปิดดูแล้ว (ดูได้ครั้งเดียว)
+	HandoverConfirmed HandoverStatus = "confirmed" // ผู้ซื้อยืนยันว่าเปลี่ยนรหัสผ่านแล้ว
+)
+
+// ข้อมูลลับที่ผู้ขายส่งมอบ เก็บเป็น JSON ที่เข้ารหัสแล้วใน Handover.Secret
+type HandoverSecrets struct {
+	Username       string   `json:"username"`
+	Password       string   `json:"password"`
+	SecondPassword string   `json:"secondPassword,omitempty"`
+	RecoveryEmail  string   `json:"recoveryEmail,omitempty"`
+	BackupCodes    []string `json:"backupCodes,omitempty"`
+}
+
+type Handover struct {
+	ID               primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	GroupID          primitive.ObjectID `bson:"groupId" json:"groupId"`
+	EscrowID         primitive.ObjectID `bson:"escrowId" json:"escrowId"`
+	ListingID        primitive.ObjectID `bson:"listingId" json:"listingId"`
+	Buyer            string             `bson:"buyer" json:"buyer"`
+	Seller           string             `bson:"seller" json:"seller"`
+	Status           HandoverStatus     `bson:"status" json:"status"`
+	Secret           string             `bson:"secret" json:"-"`
+	HasRecoveryEmail bool               `bson:"hasRecoveryEmail" json:"hasRecoveryEmail"`
+	BackupCodeCount  int                `bson:"backupCodeCount" json:"backupCodeCount"`
+	SubmittedAt      time.Time          `bson:"submittedAt" json:"submittedAt"`
+	RevealedAt       *time.Time         `bson:"revealedAt,omitempty" json:"revealedAt,omitempty"`
+	ConfirmedAt      *time.Time         `bson:"confirmedAt,omitempty" json:"confirmedAt,omitempty"`
+	CreatedAt        time.Time          `bson:"createdAt" json:"createdAt"`
+	UpdatedAt        time.Time          `bson:"updatedAt" json:"updatedAt"`
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// รายการบัญชีคู่ ทุก transaction (TxnID เดียวกัน) ต้องมียอด debit เท่ากับ credit
+type LedgerEntry struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	TxnID         primitive.ObjectID `bson:"txnId" json:"txnId"`
+	Kind          string             `bson:"kind" json:"kind"`
+	Account       string             `bson:"account" json:"account"`
+	Debit         int64              `bson:"debit" json:"debit"`   // หน่วยสตางค์
+	Credit        int64              `bson:"credit" json:"credit"` // หน่วยสตางค์
+	EscrowID      primitive.ObjectID `bson:"escrowId,omitempty" json:"escrowId,omitempty"`
+	PayoutBatchID primitive.ObjectID `bson:"payoutBatchId,omitempty" json:"payoutBatchId,omitempty"`
+	Memo          string             `bson:"memo,omitempty" json:"memo,omitempty"`
+	CreatedAt     time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+type PayoutItem struct {
+	Seller        string             `bson:"seller" json:"seller"`
+	Amount        int64              `bson:"amount" json:"amount"`
+	BankAccountID primitive.ObjectID `bson:"bankAccountId" json:"bankAccountId"`
+	Type          string             `bson:"type" json:"type"` // 'bank' หรือ 'promptpay'
+	BankName      string             `bson:"bankName" json:"bankName"`
+	AccountNo     string             `bson:"accountNo" json:"accountNo"`
+	AccountName   string             `bson:"accountName" json:"accountName"`
+}
+
+type PayoutBatch struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Items     []PayoutItem       `bson:"items" json:"items"`
+	Total     int64              `bson:"total" json:"total"`
+	CreatedBy string             `bson:"createdBy" json:"createdBy"`
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+}
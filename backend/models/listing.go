@@ -6,6 +6,55 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+type ListingStatus string
+
+const (
+	ListingDraft    ListingStatus = "draft"
+	ListingActive   ListingStatus = "active"
+	ListingReserved ListingStatus = "reserved"
+	ListingSold     ListingStatus = "sold"
+	ListingHidden   ListingStatus = "hidden"
+	ListingRemoved  ListingStatus = "removed"
+)
+
+// reserved และ sold ถูกตั้งโดยระบบซื้อขายกลางเท่านั้น
+var listingTransitions = map[ListingStatus][]ListingStatus{
+	ListingDraft:    {ListingActive, ListingRemoved},
+	ListingActive:   {ListingReserved, ListingHidden, ListingRemoved},
+	ListingReserved: {ListingActive, ListingSold},
+	ListingHidden:   {ListingActive, ListingRemoved},
+}
+
+func (s ListingStatus) IsValid() bool {
+	switch s {
+	case ListingDraft, ListingActive, ListingReserved, ListingSold, ListingHidden, ListingRemoved:
+		return true
+	}
+	return false
+}
+
+func (s ListingStatus) CanTransitionTo(next ListingStatus) bool {
+	for _, allowed := range listingTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// สถานะทั้งหมดที่เปลี่ยนมาเป็น next ได้
+func ListingStatusesBefore(next ListingStatus) []ListingStatus {
+	var from []ListingStatus
+	for s, targets := range listingTransitions {
+		for _, t := range targets {
+			if t == next {
+				from = append(from, s)
+			}
+		}
+	}
+	return from
+}
+
 type Listing struct {
 	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	UserEmail      string             `bson:"userEmail" json:"userEmail"`
@@ -15,7 +64,7 @@ type Listing struct {
 	Description    string             `bson:"description" json:"description"`
 	Images         []string           `bson:"images" json:"images"`
 	BankAccount    primitive.ObjectID `bson:"bankAccount" json:"bankAccount"`
-	Status         string             `bson:"status" json:"status"`
+	Status         ListingStatus      `bson:"status" json:"status"`
 	Favorites      int                `bson:"favorites" json:"favorites"`
 	CreatedAt      time.Time          `bson:"createdAt" json:"createdAt"`
 	UpdatedAt      time.Time          `bson:"updatedAt" json:"updatedAt"`
@@ -23,4 +72,7 @@ type Listing struct {
 	Username       string             `bson:"username,omitempty" json:"username,omitempty"`
 	Password       string             `bson:"password,omitempty" json:"password,omitempty"`
 	SecondPassword string             `bson:"secondPassword,omitempty" json:"secondPassword,omitempty"`
+	// สำเนาสถานะการระงับของผู้ขาย ใช้กรองหน้ารวมประกาศโดยไม่ต้อง join users
+	SellerSuspended      bool       `bson:"sellerSuspended,omitempty" json:"-"`
+	SellerSuspendedUntil *time.Time `bson:"sellerSuspendedUntil,omitempty" json:"-"`
 }
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type PaymentStatus string
+
+const (
+	PaymentPending    PaymentStatus = "pending"
+	PaymentSuccessful PaymentStatus = "successful"
+	PaymentFailed     PaymentStatus = "failed"
+	PaymentRefunded   PaymentStatus = "refunded"
+)
+
+type Payment struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	SourceID  string             `bson:"sourceId" json:"sourceId"`
+	ChargeID  string             `bson:"chargeId" json:"chargeId"`
+	EscrowID  primitive.ObjectID `bson:"escrowId,omitempty" json:"escrowId,omitempty"`
+	GroupID   primitive.ObjectID `bson:"groupId,omitempty" json:"groupId,omitempty"`
+	ListingID primitive.ObjectID `bson:"listingId,omitempty" json:"listingId,omitempty"`
+	Buyer     string             `bson:"buyer" json:"buyer"`
+	Seller    string             `bson:"seller,omitempty" json:"seller,omitempty"`
+	Amount    int64              `bson:"amount" json:"amount"` // หน่วยสตางค์
+	Currency  string             `bson:"currency" json:"currency"`
+	Status    PaymentStatus      `bson:"status" json:"status"`
+	PaidAt    *time.Time         `bson:"paidAt,omitempty" json:"paidAt,omitempty"`
+	// เงินเข้ามาโดยไม่มีการซื้อขายรองรับและคืนอัตโนมัติไม่ได้ ผู้ดูแลต้องจัดการเอง
+	NeedsReview   bool      `bson:"needsReview,omitempty" json:"needsReview,omitempty"`
+	ReviewReason  string    `bson:"reviewReason,omitempty" json:"reviewReason,omitempty"`
+	OmiseRefundID string    `bson:"omiseRefundId,omitempty" json:"omiseRefundId,omitempty"`
+	CreatedAt     time.Time `bson:"createdAt" json:"createdAt"`
+	UpdatedAt     time.Time `bson:"updatedAt" json:"updatedAt"`
+}
@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type RefundStatus string
+
+const (
+	RefundRequested  RefundStatus = "requested"
+	RefundProcessing RefundStatus = "processing"
+	RefundRejected   RefundStatus = "rejected"
+	RefundCompleted  RefundStatus = "completed"
+	RefundFailed     RefundStatus = "failed"
+)
+
+type Refund struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	EscrowID       primitive.ObjectID `bson:"escrowId" json:"escrowId"`
+	GroupID        primitive.ObjectID `bson:"groupId" json:"groupId"`
+	ListingID      primitive.ObjectID `bson:"listingId" json:"listingId"`
+	ChargeID       string             `bson:"chargeId" json:"chargeId"`
+	Buyer          string             `bson:"buyer" json:"buyer"`
+	Seller         string             `bson:"seller" json:"seller"`
+	Amount         int64              `bson:"amount" json:"amount"` // หน่วยสตางค์
+	Reason         string             `bson:"reason" json:"reason"`
+	Status         RefundStatus       `bson:"status" json:"status"`
+	SellerApproved *bool              `bson:"sellerApproved,omitempty" json:"sellerApproved,omitempty"`
+	DecidedBy      string             `bson:"decidedBy,omitempty" json:"decidedBy,omitempty"`
+	OmiseRefundID  string             `bson:"omiseRefundId,omitempty" json:"omiseRefundId,omitempty"`
+	FailureReason  string             `bson:"failureReason,omitempty" json:"failureReason,omitempty"`
+	NeedsReview    bool               `bson:"needsReview,omitempty" json:"needsReview,omitempty"`
+	ReviewReason   string             `bson:"reviewReason,omitempty" json:"reviewReason,omitempty"`
+	CreatedAt      time.Time          `bson:"createdAt" json:"createdAt"`
+	UpdatedAt      time.Time          `bson:"updatedAt" json:"updatedAt"`
+}
@@ -15,6 +15,48 @@ type ReportIssue struct {
 	CreatedAt   time.Time          `bson:"createdAt" json:"createdAt"`
 }
 
+type ReportStatus string
+
+const (
+	ReportOpen      ReportStatus = "open"
+	ReportTriaged   ReportStatus = "triaged"
+	ReportActioned  ReportStatus = "actioned"
+	ReportDismissed ReportStatus = "dismissed"
+)
+
+var reportTransitions = map[ReportStatus][]ReportStatus{
+	ReportOpen:    {ReportTriaged, ReportActioned, ReportDismissed},
+	ReportTriaged: {ReportActioned, ReportDismissed},
+}
+
+func (s ReportStatus) CanTransitionTo(next ReportStatus) bool {
+	for _, allowed := range reportTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// รายงานเก่าที่ยังไม่มี status ถือว่า open
+func (s ReportStatus) OrOpen() ReportStatus {
+	if s == "" {
+		return ReportOpen
+	}
+	return s
+}
+
+const (
+	ModerationHideListing = "hide_listing"
+	ModerationSuspendUser = "suspend_user"
+)
+
+type ModerationNote struct {
+	By   string    `bson:"by" json:"by"`
+	Text string    `bson:"text" json:"text"`
+	At   time.Time `bson:"at" json:"at"`
+}
+
 type ReportIssuePost struct {
 	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	Email         string             `bson:"email" json:"email"`
@@ -24,4 +66,13 @@ type ReportIssuePost struct {
 	ListingID     *string            `bson:"listingId,omitempty" json:"listingId"`
 	ReportedEmail *string            `bson:"reportedEmail,omitempty" json:"reportedEmail"`
 	CreatedAt     time.Time          `bson:"createdAt" json:"createdAt"`
+
+	Status     ReportStatus     `bson:"status,omitempty" json:"status"`
+	AssignedTo string           `bson:"assignedTo,omitempty" json:"assignedTo,omitempty"`
+	Notes      []ModerationNote `bson:"notes,omitempty" json:"notes,omitempty"`
+	Action     string           `bson:"action,omitempty" json:"action,omitempty"`
+	Resolution string           `bson:"resolution,omitempty" json:"resolution,omitempty"`
+	ResolvedBy string           `bson:"resolvedBy,omitempty" json:"resolvedBy,omitempty"`
+	ResolvedAt *time.Time       `bson:"resolvedAt,omitempty" json:"resolvedAt,omitempty"`
+	UpdatedAt  *time.Time       `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
 }
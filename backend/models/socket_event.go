@@ -0,0 +1,96 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// เพิ่มเลขเวอร์ชันเมื่อรูปแบบ payload เปลี่ยนแบบไม่เข้ากันกับของเดิม
+const SocketProtocolVersion = 1
+
+type SocketEventType string
+
+const (
+	SocketEventMessage      SocketEventType = "message"
+	SocketEventAck          SocketEventType = "ack"
+	SocketEventTyping       SocketEventType = "typing"
+	SocketEventReadReceipt  SocketEventType = "read_receipt"
+	SocketEventTradeStatus  SocketEventType = "trade_status"
+	SocketEventNewMessage   SocketEventType = "new_message_notification"
+	SocketEventGroupCreated SocketEventType = "new_group_created"
+	SocketEventCatchUpDone  SocketEventType = "catch_up_complete"
+	SocketEventError        SocketEventType = "error"
+)
+
+// ทุก frame บน WebSocket ห่อด้วย envelope นี้ทั้งสองทิศทาง
+// ID คือ id ที่ client สร้างเองสำหรับ frame ที่ต้องการ ack ฝั่ง server จะส่งกลับใน ack/error
+type SocketEnvelope struct {
+	Version int             `json:"v"`
+	Type    SocketEventType `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type SendMessagePayload struct {
+	Content string `json:"content"`
+	// id จาก POST /chat/groups/:id/attachments ส่งพร้อม content ว่างได้
+	AttachmentID string `json:"attachment_id,omitempty"`
+}
+
+type AckPayload struct {
+	MessageID primitive.ObjectID `json:"message_id"`
+	Timestamp string             `json:"timestamp"`
+	// true เมื่อเป็นการส่งซ้ำของข้อความที่บันทึกไว้แล้ว
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+type TypingPayload struct {
+	GroupID primitive.ObjectID `json:"group_id"`
+	Email   string             `json:"email"`
+	Typing  bool               `json:"typing"`
+}
+
+type ReadReceiptPayload struct {
+	GroupID   primitive.ObjectID `json:"group_id"`
+	Email     string             `json:"email"`
+	MessageID primitive.ObjectID `json:"message_id"`
+	ReadAt    string             `json:"read_at,omitempty"`
+}
+
+type TradeStatusPayload struct {
+	GroupID         primitive.ObjectID  `json:"group_id"`
+	EscrowID        *primitive.ObjectID `json:"escrow_id,omitempty"`
+	EscrowStatus    EscrowStatus        `json:"escrow_status,omitempty"`
+	BuyerConfirmed  *bool               `json:"buyer_confirmed,omitempty"`
+	SellerConfirmed *bool               `json:"seller_confirmed,omitempty"`
+	At              time.Time           `json:"at"`
+}
+
+type NewMessageNotificationPayload struct {
+	GroupID     primitive.ObjectID `json:"group_id"`
+	SenderEmail string             `json:"senderEmail"`
+	Timestamp   string             `json:"timestamp"`
+}
+
+type CatchUpCompletePayload struct {
+	Messages int `json:"messages"`
+	Events   int `json:"events"`
+	// true เมื่อข้อความที่พลาดไปมีมากเกินกว่าจะส่งทาง socket ให้ดึงผ่าน REST ต่อ
+	HasMore bool `json:"has_more"`
+}
+
+type SocketErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// event ของกลุ่มที่เก็บไว้ให้ client ที่หลุดไปดึงย้อนหลังได้ เช่นสถานะการซื้อขาย
+type ChatEvent struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty"`
+	GroupID primitive.ObjectID `bson:"group_id"`
+	Type    SocketEventType    `bson:"type"`
+	Payload []byte             `bson:"payload"`
+	At      time.Time          `bson:"at"`
+}
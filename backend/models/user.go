@@ -1,22 +1,72 @@
 package models
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 type User struct {
-	ID        primitive.ObjectID `bson:"_id,omitempty" form:"id"`
-	FirstName string             `bson:"firstName" form:"firstName"`
-	LastName  string             `bson:"lastName" form:"lastName"`
-	NameStore string             `bson:"namestore" form:"namestore"`
-	Email     string             `bson:"email" form:"email"`
-	Username  string             `bson:"username" form:"username"`
-	Password  string             `bson:"password,omitempty" form:"password"`
-	Phone     string             `bson:"phone" form:"phone"`
-	Address   string             `bson:"address" form:"address"`
-	Facebook  string             `bson:"facebook" form:"facebook"`
-	Instagram string             `bson:"instagram" form:"instagram"`
-	Line      string             `bson:"line" form:"line"`
-	Discord   string             `bson:"discord" form:"discord"`
-	Bio       string             `bson:"bio" form:"bio"`
-	Games     []string           `bson:"games" form:"games"`
-	Image     string             `bson:"image" form:"image"`
+	ID         primitive.ObjectID `bson:"_id,omitempty" form:"id"`
+	FirstName  string             `bson:"firstName" form:"firstName"`
+	LastName   string             `bson:"lastName" form:"lastName"`
+	NameStore  string             `bson:"namestore" form:"namestore"`
+	Email      string             `bson:"email" form:"email"`
+	Username   string             `bson:"username" form:"username"`
+	Password   string             `bson:"password,omitempty" form:"password"`
+	Phone      string             `bson:"phone" form:"phone"`
+	Address    string             `bson:"address" form:"address"`
+	Facebook   string             `bson:"facebook" form:"facebook"`
+	Instagram  string             `bson:"instagram" form:"instagram"`
+	Line       string             `bson:"line" form:"line"`
+	Discord    string             `bson:"discord" form:"discord"`
+	Bio        string             `bson:"bio" form:"bio"`
+	Games      []string           `bson:"games" form:"games"`
+	Image      string             `bson:"image" form:"image"`
+	Role       Role               `bson:"role,omitempty" form:"-"`
+	Suspension *Suspension        `bson:"suspension,omitempty" form:"-"`
+}
+
+// การระงับบัญชี Until เป็น nil หมายถึงระงับถาวร
+type Suspension struct {
+	Reason   string              `bson:"reason" json:"reason"`
+	Until    *time.Time          `bson:"until,omitempty" json:"until,omitempty"`
+	By       string              `bson:"by" json:"by"`
+	At       time.Time           `bson:"at" json:"at"`
+	ReportID *primitive.ObjectID `bson:"reportId,omitempty" json:"reportId,omitempty"`
+}
+
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+func (r Role) IsValid() bool {
+	switch r {
+	case RoleUser, RoleModerator, RoleAdmin:
+		return true
+	}
+	return false
+}
+
+// ผู้ใช้เก่าที่ยังไม่มี role ถือเป็น user
+func (u User) EffectiveRole() Role {
+	if u.Role == "" {
+		return RoleUser
+	}
+	return u.Role
+}
+
+// คืนการระงับที่ยังมีผลอยู่ ณ เวลา now หรือ nil ถ้าไม่ถูกระงับ
+func (u User) ActiveSuspension(now time.Time) *Suspension {
+	if u.Suspension == nil {
+		return nil
+	}
+	if u.Suspension.Until != nil && !u.Suspension.Until.After(now) {
+		return nil
+	}
+	return u.Suspension
 }
@@ -0,0 +1,84 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+)
+
+const subscriberBuffer = 256
+
+type memorySubscriber struct {
+	ch   chan []byte
+	done <-chan struct{}
+}
+
+// ใช้ได้เฉพาะภายใน process เดียว
+type Memory struct {
+	mu     sync.RWMutex
+	subs   map[string]map[*memorySubscriber]struct{}
+	closed bool
+}
+
+func NewMemory() *Memory {
+	return &Memory{subs: make(map[string]map[*memorySubscriber]struct{})}
+}
+
+func (m *Memory) Publish(ctx context.Context, topic string, payload []byte) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return ErrClosed
+	}
+
+	for sub := range m.subs[topic] {
+		select {
+		case sub.ch <- payload:
+		case <-sub.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Subscribe(ctx context.Context, topic string) (<-chan []byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	sub := &memorySubscriber{ch: make(chan []byte, subscriberBuffer), done: ctx.Done()}
+	if m.subs[topic] == nil {
+		m.subs[topic] = make(map[*memorySubscriber]struct{})
+	}
+	m.subs[topic][sub] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if _, ok := m.subs[topic][sub]; ok {
+			delete(m.subs[topic], sub)
+			close(sub.ch)
+		}
+	}()
+
+	return sub.ch, nil
+}
+
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	for _, subs := range m.subs {
+		for sub := range subs {
+			close(sub.ch)
+		}
+	}
+	m.subs = nil
+	return nil
+}
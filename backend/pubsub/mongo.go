@@ -0,0 +1,197 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// เก็บ event ไว้ชั่วคราวพอให้ change stream resume ได้ แล้วให้ TTL index ลบทิ้ง
+const mongoEventTTL = time.Hour
+
+type mongoEvent struct {
+	Topic     string    `bson:"topic"`
+	Payload   []byte    `bson:"payload"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+// กระจายข้อความผ่าน collection กลาง ทุก instance ดู insert ด้วย change stream
+// ต้องใช้ MongoDB แบบ replica set (รวมถึง Atlas)
+type Mongo struct {
+	coll   *mongo.Collection
+	mu     sync.Mutex
+	closed bool
+	cancel context.CancelFunc
+	ctx    context.Context
+}
+
+func NewMongo(ctx context.Context, coll *mongo.Collection) (*Mongo, error) {
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "createdAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(mongoEventTTL.Seconds())),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	base, cancel := context.WithCancel(context.Background())
+	return &Mongo{coll: coll, ctx: base, cancel: cancel}, nil
+}
+
+func (m *Mongo) Publish(ctx context.Context, topic string, payload []byte) error {
+	if m.isClosed() {
+		return ErrClosed
+	}
+	_, err := m.coll.InsertOne(ctx, mongoEvent{Topic: topic, Payload: payload, CreatedAt: time.Now()})
+	return err
+}
+
+func (m *Mongo) Subscribe(ctx context.Context, topic string) (<-chan []byte, error) {
+	if m.isClosed() {
+		return nil, ErrClosed
+	}
+
+	// ผูกกับทั้ง ctx ของผู้เรียกและการ Close
+	subCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-m.ctx.Done():
+			cancel()
+		case <-subCtx.Done():
+		}
+	}()
+
+	stream, err := m.watch(subCtx, topic, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	ch := make(chan []byte, subscriberBuffer)
+	go m.pump(subCtx, cancel, topic, stream, ch)
+	return ch, nil
+}
+
+func (m *Mongo) watch(ctx context.Context, topic string, resumeToken bson.Raw) (*mongo.ChangeStream, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"operationType": "insert", "fullDocument.topic": topic}}},
+	}
+	opts := options.ChangeStream()
+	if resumeToken != nil {
+		opts.SetResumeAfter(resumeToken)
+	}
+	return m.coll.Watch(ctx, pipeline, opts)
+}
+
+// อ่าน change stream ส่งต่อเข้า channel และต่อใหม่จาก resume token เมื่อหลุด
+func (m *Mongo) pump(ctx context.Context, cancel context.CancelFunc, topic string, stream *mongo.ChangeStream, ch chan<- []byte) {
+	defer close(ch)
+	defer cancel()
+
+	backoff := time.Second
+	// เวลาของ event ล่าสุดที่ส่งต่อแล้ว ใช้บอกช่วงที่อาจพลาดไปถ้า resume token ใช้ไม่ได้
+	lastEventAt := time.Now()
+	for {
+		for stream.Next(ctx) {
+			var change struct {
+				FullDocument mongoEvent `bson:"fullDocument"`
+			}
+			if err := stream.Decode(&change); err != nil {
+				log.Println("pubsub: failed to decode change event:", err)
+				continue
+			}
+			select {
+			case ch <- change.FullDocument.Payload:
+			case <-ctx.Done():
+			}
+			lastEventAt = change.FullDocument.CreatedAt
+			backoff = time.Second
+		}
+
+		resumeToken := stream.ResumeToken()
+		err := stream.Err()
+		stream.Close(context.Background())
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("pubsub: change stream for", topic, "stopped, reconnecting:", err)
+
+		tokenLost := false
+		for {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+
+			stream, err = m.watch(ctx, topic, resumeToken)
+			if err == nil {
+				break
+			}
+			log.Println("pubsub: failed to reopen change stream for", topic, ":", err)
+			if resumeToken != nil && resumeTokenLost(err) {
+				// resume token หมดอายุจาก oplog แล้ว ต้องเริ่มใหม่จากปัจจุบัน
+				// event ที่ publish ระหว่างนี้จะไม่ถูกส่งต่อ (ยอมรับว่าหายได้) จึงบันทึกช่วงที่พลาดไว้ให้ตรวจสอบ
+				resumeToken = nil
+				tokenLost = true
+			}
+		}
+		if tokenLost {
+			m.logMissedEvents(ctx, topic, lastEventAt, time.Now())
+		}
+	}
+}
+
+// error ที่แปลว่า resume token ใช้ต่อไม่ได้อีก ต้องเริ่ม stream ใหม่
+// 260 InvalidResumeToken, 280 ChangeStreamFatalError, 286 ChangeStreamHistoryLost
+func resumeTokenLost(err error) bool {
+	var serverErr mongo.ServerError
+	if !errors.As(err, &serverErr) {
+		return false
+	}
+	return serverErr.HasErrorCode(260) || serverErr.HasErrorCode(280) || serverErr.HasErrorCode(286)
+}
+
+// นับ event ที่ publish หลัง event ล่าสุดที่ส่งต่อแล้วจนถึงตอนเริ่ม stream ใหม่ ซึ่ง subscriber นี้จะไม่ได้รับ
+func (m *Mongo) countMissedEvents(ctx context.Context, topic string, since, until time.Time) (int64, error) {
+	return m.coll.CountDocuments(ctx, bson.M{
+		"topic":     topic,
+		"createdAt": bson.M{"$gt": since, "$lte": until},
+	})
+}
+
+func (m *Mongo) logMissedEvents(ctx context.Context, topic string, since, until time.Time) {
+	missed, err := m.countMissedEvents(ctx, topic, since, until)
+	if err != nil {
+		log.Printf("pubsub: resume token for %s lost, events published between %s and %s were not delivered (count failed: %v)",
+			topic, since.Format(time.RFC3339), until.Format(time.RFC3339), err)
+		return
+	}
+	log.Printf("pubsub: resume token for %s lost, %d events published between %s and %s were not delivered",
+		topic, missed, since.Format(time.RFC3339), until.Format(time.RFC3339))
+}
+
+func (m *Mongo) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
+
+func (m *Mongo) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		m.closed = true
+		m.cancel()
+	}
+	return nil
+}
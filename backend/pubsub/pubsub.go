@@ -0,0 +1,18 @@
+// Package pubsub กระจายข้อความระหว่าง instance ของ backend
+// ใช้ memory สำหรับเครื่องเดียว หรือ mongo (change stream) เมื่อรันหลาย instance
+package pubsub
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrClosed = errors.New("pubsub is closed")
+
+type PubSub interface {
+	// ส่ง payload ไปยังทุก subscriber ของ topic ในทุก instance
+	Publish(ctx context.Context, topic string, payload []byte) error
+	// รับ payload ของ topic จนกว่า ctx จะถูกยกเลิก จากนั้น channel จะถูกปิด
+	Subscribe(ctx context.Context, topic string) (<-chan []byte, error)
+	Close() error
+}
@@ -0,0 +1,224 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const testTopic = "test.topic"
+
+// ทุก subscriber ของทุก instance ต้องได้ทุก event ตามลำดับที่ publish และไม่ได้ event ของ topic อื่น
+func testFanout(t *testing.T, instances []PubSub) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var subs []<-chan []byte
+	for _, ps := range instances {
+		for i := 0; i < 2; i++ {
+			ch, err := ps.Subscribe(ctx, testTopic)
+			if err != nil {
+				t.Fatal("subscribe:", err)
+			}
+			subs = append(subs, ch)
+		}
+	}
+	other, err := instances[0].Subscribe(ctx, "other.topic")
+	if err != nil {
+		t.Fatal("subscribe:", err)
+	}
+
+	const perInstance = 20
+	var want []string
+	for i, ps := range instances {
+		for j := 0; j < perInstance; j++ {
+			payload := fmt.Sprintf("instance-%d-event-%d", i, j)
+			if err := ps.Publish(ctx, testTopic, []byte(payload)); err != nil {
+				t.Fatal("publish:", err)
+			}
+			want = append(want, payload)
+		}
+	}
+
+	for n, ch := range subs {
+		for i, expected := range want {
+			select {
+			case got := <-ch:
+				if string(got) != expected {
+					t.Fatalf("subscriber %d event %d = %q, want %q", n, i, got, expected)
+				}
+			case <-ctx.Done():
+				t.Fatalf("subscriber %d received %d of %d events", n, i, len(want))
+			}
+		}
+	}
+
+	select {
+	case got := <-other:
+		t.Fatalf("subscriber of another topic received %q", got)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestMemoryFanout(t *testing.T) {
+	ps := NewMemory()
+	defer ps.Close()
+	testFanout(t, []PubSub{ps})
+}
+
+func TestMemoryCloseEndsSubscriptions(t *testing.T) {
+	ps := NewMemory()
+	ch, err := ps.Subscribe(context.Background(), testTopic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.Close()
+	if _, ok := <-ch; ok {
+		t.Fatal("channel still open after Close")
+	}
+	if err := ps.Publish(context.Background(), testTopic, nil); err != ErrClosed {
+		t.Fatalf("publish after close = %v, want ErrClosed", err)
+	}
+}
+
+// collection ชั่วคราวสำหรับ mongo pubsub ต้องเป็น replica set ถ้าไม่ใช่จะข้าม
+func useTestCollection(t *testing.T) (dbName, collName string) {
+	t.Helper()
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal("connect test MongoDB:", err)
+	}
+
+	var hello bson.M
+	if err := client.Database("admin").RunCommand(ctx, bson.M{"hello": 1}).Decode(&hello); err != nil {
+		t.Fatal("hello:", err)
+	}
+	if _, ok := hello["setName"]; !ok {
+		client.Disconnect(ctx)
+		t.Skip("MONGO_TEST_URI is not a replica set, change streams are unavailable")
+	}
+
+	dbName = "goosenest_test_" + primitive.NewObjectID().Hex()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		client.Database(dbName).Drop(ctx)
+		client.Disconnect(ctx)
+	})
+	return dbName, "pubsub_events"
+}
+
+// แต่ละ instance ใช้ client ของตัวเองเหมือน backend ที่รันแยก process
+func newTestMongo(t *testing.T, dbName, collName string) *Mongo {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(os.Getenv("MONGO_TEST_URI")))
+	if err != nil {
+		t.Fatal("connect test MongoDB:", err)
+	}
+	ps, err := NewMongo(ctx, client.Database(dbName).Collection(collName))
+	if err != nil {
+		t.Fatal("new mongo pubsub:", err)
+	}
+	t.Cleanup(func() {
+		ps.Close()
+		client.Disconnect(context.Background())
+	})
+	return ps
+}
+
+func TestMongoFanoutAcrossInstances(t *testing.T) {
+	dbName, collName := useTestCollection(t)
+	a := newTestMongo(t, dbName, collName)
+	b := newTestMongo(t, dbName, collName)
+	testFanout(t, []PubSub{a, b})
+}
+
+func TestMongoCloseEndsSubscriptions(t *testing.T) {
+	dbName, collName := useTestCollection(t)
+	ps := newTestMongo(t, dbName, collName)
+
+	ch, err := ps.Subscribe(context.Background(), testTopic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.Close()
+
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("received event after Close")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("channel not closed after Close")
+	}
+}
+
+// ถ้า resume token หายไป event ในช่วงนั้นถือว่าหาย (known loss) แต่ต้องนับได้ว่าพลาดไปกี่รายการ
+func TestMongoCountsEventsMissedAfterLostToken(t *testing.T) {
+	dbName, collName := useTestCollection(t)
+	ps := newTestMongo(t, dbName, collName)
+	ctx := context.Background()
+
+	lastDelivered := time.Now().Add(-time.Minute)
+	for i, at := range []time.Time{
+		lastDelivered.Add(-time.Second), // ส่งไปแล้วก่อนหลุด
+		lastDelivered.Add(10 * time.Second),
+		lastDelivered.Add(20 * time.Second),
+	} {
+		if _, err := ps.coll.InsertOne(ctx, mongoEvent{Topic: testTopic, Payload: []byte(fmt.Sprint(i)), CreatedAt: at}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ps.coll.InsertOne(ctx, mongoEvent{Topic: "other.topic", CreatedAt: lastDelivered.Add(5 * time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+
+	missed, err := ps.countMissedEvents(ctx, testTopic, lastDelivered, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missed != 2 {
+		t.Fatalf("missed = %d, want 2", missed)
+	}
+}
+
+func TestResumeTokenLost(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"history lost", mongo.CommandError{Code: 286, Name: "ChangeStreamHistoryLost"}, true},
+		{"invalid token", mongo.CommandError{Code: 260, Name: "InvalidResumeToken"}, true},
+		{"fatal", mongo.CommandError{Code: 280, Name: "ChangeStreamFatalError"}, true},
+		{"wrapped", fmt.Errorf("watch: %w", mongo.CommandError{Code: 286}), true},
+		{"network", mongo.CommandError{Code: 6, Name: "HostUnreachable"}, false},
+		{"not a server error", errors.New("connection reset"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resumeTokenLost(tt.err); got != tt.want {
+				t.Fatalf("resumeTokenLost(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
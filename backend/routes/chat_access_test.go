@@ -0,0 +1,300 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-auth-mongo/config"
+	"go-auth-mongo/controllers"
+	"go-auth-mongo/models"
+	"go-auth-mongo/pubsub"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	testJWTSecret = "route-test-secret"
+	memberEmail   = "member@example.com"
+	outsiderEmail = "outsider@example.com"
+)
+
+var startBroadcasters sync.Once
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// ต่อ MongoDB จาก MONGO_TEST_URI แล้วใช้ database ชั่วคราว ข้าม test ถ้าไม่ได้ตั้งไว้
+// pubsub เป็นแบบ memory ตัวเดียวตลอดทั้ง package เพราะ broadcaster ทำงานตลอดอายุ process
+func useTestDB(t *testing.T) {
+	t.Helper()
+
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI is not set")
+	}
+	t.Setenv("JWT_SECRET", testJWTSecret)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal("connect test MongoDB:", err)
+	}
+
+	prevDB := config.DB
+	config.DB = client.Database("goosenest_test_" + primitive.NewObjectID().Hex())
+	config.EnsureIndexes()
+
+	startBroadcasters.Do(func() {
+		config.PubSub = pubsub.NewMemory()
+		go controllers.Broadcaster()
+		go controllers.GroupCreationBroadcaster()
+	})
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		config.DB.Drop(ctx)
+		client.Disconnect(ctx)
+		config.DB = prevDB
+	})
+}
+
+func testToken(t *testing.T, email string) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"email": email,
+		"role":  string(models.RoleUser),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+	signed, err := token.SignedString([]byte(testJWTSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func seedGroup(t *testing.T, members ...string) models.Group {
+	t.Helper()
+	group := models.Group{
+		ID:        primitive.NewObjectID(),
+		Name:      "test group",
+		Members:   members,
+		ProductID: primitive.NewObjectID().Hex(),
+		CreatedAt: time.Now().Format(time.RFC3339),
+		Buyer:     members[0],
+		Seller:    members[len(members)-1],
+	}
+	if _, err := config.GetCollection("groups").InsertOne(context.Background(), group); err != nil {
+		t.Fatal("insert group:", err)
+	}
+	return group
+}
+
+func newTestRouter() *gin.Engine {
+	r := gin.New()
+	RegisterRoutes(r)
+	return r
+}
+
+// ทุก route ของ /chat ที่อ้างถึงกลุ่มด้วย :id ต้องตอบ 403 ให้คนที่ไม่ใช่สมาชิก
+// route ใหม่ที่ยังไม่อยู่ในตารางจะทำให้ test นี้ fail จนกว่าจะเพิ่มเข้ามา
+func TestChatRoutesRejectNonMembers(t *testing.T) {
+	useTestDB(t)
+	r := newTestRouter()
+	group := seedGroup(t, memberEmail, "seller@example.com")
+	token := testToken(t, outsiderEmail)
+
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/chat/groups/:id"},
+		{http.MethodGet, "/chat/messages/:id"},
+		{http.MethodPut, "/chat/groups/:id/read-status"},
+		{http.MethodPost, "/chat/groups/:id/attachments"},
+		{http.MethodGet, "/chat/groups/:id/attachments/:attachmentId"},
+		{http.MethodPatch, "/chat/groups/:id/confirm"},
+		{http.MethodGet, "/chat/groups/:id/escrow"},
+		{http.MethodPatch, "/chat/groups/:id/escrow/deliver"},
+		{http.MethodPatch, "/chat/groups/:id/escrow/accept"},
+		{http.MethodPatch, "/chat/groups/:id/escrow/dispute"},
+		{http.MethodGet, "/chat/groups/:id/handover"},
+		{http.MethodPost, "/chat/groups/:id/handover"},
+		{http.MethodPatch, "/chat/groups/:id/handover/reveal"},
+		{http.MethodPatch, "/chat/groups/:id/handover/confirm"},
+	}
+
+	covered := map[string]bool{}
+	for _, tt := range tests {
+		covered[tt.method+" "+tt.path] = true
+	}
+	for _, route := range r.Routes() {
+		if strings.HasPrefix(route.Path, "/chat/") && strings.Contains(route.Path, ":id") && !covered[route.Method+" "+route.Path] {
+			t.Errorf("route %s %s is not covered by the non-member table", route.Method, route.Path)
+		}
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			path := strings.NewReplacer(
+				":attachmentId", primitive.NewObjectID().Hex(),
+				":id", group.ID.Hex(),
+			).Replace(tt.path)
+
+			req := httptest.NewRequest(tt.method, path, strings.NewReader("{}"))
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("status %d body %s, want 403", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func dialSocket(t *testing.T, server *httptest.Server, path string) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + path
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		t.Fatalf("dial %s: %v (status %d)", path, err, status)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// อ่าน envelope ถัดไป คืน false ถ้าไม่มีอะไรเข้ามาภายใน wait
+func readEnvelope(conn *websocket.Conn, wait time.Duration) (models.SocketEnvelope, bool) {
+	var env models.SocketEnvelope
+	conn.SetReadDeadline(time.Now().Add(wait))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return env, false
+	}
+	return env, json.Unmarshal(data, &env) == nil
+}
+
+func publishTestEvent(t *testing.T, topic string, event interface{}) {
+	t.Helper()
+	payload, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.PubSub.Publish(context.Background(), topic, payload); err != nil {
+		t.Fatal("publish:", err)
+	}
+}
+
+// ส่ง event ซ้ำจนกว่า conn จะได้รับ เพราะ client ลงทะเบียนหลัง upgrade ไม่พร้อมกับ Dial
+func publishUntilReceived(t *testing.T, conn *websocket.Conn, topic string, event interface{}, want models.SocketEventType) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		publishTestEvent(t, topic, event)
+		if env, ok := readEnvelope(conn, 200*time.Millisecond); ok && env.Type == want {
+			return
+		}
+	}
+	t.Fatalf("did not receive %s", want)
+}
+
+func chatMessageEvent(group models.Group, sender string) controllers.BroadcastMessage {
+	return controllers.BroadcastMessage{
+		Message: models.Message{
+			ID:          primitive.NewObjectID(),
+			GroupID:     group.ID,
+			SenderEmail: sender,
+			Content:     "hello",
+			Timestamp:   time.Now().Format(time.RFC3339),
+		},
+		SenderID: primitive.NewObjectID().Hex(),
+		Members:  group.Members,
+	}
+}
+
+func TestChatSocketRejectsNonMembers(t *testing.T) {
+	useTestDB(t)
+	r := newTestRouter()
+	group := seedGroup(t, memberEmail, "seller@example.com")
+
+	req := httptest.NewRequest(http.MethodGet, "/ws/chat?group_id="+group.ID.Hex()+"&token="+testToken(t, outsiderEmail), nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status %d body %s, want 403", w.Code, w.Body.String())
+	}
+}
+
+// /ws/listen และ /ws/watch-new-groups ไม่ผูกกับกลุ่ม จึงตรวจว่าคนนอกไม่ได้รับ event ของกลุ่มที่ตัวเองไม่ได้อยู่
+func TestListenerSocketsSkipNonMembers(t *testing.T) {
+	useTestDB(t)
+	server := httptest.NewServer(newTestRouter())
+	defer server.Close()
+
+	group := seedGroup(t, memberEmail, "seller@example.com")
+	outsiderGroup := seedGroup(t, outsiderEmail, "seller@example.com")
+
+	t.Run("listen", func(t *testing.T) {
+		member := dialSocket(t, server, "/ws/listen?token="+testToken(t, memberEmail))
+		outsider := dialSocket(t, server, "/ws/listen?token="+testToken(t, outsiderEmail))
+
+		// ให้แน่ใจว่าทั้งสองฝั่งลงทะเบียนแล้วก่อนทดสอบ
+		publishUntilReceived(t, outsider, "chat.message", chatMessageEvent(outsiderGroup, "seller@example.com"), models.SocketEventNewMessage)
+		publishUntilReceived(t, member, "chat.message", chatMessageEvent(group, "seller@example.com"), models.SocketEventNewMessage)
+
+		for {
+			env, ok := readEnvelope(outsider, 300*time.Millisecond)
+			if !ok {
+				break
+			}
+			var payload models.NewMessageNotificationPayload
+			json.Unmarshal(env.Payload, &payload)
+			if payload.GroupID == group.ID {
+				t.Fatal("outsider received a notification for a group they are not in")
+			}
+		}
+	})
+
+	t.Run("watch-new-groups", func(t *testing.T) {
+		member := dialSocket(t, server, "/ws/watch-new-groups?token="+testToken(t, memberEmail))
+		outsider := dialSocket(t, server, "/ws/watch-new-groups?token="+testToken(t, outsiderEmail))
+
+		publishUntilReceived(t, outsider, "chat.group_created",
+			controllers.NewGroupNotification{Group: outsiderGroup, ReceiverEM: outsiderEmail}, models.SocketEventGroupCreated)
+		publishUntilReceived(t, member, "chat.group_created",
+			controllers.NewGroupNotification{Group: group, ReceiverEM: memberEmail}, models.SocketEventGroupCreated)
+
+		for {
+			env, ok := readEnvelope(outsider, 300*time.Millisecond)
+			if !ok {
+				break
+			}
+			var got models.Group
+			json.Unmarshal(env.Payload, &got)
+			if got.ID == group.ID {
+				t.Fatal("outsider received a group created event for another user")
+			}
+		}
+	})
+}
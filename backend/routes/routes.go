@@ -3,6 +3,7 @@ package routes
 import (
 	"go-auth-mongo/controllers"
 	"go-auth-mongo/middleware"
+	"go-auth-mongo/models"
 
 	"github.com/gin-gonic/gin"
 )
@@ -76,14 +77,47 @@ func RegisterRoutes(r *gin.Engine) {
 		chat.GET("/groups/:id", controllers.GetGroupByIDHandler)
 		chat.GET("/messages/:id", controllers.GetMessagesHandler)
 		chat.PUT("/groups/:id/read-status", controllers.UpdateReadStatusHandler)
+		chat.POST("/groups/:id/attachments", controllers.UploadChatAttachmentHandler)
+		chat.GET("/groups/:id/attachments/:attachmentId", controllers.GetChatAttachmentHandler)
 		chat.PATCH("/groups/:id/confirm", controllers.ConfirmTradeHandler)
 		chat.GET("/groups/confirmed", controllers.GetConfirmedTradeGroupsHandler)
+		chat.GET("/groups/:id/escrow", controllers.GetEscrowHandler)
+		chat.PATCH("/groups/:id/escrow/deliver", controllers.DeliverEscrowHandler)
+		chat.PATCH("/groups/:id/escrow/accept", controllers.AcceptEscrowHandler)
+		chat.PATCH("/groups/:id/escrow/dispute", controllers.DisputeEscrowHandler)
+		chat.GET("/groups/:id/handover", controllers.GetHandoverHandler)
+		chat.POST("/groups/:id/handover", controllers.SubmitHandoverHandler)
+		chat.PATCH("/groups/:id/handover/reveal", controllers.RevealHandoverHandler)
+		chat.PATCH("/groups/:id/handover/confirm", controllers.ConfirmHandoverHandler)
 	}
 
+	refundGateway := controllers.NewOmiseRefundGateway()
+	paymentController := controllers.NewPaymentController(refundGateway)
+	r.POST("/payment/webhook", paymentController.Webhook)
+
 	payment := r.Group("/payment")
 	payment.Use(middleware.JWTAuthMiddleware())
 	{
-		payment.POST("/generateQR", controllers.NewPaymentController().CreateQR)
+		payment.POST("/generateQR", paymentController.CreateQR)
+		payment.GET("/history", paymentController.History)
+	}
+
+	payout := r.Group("/payout")
+	payout.Use(middleware.JWTAuthMiddleware())
+	{
+		payout.GET("/balance", controllers.GetPayoutBalance)
+		payout.POST("/batches", middleware.RequireRole(models.RoleAdmin), controllers.CreatePayoutBatch)
+		payout.GET("/batches/:id/export", middleware.RequireRole(models.RoleAdmin), controllers.ExportPayoutBatch)
+	}
+
+	refundController := controllers.NewRefundController(refundGateway)
+	refund := r.Group("/refund")
+	refund.Use(middleware.JWTAuthMiddleware())
+	{
+		refund.POST("/", refundController.Request)
+		refund.GET("/:id", refundController.Get)
+		refund.PATCH("/:id/seller", refundController.SellerDecision)
+		refund.PATCH("/:id/admin", middleware.RequireRole(models.RoleAdmin), refundController.AdminDecision)
 	}
 
 	report := r.Group("/report")
@@ -93,7 +127,29 @@ func RegisterRoutes(r *gin.Engine) {
 		report.POST("/post", controllers.CreateReportIssuePost)
 	}
 
-	r.GET("/ws/chat", controllers.WebSocketHandlerChat)
-	r.GET("/ws/listen", controllers.WebSocketHandlerListenAllGroups)
-	r.GET("/ws/watch-new-groups", controllers.WebSocketHandlerWatchNewGroups)
+	admin := r.Group("/admin")
+	admin.Use(middleware.JWTAuthMiddleware(), middleware.RequireRole(models.RoleModerator, models.RoleAdmin))
+	{
+		admin.GET("/reports", controllers.GetAllReportIssuesForAdmin)
+		admin.GET("/moderation/reports", controllers.ListModerationReports)
+		admin.GET("/moderation/reports/:id", controllers.GetModerationReport)
+		admin.PATCH("/moderation/reports/:id/assign", controllers.AssignModerationReport)
+		admin.POST("/moderation/reports/:id/notes", controllers.AddModerationNote)
+		admin.POST("/moderation/reports/:id/action", controllers.ActionModerationReport)
+		admin.POST("/moderation/reports/:id/dismiss", controllers.DismissModerationReport)
+		admin.GET("/users", controllers.AdminListUsers)
+		admin.PATCH("/users/:id/role", middleware.RequireRole(models.RoleAdmin), controllers.AdminSetUserRole)
+		admin.POST("/users/:id/suspension", controllers.SuspendUserHandler)
+		admin.DELETE("/users/:id/suspension", controllers.UnsuspendUserHandler)
+		admin.GET("/listings", controllers.AdminListListings)
+		admin.POST("/escrow/:id/resolve", middleware.RequireRole(models.RoleAdmin), refundController.ResolveDispute)
+	}
+
+	ws := r.Group("/ws")
+	ws.Use(middleware.WebSocketAuthMiddleware())
+	{
+		ws.GET("/chat", controllers.WebSocketHandlerChat)
+		ws.GET("/listen", controllers.WebSocketHandlerListenAllGroups)
+		ws.GET("/watch-new-groups", controllers.WebSocketHandlerWatchNewGroups)
+	}
 }
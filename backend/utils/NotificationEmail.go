@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"html"
 	"log"
 	"net/smtp"
 	"os"
@@ -88,3 +89,40 @@ func SendNewMessageNotificationEmail(to string) error {
 	err := smtp.SendMail(smtpHost+":"+smtpPort, auth, from, []string{to}, message)
 	return err
 }
+
+func SendReportOutcomeEmail(to string, reportSubject string, outcome string) error {
+
+	from := os.Getenv("EMAIL")
+	password := os.Getenv("PASSWORDAPP")
+
+	smtpHost := "smtp.gmail.com"
+	smtpPort := "587"
+
+	subject := "แจ้งผลการตรวจสอบรายงานของคุณ"
+
+	body := `
+		<html>
+		<body style="font-family: Arial, sans-serif; background-color: #f7f7f7; padding: 20px;">
+			<div style="max-width: 600px; margin: auto; background-color: #ffffff; border-radius: 8px; padding: 30px; box-shadow: 0 0 10px rgba(0,0,0,0.1);">
+				<h2 style="color: #333;">ผลการตรวจสอบรายงาน</h2>
+				<p style="font-size: 16px;">เรื่อง: ` + html.EscapeString(reportSubject) + `</p>
+				<p style="font-size: 18px;">` + html.EscapeString(outcome) + `</p>
+				<p style="font-size: 16px;">ขอบคุณที่ช่วยให้ GooseNest ปลอดภัยสำหรับทุกคน</p>
+				<hr style="border: none; border-top: 1px solid #eee; margin: 30px 0;">
+				<p style="font-size: 14px; color: #999;">อีเมลฉบับนี้ถูกส่งโดยอัตโนมัติ กรุณาอย่าตอบกลับอีเมลนี้</p>
+			</div>
+		</body>
+		</html>
+	`
+
+	message := []byte("From: GooseNest <" + from + ">\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/html; charset=\"UTF-8\"\r\n\r\n" +
+		body)
+
+	auth := smtp.PlainAuth("", from, password, smtpHost)
+	err := smtp.SendMail(smtpHost+":"+smtpPort, auth, from, []string{to}, message)
+	return err
+}
@@ -0,0 +1,199 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ciphertext รูปแบบใหม่: "v2:<keyID>:<base64url(nonce|sealed)>"
+// รูปแบบเก่า (AES-CFB ด้วย SECRET_KEY) เป็น base64 ล้วนและยังถอดได้ระหว่าง migrate
+const ciphertextVersion = "v2"
+
+var (
+	ErrUnknownKeyID      = errors.New("unknown encryption key id")
+	ErrMalformedCipher   = errors.New("malformed ciphertext")
+	ErrNoLegacyKey       = errors.New("legacy ciphertext but SECRET_KEY is not set")
+	errKeysNotConfigured = errors.New("ENCRYPTION_KEYS is not set")
+	errPrimaryIsLegacy   = errors.New("primary encryption key must not be the same as SECRET_KEY")
+)
+
+type keyring struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+	legacy  cipher.Block
+}
+
+var credentialKeys *keyring
+
+// โหลด key จาก ENCRYPTION_KEYS="id1:key1,id2:key2" (key ยาว 32 ตัวอักษร) ต้องตั้งเสมอ
+// ENCRYPTION_PRIMARY_KEY คือ key ที่ใช้เข้ารหัสใหม่ ถ้าไม่กำหนดใช้ตัวสุดท้าย
+// SECRET_KEY ใช้ถอดข้อมูล AES-CFB เดิมเท่านั้น และห้ามเป็น primary key เพื่อไม่ให้ใช้ key เดียวกับสอง mode
+// ระบบที่เคยเข้ารหัสด้วย "v1" จาก SECRET_KEY ให้ใส่ "v1:<SECRET_KEY>" ไว้เป็น key รองจนกว่าจะรัน rotatekeys
+func LoadEncryptionKeys() error {
+	ring := &keyring{aeads: map[string]cipher.AEAD{}}
+
+	legacyKey := os.Getenv("SECRET_KEY")
+	if legacyKey != "" {
+		block, err := aes.NewCipher([]byte(legacyKey))
+		if err != nil {
+			return fmt.Errorf("SECRET_KEY: %w", err)
+		}
+		ring.legacy = block
+	}
+
+	specs := os.Getenv("ENCRYPTION_KEYS")
+	if specs == "" {
+		return errKeysNotConfigured
+	}
+	rawKeys := map[string]string{}
+
+	for _, spec := range strings.Split(specs, ",") {
+		id, key, ok := strings.Cut(strings.TrimSpace(spec), ":")
+		if !ok || id == "" {
+			return fmt.Errorf("invalid ENCRYPTION_KEYS entry %q", spec)
+		}
+		if len(key) != 32 {
+			return fmt.Errorf("encryption key %q must be exactly 32 characters (current: %d)", id, len(key))
+		}
+		block, err := aes.NewCipher([]byte(key))
+		if err != nil {
+			return err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		ring.aeads[id] = aead
+		rawKeys[id] = key
+		ring.primary = id
+	}
+
+	if primary := os.Getenv("ENCRYPTION_PRIMARY_KEY"); primary != "" {
+		if _, ok := ring.aeads[primary]; !ok {
+			return fmt.Errorf("ENCRYPTION_PRIMARY_KEY %q is not in ENCRYPTION_KEYS", primary)
+		}
+		ring.primary = primary
+	}
+	if legacyKey != "" && rawKeys[ring.primary] == legacyKey {
+		return errPrimaryIsLegacy
+	}
+
+	credentialKeys = ring
+	return nil
+}
+
+func PrimaryKeyID() string {
+	if credentialKeys == nil {
+		return ""
+	}
+	return credentialKeys.primary
+}
+
+func Encrypt(text string) (string, error) {
+	if credentialKeys == nil {
+		return "", errKeysNotConfigured
+	}
+	aead := credentialKeys.aeads[credentialKeys.primary]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	// ผูก key ID ไว้กับ ciphertext เพื่อไม่ให้สลับ prefix ได้
+	prefix := ciphertextVersion + ":" + credentialKeys.primary + ":"
+	sealed := aead.Seal(nonce, nonce, []byte(text), []byte(prefix))
+	return prefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func Decrypt(cryptoText string) (string, error) {
+	if credentialKeys == nil {
+		return "", errKeysNotConfigured
+	}
+	if cryptoText == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(cryptoText, ciphertextVersion+":") {
+		return decryptLegacy(cryptoText)
+	}
+
+	parts := strings.SplitN(cryptoText, ":", 3)
+	if len(parts) != 3 {
+		return "", ErrMalformedCipher
+	}
+	aead, ok := credentialKeys.aeads[parts[1]]
+	if !ok {
+		return "", ErrUnknownKeyID
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", ErrMalformedCipher
+	}
+
+	nonce, body := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, body, []byte(parts[0]+":"+parts[1]+":"))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// ต้องเข้ารหัสใหม่ถ้าเป็นรูปแบบเก่าหรือไม่ได้ใช้ primary key
+func NeedsReencryption(cryptoText string) bool {
+	if cryptoText == "" || credentialKeys == nil {
+		return false
+	}
+	return !strings.HasPrefix(cryptoText, ciphertextVersion+":"+credentialKeys.primary+":")
+}
+
+// UpdateListing รุ่นแรกบันทึกรหัสโดยไม่เข้ารหัส ค่าแบบนี้ไม่มี prefix v2
+// และถอดแบบ legacy ไม่ได้หรือถอดแล้วไม่ได้ข้อความที่อ่านได้ (CFB ไม่มีการตรวจความถูกต้อง)
+// ถ้าไม่มี SECRET_KEY จะแยกไม่ได้ จึงถือว่าเป็น ciphertext ไว้ก่อน
+func LooksLikePlaintext(value string) bool {
+	if value == "" || strings.HasPrefix(value, ciphertextVersion+":") {
+		return false
+	}
+	raw, err := base64.URLEncoding.DecodeString(value)
+	if err != nil || len(raw) < aes.BlockSize {
+		return true
+	}
+	if credentialKeys == nil || credentialKeys.legacy == nil {
+		return false
+	}
+	plaintext, err := decryptLegacy(value)
+	if err != nil || !utf8.ValidString(plaintext) {
+		return true
+	}
+	for _, r := range plaintext {
+		if unicode.IsControl(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func decryptLegacy(cryptoText string) (string, error) {
+	if credentialKeys.legacy == nil {
+		return "", ErrNoLegacyKey
+	}
+	ciphertext, err := base64.URLEncoding.DecodeString(cryptoText)
+	if err != nil {
+		return "", ErrMalformedCipher
+	}
+	if len(ciphertext) < aes.BlockSize {
+		return "", ErrMalformedCipher
+	}
+	iv := ciphertext[:aes.BlockSize]
+	ciphertext = ciphertext[aes.BlockSize:]
+	stream := cipher.NewCFBDecrypter(credentialKeys.legacy, iv)
+	stream.XORKeyStream(ciphertext, ciphertext)
+	return string(ciphertext), nil
+}
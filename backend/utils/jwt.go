@@ -7,10 +7,15 @@ import (
 	"github.com/dgrijalva/jwt-go"
 )
 
-func GenerateToken(email string) (string, error) {
+func GenerateToken(email string, role string) (string, error) {
+	if role == "" {
+		role = "user"
+	}
+
 	claims := jwt.MapClaims{}
 	claims["authorized"] = true
 	claims["email"] = email
+	claims["role"] = role
 	claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
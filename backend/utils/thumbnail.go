@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+)
+
+// กันรูปที่ประกาศขนาดใหญ่ผิดปกติจนกินหน่วยความจำตอน decode
+const maxThumbnailSourcePixels = 40_000_000
+
+var ErrImageTooLarge = errors.New("image dimensions too large")
+
+// ย่อรูปให้ด้านยาวไม่เกิน maxSize แล้ว encode เป็น JPEG คืนความกว้าง/สูงของรูปต้นฉบับด้วย
+func MakeThumbnail(data []byte, maxSize int) ([]byte, int, int, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if cfg.Width*cfg.Height > maxThumbnailSourcePixels {
+		return nil, 0, 0, ErrImageTooLarge
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	tw, th := w, h
+	if w >= h && w > maxSize {
+		tw, th = maxSize, max(1, h*maxSize/w)
+	} else if h > w && h > maxSize {
+		tw, th = max(1, w*maxSize/h), maxSize
+	}
+
+	// เฉลี่ยสีของพิกเซลต้นฉบับที่ตกในแต่ละพิกเซลปลายทาง และวางบนพื้นขาวเพราะ JPEG ไม่มี alpha
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		sy0 := bounds.Min.Y + y*h/th
+		sy1 := max(sy0+1, bounds.Min.Y+(y+1)*h/th)
+		for x := 0; x < tw; x++ {
+			sx0 := bounds.Min.X + x*w/tw
+			sx1 := max(sx0+1, bounds.Min.X+(x+1)*w/tw)
+
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			white := 0xffff - a/n
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r/n + white),
+				G: uint16(g/n + white),
+				B: uint16(b/n + white),
+				A: 0xffff,
+			})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, 0, 0, err
+	}
+	return buf.Bytes(), w, h, nil
+}
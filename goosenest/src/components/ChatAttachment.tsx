@@ -0,0 +1,66 @@
+import React, { useEffect, useState } from 'react';
+import FullImageModal from '@/components/FullImageModal';
+
+const BASE_URL = import.meta.env.VITE_API_BASE_URL;
+
+interface ChatAttachmentProps {
+  groupId: string;
+  attachment: {
+    id: string;
+    name: string;
+    content_type: string;
+    size: number;
+    has_thumbnail: boolean;
+  };
+  onLoad?: () => void;
+}
+
+// ไฟล์แนบในแชทเก็บแบบ private ต้องขอลิงก์ชั่วคราวจาก server ก่อนแสดง
+const ChatAttachment: React.FC<ChatAttachmentProps> = ({ groupId, attachment, onLoad }) => {
+  const [urls, setUrls] = useState<{ url: string; thumbnail_url?: string } | null>(null);
+  const [showFull, setShowFull] = useState(false);
+
+  useEffect(() => {
+    let cancelled = false;
+
+    fetch(`${BASE_URL}/chat/groups/${groupId}/attachments/${attachment.id}`, {
+      headers: { Authorization: `Bearer ${localStorage.getItem('token')}` },
+    })
+      .then((res) => (res.ok ? res.json() : Promise.reject(new Error('Failed to load attachment'))))
+      .then((data) => {
+        if (!cancelled) setUrls(data);
+      })
+      .catch((err) => console.error(err));
+
+    return () => {
+      cancelled = true;
+    };
+  }, [groupId, attachment.id]);
+
+  if (!urls) {
+    return <div className="w-[200px] h-[120px] rounded-lg bg-gray-700/50 animate-pulse" />;
+  }
+
+  if (attachment.content_type.startsWith('image/')) {
+    return (
+      <>
+        <img
+          src={urls.thumbnail_url || urls.url}
+          alt={attachment.name}
+          onLoad={onLoad}
+          onClick={() => setShowFull(true)}
+          className="max-w-[200px] max-h-[200px] w-auto h-auto rounded-lg border border-gray-700/50 cursor-pointer transition-opacity hover:opacity-90"
+        />
+        {showFull && <FullImageModal imageUrl={urls.url} alt={attachment.name} onClose={() => setShowFull(false)} />}
+      </>
+    );
+  }
+
+  return (
+    <a href={urls.url} target="_blank" rel="noreferrer" className="underline text-sm">
+      📎 {attachment.name} ({Math.ceil(attachment.size / 1024)} KB)
+    </a>
+  );
+};
+
+export default ChatAttachment;
@@ -4,6 +4,7 @@ import { useLocation, useNavigate } from "react-router-dom";
 
 const WS_BASE_URL = import.meta.env.VITE_WS_BASE_URL;
 const BASE_URL = import.meta.env.VITE_API_BASE_URL;
+const SOCKET_PROTOCOL_VERSION = 1;
 
 const NotificationContext = createContext();
 
@@ -25,7 +26,7 @@ export const NotificationProvider = ({ children }) => {
       return;
     }
 
-    const wsUrl = `${WS_BASE_URL}/ws/listen?email=${encodeURIComponent(email)}`;
+    const wsUrl = `${WS_BASE_URL}/ws/listen?token=${encodeURIComponent(token)}`;
     wsRef.current = new WebSocket(wsUrl);
 
     wsRef.current.onopen = () => {
@@ -34,13 +35,17 @@ export const NotificationProvider = ({ children }) => {
 
     wsRef.current.onmessage = async (event) => {
       try {
-        const message = JSON.parse(event.data);
+        const { v, type, payload } = JSON.parse(event.data);
+        if (v !== SOCKET_PROTOCOL_VERSION) {
+          console.warn("Unsupported socket protocol version:", v);
+          return;
+        }
 
         if (
-          message.type === "new_message_notification" &&
+          type === "new_message_notification" &&
           location.pathname !== "/chat"
         ) {
-          const res = await fetch(`${BASE_URL}/chat/groups/${message.group_id}`, {
+          const res = await fetch(`${BASE_URL}/chat/groups/${payload.group_id}`, {
             headers: {
               Authorization: `Bearer ${token}`,
               "Content-Type": "application/json",
@@ -62,7 +67,7 @@ export const NotificationProvider = ({ children }) => {
               <div
                 onClick={() => {
                   toast.dismiss(t.id);
-                  navigate("/chat", { state: { group_id: message.group_id } });
+                  navigate("/chat", { state: { group_id: payload.group_id } });
                 }}
                 className="cursor-pointer flex items-start gap-3 p-4 bg-white rounded-xl shadow-lg w-80 hover:bg-gray-50 transition duration-200"
               >
@@ -1,4 +1,4 @@
-import React, { useEffect, useState } from 'react';
+import React, { useEffect, useRef, useState } from 'react';
 import { motion, AnimatePresence } from 'framer-motion';
 import { Button } from '@/components/ui/button';
 import { Input } from '@/components/ui/input';
@@ -29,6 +29,15 @@ const gameCategories = [
   { id: 'อื่นๆ', name: 'อื่นๆ', icon: '❓', color: 'from-gray-500 to-gray-700' },
 ];
 
+const LISTING_PAGE_SIZE = 20;
+
+const sortOptions = [
+  { id: 'newest', name: 'ล่าสุด' },
+  { id: 'price_asc', name: 'ราคาต่ำ-สูง' },
+  { id: 'price_desc', name: 'ราคาสูง-ต่ำ' },
+  { id: 'favorites', name: 'ยอดนิยม' },
+];
+
 const Buy = () => {
   const [selectedGame, setSelectedGame] = useState('all');
   const [searchTerm, setSearchTerm] = useState('');
@@ -54,22 +63,18 @@ const Buy = () => {
     setOpenMenuId(openMenuId === id ? null : id);
   }; 
 
-  const filteredProducts = products.filter((product) => {
-    const title = product.listing.title || "";
-    const description = product.listing.description || "";
-    const matchesSearch =
-      title.toLowerCase().includes(searchTerm.toLowerCase()) ||
-      description.toLowerCase().includes(searchTerm.toLowerCase());
-  
-    if (selectedGame === 'favorite') {
-      console.log("like: ", likedPosts);
-      return Array.isArray(likedPosts) && likedPosts.includes(product.listing.id) && matchesSearch;
-    } else if (selectedGame === 'all') {
-      return matchesSearch;
-    } else {
-      return product.listing.game === selectedGame && matchesSearch;
-    }
-  });  
+  const [sortBy, setSortBy] = useState('newest');
+  const [minPrice, setMinPrice] = useState('');
+  const [maxPrice, setMaxPrice] = useState('');
+  const [debouncedSearch, setDebouncedSearch] = useState('');
+  const [nextCursor, setNextCursor] = useState('');
+  const [loadingProducts, setLoadingProducts] = useState(false);
+  const requestIdRef = useRef(0);
+
+  // เกม คำค้นหา ราคา และการเรียงถูกกรองที่ server แล้ว เหลือแค่รายการโปรดที่กรองจากหน้าที่โหลดมา
+  const filteredProducts = selectedGame === 'favorite'
+    ? products.filter((product) => Array.isArray(likedPosts) && likedPosts.includes(product.listing.id))
+    : products;
   
   const [showUserModal, setShowUserModal] = useState(false);
   const [selectedUser, setSelectedUser] = useState(null);
@@ -123,26 +128,49 @@ const Buy = () => {
   }, [products]);
 
   useEffect(() => {
-    const fetchProducts = async () => {
-      try {
-        const res = await axios.get(`${BASE_URL}/listing/all`, {
-          headers: {
-            Authorization: `Bearer ${localStorage.getItem('token')}`,
-          },
-        });
-  
-        const sortedProducts = res.data.sort((a, b) => {
-          return new Date(b.listing.createdAt).getTime() - new Date(a.listing.createdAt).getTime();
-        });
-  
-        setProducts(sortedProducts);
-      } catch (error) {
-        console.error('โหลดข้อมูลล้มเหลว:', error);
-      }
-    };
-  
+    const timer = setTimeout(() => setDebouncedSearch(searchTerm.trim()), 400);
+    return () => clearTimeout(timer);
+  }, [searchTerm]);
+
+  const fetchProducts = async (cursor = '') => {
+    const requestId = ++requestIdRef.current;
+    const params: Record<string, string | number> = { limit: LISTING_PAGE_SIZE, sort: sortBy };
+    if (selectedGame !== 'all' && selectedGame !== 'favorite') params.game = selectedGame;
+    if (debouncedSearch) params.q = debouncedSearch;
+    if (minPrice) params.min_price = minPrice;
+    if (maxPrice) params.max_price = maxPrice;
+    if (cursor) params.cursor = cursor;
+
+    setLoadingProducts(true);
+    try {
+      const res = await axios.get(`${BASE_URL}/listing/all`, {
+        params,
+        headers: {
+          Authorization: `Bearer ${localStorage.getItem('token')}`,
+        },
+      });
+      // ผลของตัวกรองเก่าที่ตอบกลับมาช้าต้องไม่ทับผลล่าสุด
+      if (requestId !== requestIdRef.current) return;
+
+      const items = res.data.items || [];
+      setProducts((prev) => (cursor ? [...prev, ...items] : items));
+      setNextCursor(res.data.nextCursor || '');
+    } catch (error) {
+      if (requestId !== requestIdRef.current) return;
+      console.error('โหลดข้อมูลล้มเหลว:', error);
+      toast({
+        title: 'โหลดสินค้าไม่สำเร็จ',
+        description: error.response?.data?.error || 'กรุณาลองใหม่อีกครั้ง',
+        variant: 'destructive',
+      });
+    } finally {
+      if (requestId === requestIdRef.current) setLoadingProducts(false);
+    }
+  };
+
+  useEffect(() => {
     fetchProducts();
-  }, []);  
+  }, [selectedGame, debouncedSearch, sortBy, minPrice, maxPrice]);
 
   const handlePurchase = (product) => {
     setSelectedProduct(product);
@@ -234,6 +262,36 @@ const Buy = () => {
               />
             </div>
 
+            {/* Sort + Price */}
+            <div className="flex flex-wrap items-center gap-2">
+              <select
+                value={sortBy}
+                onChange={(e) => setSortBy(e.target.value)}
+                className="bg-gray-800/50 border border-gray-600 focus:border-cyan-400 rounded-xl h-10 px-3 text-gray-200"
+              >
+                {sortOptions.map((option) => (
+                  <option key={option.id} value={option.id}>{option.name}</option>
+                ))}
+              </select>
+              <Input
+                type="number"
+                min={0}
+                placeholder="ราคาต่ำสุด"
+                value={minPrice}
+                onChange={(e) => setMinPrice(e.target.value)}
+                className="w-32 bg-gray-800/50 border-gray-600 focus:border-cyan-400 rounded-xl h-10"
+              />
+              <span className="text-gray-500">-</span>
+              <Input
+                type="number"
+                min={0}
+                placeholder="ราคาสูงสุด"
+                value={maxPrice}
+                onChange={(e) => setMaxPrice(e.target.value)}
+                className="w-32 bg-gray-800/50 border-gray-600 focus:border-cyan-400 rounded-xl h-10"
+              />
+            </div>
+
             {/* Game Categories */}
             <div className="flex flex-wrap gap-2 pb-2">
               {gameCategories.map((category) => (
@@ -283,7 +341,20 @@ const Buy = () => {
           />
         ))}
 
-          {filteredProducts.length === 0 && (
+          {nextCursor && (
+            <div className="flex justify-center">
+              <Button
+                variant="outline"
+                disabled={loadingProducts}
+                onClick={() => fetchProducts(nextCursor)}
+                className="border-gray-600 text-gray-300 hover:border-cyan-400 hover:text-cyan-400 bg-gray-800/30 rounded-xl"
+              >
+                {loadingProducts ? 'กำลังโหลด...' : 'โหลดเพิ่ม'}
+              </Button>
+            </div>
+          )}
+
+          {!loadingProducts && filteredProducts.length === 0 && (
             <div className="text-center py-16">
               <Gamepad2 size={64} className="mx-auto text-gray-600 mb-4" />
               <h3 className="text-xl text-gray-400 mb-2">ไม่พบสินค้า</h3>
@@ -9,9 +9,16 @@ import { useIsMobile } from "@/hooks/use-mobile";
 import UserProfileView from "@/components/UserProfileView";
 import { useLocation, useNavigate } from "react-router-dom";
 import ConfirmDialog from "@/components/ConfirmDialog";
+import ChatAttachment from "@/components/ChatAttachment";
 
 const BASE_URL = import.meta.env.VITE_API_BASE_URL;
 const WS_BASE_URL = import.meta.env.VITE_WS_BASE_URL;
+const SOCKET_PROTOCOL_VERSION = 1;
+const INBOX_PAGE_SIZE = 30;
+
+const sendSocketEvent = (ws: WebSocket, type: string, id: string, payload: unknown) => {
+  ws.send(JSON.stringify({ v: SOCKET_PROTOCOL_VERSION, type, id, payload }));
+};
 
 const Chat = () => {
   const isMobile = useIsMobile();
@@ -22,6 +29,7 @@ const Chat = () => {
   const fileInputRef = useRef<HTMLInputElement>(null);
   const scrollAreaRef = useRef<HTMLDivElement>(null);
   const socketRef = useRef<WebSocket | null>(null);
+  const lastSeenRef = useRef<Record<string, string>>({});
   const [selectedUser, setSelectedUser] = useState(null);
   const [userProducts, setUserProducts] = useState([]);
   const [showUserModal, setShowUserModal] = useState(false);
@@ -36,6 +44,10 @@ const Chat = () => {
   const currentEmail = localStorage.getItem("email");
 
   const [teams, setTeams] = useState([]);
+  const [inboxCursor, setInboxCursor] = useState<string | null>(null);
+  const [loadingTeams, setLoadingTeams] = useState(false);
+  // โหลดหน้าถัดไปแล้ว การรีเฟรชหน้าแรกจะไม่ย้อน cursor กลับ
+  const loadedMoreRef = useRef(false);
 
   useEffect(() => {
     if (location.state?.group_id) {
@@ -75,12 +87,16 @@ const Chat = () => {
       })
     );
   
-    setMemberProfiles(profiles); 
+    setMemberProfiles((prev) => ({ ...prev, ...profiles }));
   };  
 
-  const fetchTeams = async () => {
+  const fetchTeams = async (cursor?: string) => {
+    setLoadingTeams(true);
     try {
-      const response = await fetch(`${BASE_URL}/chat/groups`, {
+      const params = new URLSearchParams({ limit: String(INBOX_PAGE_SIZE) });
+      if (cursor) params.set("cursor", cursor);
+
+      const response = await fetch(`${BASE_URL}/chat/groups?${params.toString()}`, {
         method: "GET",
         headers: {
           "Authorization": `Bearer ${localStorage.getItem("token")}`,
@@ -92,19 +108,24 @@ const Chat = () => {
         throw new Error("Failed to fetch teams");
       }
 
-      const data = await response.json();
+      // server เรียงตามความเคลื่อนไหวล่าสุดมาให้แล้ว
+      const { items, next_cursor } = await response.json();
+      const ids = new Set(items.map((team) => team.id));
 
-      const sortedTeams = data.sort((a, b) => {
-        const aTime = a.last_message_at || a.created_at;
-        const bTime = b.last_message_at || b.created_at;
-        return new Date(bTime).getTime() - new Date(aTime).getTime();
-      });
-
-      setTeams(sortedTeams);
-      fetchAndSetProfiles(sortedTeams);
+      setTeams((prevTeams) =>
+        cursor
+          ? [...prevTeams.filter((team) => !ids.has(team.id)), ...items]
+          // รีเฟรชหน้าแรก คงกลุ่มจากหน้าที่โหลดเพิ่มไว้ต่อท้าย
+          : [...items, ...prevTeams.filter((team) => !ids.has(team.id))]
+      );
+      if (cursor) loadedMoreRef.current = true;
+      if (cursor || !loadedMoreRef.current) setInboxCursor(next_cursor || null);
+      fetchAndSetProfiles(items);
 
     } catch (error) {
       console.error("Error fetching teams:", error);
+    } finally {
+      setLoadingTeams(false);
     }
   };
 
@@ -115,23 +136,22 @@ const Chat = () => {
   useEffect(() => {
     if (!currentEmail) return;
   
-    const ws = new WebSocket(`${WS_BASE_URL}/ws/watch-new-groups?email=${currentEmail}`);
+    const ws = new WebSocket(`${WS_BASE_URL}/ws/watch-new-groups?token=${encodeURIComponent(localStorage.getItem("token") ?? "")}`);
     console.log("Connected to new group listener");
   
     ws.onmessage = (event) => {
-      const message = JSON.parse(event.data);
-      console.log("New group message received:", message);
+      const { type, payload: group } = JSON.parse(event.data);
   
-      if (message.type === "new_group_created") {
+      if (type === "new_group_created") {
         const newGroup = {
-          id: message.group.id,
-          name: message.group.name,
-          product_id: message.group.product_id,
-          cover_image: message.group.cover_image,
-          created_at: message.group.created_at,
-          last_message_at: message.group.last_message_at || message.group.created_at,
-          members: message.group.members || [],
-          read_status: message.group.read_status || {},
+          id: group.id,
+          name: group.name,
+          product_id: group.product_id,
+          cover_image: group.cover_image,
+          created_at: group.created_at,
+          last_message_at: group.last_message_at || group.created_at,
+          members: group.members || [],
+          read_status: group.read_status || {},
         };
   
         setTeams(prevTeams => {
@@ -158,36 +178,21 @@ const Chat = () => {
   useEffect(() => {
     if (!currentEmail) return;
   
-    const ws = new WebSocket(`${WS_BASE_URL}/ws/listen?email=${currentEmail}`);
+    const ws = new WebSocket(`${WS_BASE_URL}/ws/listen?token=${encodeURIComponent(localStorage.getItem("token") ?? "")}`);
     console.log("Connected to global message listener");
   
     ws.onmessage = (event) => {
-      const message = JSON.parse(event.data);
+      const { type, payload } = JSON.parse(event.data);
       
-      if (message.type === "new_message_notification") {
-        setTeams((prevTeams) =>
-          prevTeams
-            .map(team =>
-              team.id === message.group_id
-                ? {
-                    ...team,
-                    last_message_at: message.timestamp,
-                  }
-                : team
-            )
-            .sort((a, b) =>
-              new Date(b.last_message_at).getTime() - new Date(a.last_message_at).getTime()
-            )
-        );
-      } else {
+      if (type === "new_message_notification") {
         setTeams((prevTeams) =>
           prevTeams
             .map(team =>
-              team.id === message.group_id
+              team.id === payload.group_id
                 ? {
                     ...team,
-                    messages: [...(team.messages || []), message],
-                    last_message_at: message.timestamp,
+                    last_message_at: payload.timestamp,
+                    unread_count: (team.unread_count || 0) + 1,
                   }
                 : team
             )
@@ -212,53 +217,123 @@ const Chat = () => {
       socketRef.current = null;
     }
   
-    const ws = new WebSocket(`${WS_BASE_URL}/ws/chat?group_id=${selectedTeam}&email=${currentEmail}`);
-    socketRef.current = ws;
-  
-    ws.onopen = () => {
-      console.log("WebSocket connected to group");
-    };
-  
-    ws.onmessage = (event) => {
-      const message = JSON.parse(event.data);
-      console.log("Group message received:");
-  
-      setTeams((prevTeams) => {
-        const updatedTeams = [...prevTeams];
-        const teamIndex = updatedTeams.findIndex(team => team.id === message.group_id);
-  
-        if (teamIndex === -1) return prevTeams;
-  
-        const updatedTeam = { ...updatedTeams[teamIndex] };
-  
-        updatedTeam.messages = [...(updatedTeam.messages || []), message];
-        updatedTeam.last_message_at = message.timestamp; 
-  
-        updatedTeams[teamIndex] = updatedTeam;
-  
-        return updatedTeams.sort((a, b) =>
-          new Date(b.last_message_at).getTime() - new Date(a.last_message_at).getTime()
-        );
-      });
-  
-      scrollToBottom();
-    };
-  
-    ws.onclose = () => {
-      console.log("WebSocket disconnected");
-    };
-  
-    ws.onerror = (error) => {
-      console.error("WebSocket error:", error);
+    let closedByEffect = false;
+    let retryTimer: ReturnType<typeof setTimeout>;
+
+    // เชื่อมต่อใหม่อัตโนมัติ พร้อมส่ง last_seen เพื่อรับข้อความที่พลาดไประหว่างหลุด
+    const connect = () => {
+      const lastSeen = lastSeenRef.current[selectedTeam];
+      const ws = new WebSocket(
+        `${WS_BASE_URL}/ws/chat?group_id=${selectedTeam}&token=${encodeURIComponent(localStorage.getItem("token") ?? "")}` +
+          (lastSeen ? `&last_seen=${lastSeen}` : "")
+      );
+      socketRef.current = ws;
+
+      ws.onopen = () => {
+        console.log("WebSocket connected to group");
+      };
+
+      ws.onmessage = (event) => {
+        const { type, id, payload } = JSON.parse(event.data);
+
+        switch (type) {
+          case "message":
+            lastSeenRef.current[payload.group_id] = payload.id;
+            setTeams((prevTeams) => {
+              const updatedTeams = [...prevTeams];
+              const teamIndex = updatedTeams.findIndex(team => team.id === payload.group_id);
+
+              if (teamIndex === -1) return prevTeams;
+
+              const updatedTeam = { ...updatedTeams[teamIndex] };
+              if ((updatedTeam.messages || []).some(m => m.id === payload.id)) return prevTeams;
+
+              updatedTeam.messages = [...(updatedTeam.messages || []), payload];
+              updatedTeam.last_message_at = payload.timestamp;
+
+              updatedTeams[teamIndex] = updatedTeam;
+
+              return updatedTeams.sort((a, b) =>
+                new Date(b.last_message_at).getTime() - new Date(a.last_message_at).getTime()
+              );
+            });
+            // ข้อความที่มาถึงห้องที่เปิดอยู่ถือว่าอ่านแล้ว
+            sendSocketEvent(ws, "read_receipt", "", { message_id: payload.id });
+            scrollToBottom();
+            break;
+          case "read_receipt":
+            setTeams(prevTeams =>
+              prevTeams.map(team =>
+                team.id === payload.group_id
+                  ? {
+                      ...team,
+                      last_read: {
+                        ...(team.last_read || {}),
+                        [encodeEmailKey(payload.email)]: { message_id: payload.message_id, timestamp: payload.read_at },
+                      },
+                    }
+                  : team
+              )
+            );
+            break;
+          case "ack":
+            lastSeenRef.current[selectedTeam] = payload.message_id;
+            updateMessageByClientId(id, { id: payload.message_id, timestamp: payload.timestamp, status: "sent" });
+            break;
+          case "catch_up_complete":
+            if (payload.has_more) fetchMessages(selectedTeam);
+            break;
+          case "error":
+            console.error("WebSocket error event:", payload);
+            if (id) updateMessageByClientId(id, { status: "failed" });
+            break;
+          case "trade_status":
+            setTeams(prevTeams =>
+              prevTeams.map(team =>
+                team.id === payload.group_id
+                  ? {
+                      ...team,
+                      ...(payload.buyer_confirmed !== undefined && { buyer_confirmed: payload.buyer_confirmed }),
+                      ...(payload.seller_confirmed !== undefined && { seller_confirmed: payload.seller_confirmed }),
+                      ...(payload.escrow_status && { escrow_status: payload.escrow_status }),
+                    }
+                  : team
+              )
+            );
+            break;
+        }
+      };
+
+      ws.onclose = () => {
+        console.log("WebSocket disconnected");
+        if (!closedByEffect) retryTimer = setTimeout(connect, 2000);
+      };
+
+      ws.onerror = (error) => {
+        console.error("WebSocket error:", error);
+      };
     };
-  
+
+    connect();
+
     return () => {
-      ws.close();
+      closedByEffect = true;
+      clearTimeout(retryTimer);
+      socketRef.current?.close();
     };
   }, [selectedTeam]);  
 
   const selectedTeamData = teams.find(team => team.id === selectedTeam);
 
+  const updateMessageByClientId = (clientId: string, changes: object) => {
+    setTeams(prevTeams =>
+      prevTeams.map(team => ({
+        ...team,
+        messages: (team.messages || []).map(m => (m.client_id === clientId ? { ...m, ...changes } : m)),
+      }))
+    );
+  };
+
   const scrollToBottom = () => {
     if (scrollAreaRef.current) {
       scrollAreaRef.current.scrollTop = scrollAreaRef.current.scrollHeight;
@@ -279,10 +354,12 @@ const Chat = () => {
     }
   
     const messageToSend = {
+      client_id: crypto.randomUUID(),
       content: newMessage.trim(),
       group_id: selectedTeam,
       timestamp: new Date().toISOString(),
       senderEmail: currentEmail,
+      status: "pending",
     };
   
     const encodedEmail = encodeEmailKey(currentEmail);
@@ -306,7 +383,7 @@ const Chat = () => {
         )
     );
   
-    socketRef.current.send(JSON.stringify(messageToSend));
+    sendSocketEvent(socketRef.current, "message", messageToSend.client_id, { content: messageToSend.content });
     setNewMessage("");
   
     scrollToBottom();
@@ -351,7 +428,10 @@ const Chat = () => {
         throw new Error("Failed to fetch messages");
       }
 
-      const messages = await response.json();
+      const { messages } = await response.json();
+      if (messages.length > 0) {
+        lastSeenRef.current[selectedTeam] = messages[messages.length - 1].id;
+      }
     
       setTeams((prevTeams) =>
         prevTeams.map((team) =>
@@ -372,10 +452,57 @@ const Chat = () => {
     fileInputRef.current?.click();
   };
 
-  const handleImageChange = (e: React.ChangeEvent<HTMLInputElement>) => {
+  const handleImageChange = async (e: React.ChangeEvent<HTMLInputElement>) => {
     const file = e.target.files?.[0];
-    if (file) {
-      console.log("Image selected:", file.name);
+    e.target.value = "";
+    if (!file || !selectedTeam) return;
+    if (!socketRef.current || socketRef.current.readyState !== WebSocket.OPEN) {
+      console.warn("WebSocket is not connected");
+      return;
+    }
+
+    try {
+      const formData = new FormData();
+      formData.append("file", file);
+
+      const response = await fetch(`${BASE_URL}/chat/groups/${selectedTeam}/attachments`, {
+        method: "POST",
+        headers: {
+          Authorization: `Bearer ${localStorage.getItem("token")}`,
+        },
+        body: formData,
+      });
+      const attachment = await response.json();
+      if (!response.ok) {
+        throw new Error(attachment.error || "Failed to upload attachment");
+      }
+
+      const messageToSend = {
+        client_id: crypto.randomUUID(),
+        content: "",
+        attachment: { ...attachment, has_thumbnail: attachment.content_type.startsWith("image/") },
+        group_id: selectedTeam,
+        timestamp: new Date().toISOString(),
+        senderEmail: currentEmail,
+        status: "pending",
+      };
+
+      setTeams(prevTeams =>
+        prevTeams.map(team =>
+          team.id === selectedTeam
+            ? {
+                ...team,
+                messages: [...(team.messages || []), messageToSend],
+                last_message_at: messageToSend.timestamp,
+              }
+            : team
+        )
+      );
+
+      sendSocketEvent(socketRef.current, "message", messageToSend.client_id, { attachment_id: attachment.id });
+      scrollToBottom();
+    } catch (error) {
+      console.error("อัปโหลดไฟล์ไม่สำเร็จ:", error);
     }
   };
 
@@ -396,13 +523,15 @@ const Chat = () => {
     }
   
     const messageToSend = {
+      client_id: crypto.randomUUID(),
       content,
       group_id: groupId,
       timestamp: new Date().toISOString(),
       senderEmail: currentEmail,
+      status: "pending",
     };
   
-    socketRef.current.send(JSON.stringify(messageToSend));
+    sendSocketEvent(socketRef.current, "message", messageToSend.client_id, { content });
   
     setTeams(prevTeams =>
       prevTeams.map(team =>
@@ -487,6 +616,7 @@ const Chat = () => {
         if (team.id === teamId) {
           return {
             ...team,
+            unread_count: 0,
             read_status: {
               ...(team.read_status || {}),
               [encodedEmail]: new Date().toISOString(),
@@ -577,17 +707,7 @@ const Chat = () => {
           <ScrollArea className="flex-1 overflow-y-auto">
             <div className="p-4 space-y-3">
             {teams.map((team, index) => {
-              const encodedEmail = encodeEmailKey(currentEmail);
-              const userReadTime = team.read_status?.[encodedEmail]
-                ? new Date(team.read_status[encodedEmail]).getTime()
-                : 0;
-
-              const lastMessageTime = team.last_message_at
-                ? new Date(team.last_message_at).getTime()
-                : 0;
-
-              const hasUnread =
-                lastMessageTime > userReadTime && selectedTeam !== team.id;
+              const hasUnread = (team.unread_count || 0) > 0 && selectedTeam !== team.id;
 
               const otherMembers = team.members.filter((member) => member !== currentEmail);
               const firstOtherMember = otherMembers.length > 0 ? otherMembers[0] : null;
@@ -647,6 +767,19 @@ const Chat = () => {
                 </motion.div>
               );
             })}
+
+            {inboxCursor && (
+              <div className="flex justify-center pt-2">
+                <Button
+                  variant="outline"
+                  disabled={loadingTeams}
+                  onClick={() => fetchTeams(inboxCursor)}
+                  className="border-gray-600 text-gray-300 hover:border-cyan-400 hover:text-cyan-400 bg-gray-800/30 rounded-xl"
+                >
+                  {loadingTeams ? 'กำลังโหลด...' : 'โหลดเพิ่ม'}
+                </Button>
+              </div>
+            )}
           </div>
           </ScrollArea>
         </motion.div>
@@ -753,7 +886,16 @@ const Chat = () => {
                               }`}
                               whileHover={{ scale: 1.02 }}
                             >
-                              {message.content.startsWith("https://goosenest.s3.ap-southeast-2.amazonaws.com/") ? (
+                              {message.attachment ? (
+                                <div className="space-y-2">
+                                  <ChatAttachment
+                                    groupId={selectedTeamData.id}
+                                    attachment={message.attachment}
+                                    onLoad={scrollToBottom}
+                                  />
+                                  {message.content && <p className="text-sm leading-relaxed">{message.content}</p>}
+                                </div>
+                              ) : message.content.startsWith("https://goosenest.s3.ap-southeast-2.amazonaws.com/") ? (
                                 <motion.img
                                   onClick={() => {
                                     // setFullImageSrc_message(message.content);
@@ -861,7 +1003,7 @@ const Chat = () => {
 
                 <input
                   type="file"
-                  accept="image/*"
+                  accept="image/jpeg,image/png,image/gif,application/pdf"
                   onChange={handleImageChange}
                   ref={fileInputRef}
                   className="hidden"
@@ -272,13 +272,14 @@ const Sell = () => {
     }
   }
   
+  // สถานะของสินค้าที่แก้ไขคงเดิม เปลี่ยนได้จาก escrow หรือผู้ดูแลเท่านั้น
   const newListing = {
     game: formData.game,
     title: formData.title,
     price: parseInt(formData.price),
     description: formData.description,
     images: uploadedImageURLs,
-    status: 'active',
+    ...(editingListing ? {} : { status: 'active' }),
     bankAccount: selectedAccount.id,
     formType: formData.formType,            
     username: formData.username || '',        
@@ -366,32 +367,6 @@ const Sell = () => {
     }
   };  
 
-  const handleRefundAction = async (listingId: string, action: 'approve' | 'reject') => {
-    try {
-      await axios.put(`${BASE_URL}/listing/${listingId}/refund`, 
-        { action },
-        {
-          headers: {
-            Authorization: `Bearer ${localStorage.getItem('token')}`,
-          },
-        }
-      );
-
-      toast({
-        title: action === 'approve' ? 'อนุมัติการคืนเงินแล้ว' : 'ปฏิเสธการคืนเงินแล้ว',
-        description: action === 'approve' ? 'เงินจะถูกโอนคืนให้ลูกค้า' : 'การขอคืนเงินถูกปฏิเสธ',
-      });
-
-      fetchListings();
-    } catch {
-      toast({
-        title: 'เกิดข้อผิดพลาด',
-        description: 'ไม่สามารถดำเนินการได้',
-        variant: 'destructive',
-      });
-    }
-  };
-
   const handleInputChange = (e) => {
     const { name, value } = e.target;
     setFormData(prev => ({
@@ -415,7 +390,7 @@ const Sell = () => {
   });
 
   const canEdit = (status: string) => status === 'active';
-  const canDelete = (status: string) => status === 'active' || status === 'inactive';
+  const canDelete = (status: string) => status === 'active' || status === 'hidden' || status === 'draft';
 
   return (
     <div className="min-h-screen bg-gradient-to-br from-gray-900 via-black to-gray-900 text-white">
@@ -733,14 +708,18 @@ const Sell = () => {
                               ? "bg-green-500/80 text-white"
                               : listing.status === "sold"
                               ? "bg-blue-500/80 text-white"
-                              : listing.status === "refund"
+                              : listing.status === "reserved"
                               ? "bg-yellow-500/80 text-white"
+                              : listing.status === "hidden" || listing.status === "draft"
+                              ? "bg-gray-500/80 text-white"
                               : "bg-red-500/80 text-white"
                           )}
                         >
                           {listing.status === "active" ? "พร้อมขาย" 
                            : listing.status === "sold" ? "ขายแล้ว"
-                           : listing.status === "refund" ? "ขอเงินคืน"
+                           : listing.status === "reserved" ? "กำลังซื้อขาย"
+                           : listing.status === "hidden" ? "ซ่อนอยู่"
+                           : listing.status === "draft" ? "ฉบับร่าง"
                            : "โดนระงับ"}
                         </div>
                         <div className="px-3 py-1 rounded-full text-xs font-medium backdrop-blur-sm bg-blue-500/80 text-white">
@@ -795,51 +774,27 @@ const Sell = () => {
 
                         {/* Conditional Action Buttons */}
                         <div className="flex space-x-2 pt-3">
-                          {listing.status === 'refund' ? (
-                            <>
-                              <Button
-                                size="sm"
-                                className="flex-1 bg-green-500 hover:bg-green-600 text-white rounded-lg"
-                                onClick={() => handleRefundAction(listing.id, 'approve')}
-                              >
-                                <CheckCircle size={14} className="mr-1" />
-                                อนุมัติคืนเงิน
-                              </Button>
-                              <Button
-                                size="sm"
-                                variant="outline"
-                                className="flex-1 border-red-400 text-red-400 hover:bg-red-400 hover:text-white rounded-lg"
-                                onClick={() => handleRefundAction(listing.id, 'reject')}
-                              >
-                                <XCircle size={14} className="mr-1" />
-                                ปฏิเสธ
-                              </Button>
-                            </>
-                          ) : (
-                            <>
-                              {canEdit(listing.status) && (
-                                <Button
-                                  size="sm"
-                                  variant="outline"
-                                  className="flex-1 border-cyan-400 text-cyan-400 hover:bg-cyan-400 hover:text-black rounded-lg"
-                                  onClick={() => handleEditListing(listing)}
-                                >
-                                  <Edit size={14} className="mr-1" />
-                                  แก้ไข
-                                </Button>
-                              )}
-                              {canDelete(listing.status) && (
-                                <Button 
-                                  size="sm" 
-                                  variant="outline" 
-                                  className="flex-1 border-red-400 text-red-400 hover:bg-red-400 hover:text-white rounded-lg"
-                                  onClick={() => handleDelete(listing.id)}
-                                >
-                                  <Trash2 size={14} className="mr-1" />
-                                  ลบ
-                                </Button>
-                              )}
-                            </>
+                          {canEdit(listing.status) && (
+                            <Button
+                              size="sm"
+                              variant="outline"
+                              className="flex-1 border-cyan-400 text-cyan-400 hover:bg-cyan-400 hover:text-black rounded-lg"
+                              onClick={() => handleEditListing(listing)}
+                            >
+                              <Edit size={14} className="mr-1" />
+                              แก้ไข
+                            </Button>
+                          )}
+                          {canDelete(listing.status) && (
+                            <Button 
+                              size="sm" 
+                              variant="outline" 
+                              className="flex-1 border-red-400 text-red-400 hover:bg-red-400 hover:text-white rounded-lg"
+                              onClick={() => handleDelete(listing.id)}
+                            >
+                              <Trash2 size={14} className="mr-1" />
+                              ลบ
+                            </Button>
                           )}
                         </div>
                       </div>
@@ -881,6 +836,7 @@ const filterOptions = [
   { id: 'all', name: 'ทั้งหมด', icon: Package, color: 'from-gray-500 to-gray-600' },
   { id: 'active', name: 'กำลังขาย', icon: ShoppingCart, color: 'from-green-500 to-emerald-600' },
   { id: 'sold', name: 'ขายออกแล้ว', icon: CheckCircle, color: 'from-blue-500 to-indigo-600' },
-  { id: 'refund', name: 'ขอเงินคืน', icon: RefreshCw, color: 'from-yellow-500 to-orange-600' },
-  { id: 'inactive', name: 'โดนระงับการขาย', icon: XCircle, color: 'from-red-500 to-pink-600' },
+  { id: 'reserved', name: 'กำลังซื้อขาย', icon: RefreshCw, color: 'from-yellow-500 to-orange-600' },
+  { id: 'hidden', name: 'ซ่อนอยู่', icon: AlertTriangle, color: 'from-gray-500 to-gray-700' },
+  { id: 'removed', name: 'โดนระงับการขาย', icon: XCircle, color: 'from-red-500 to-pink-600' },
 ];
\ No newline at end of file